@@ -43,12 +43,9 @@ func Init(serviceName string) error {
 	api.DefaultClient = apiClient
 
 	// Load config
-	var configRsp map[string]interface{}
-	_, err = api.Get(fmt.Sprintf("service.config/read/%s", serviceName), &configRsp)
-	if err != nil {
+	if err := LoadConfig(serviceName); err != nil {
 		return err
 	}
-	config.DefaultProvider = config.New(configRsp)
 
 	// Connect to Redis
 	if config.Has("redis.host") {
@@ -66,6 +63,19 @@ func Init(serviceName string) error {
 	return nil
 }
 
+// LoadConfig reads the service's config from service.config and makes it the
+// default provider. It can be called again to pick up changes to the config
+// but the provider is not safe to replace while other goroutines read it.
+func LoadConfig(serviceName string) error {
+	var configRsp map[string]interface{}
+	if _, err := api.Get(fmt.Sprintf("service.config/read/%s", serviceName), &configRsp); err != nil {
+		return err
+	}
+
+	config.DefaultProvider = config.New(configRsp)
+	return nil
+}
+
 // Run takes a number of processes and concurrently runs them all. It will stop if all processes
 // terminate or if a signal (SIGINT or SIGTERM) is received.
 func Run(processes ...Process) {
@@ -11,6 +11,10 @@ type Error struct {
 	Code     string            `json:"code"`
 	Message  string            `json:"message"`
 	Metadata map[string]string `json:"metadata"`
+
+	// Retryable is whether the same request might succeed if it is
+	// made again, e.g. because the error was caused by transient I/O
+	Retryable bool `json:"retryable,omitempty"`
 }
 
 // Error returns a string message of the error
@@ -72,51 +76,105 @@ const (
 
 // InternalService creates a new error to represent an internal service error
 func InternalService(format string, a ...interface{}) *Error {
-	return newError(ErrInternalService, format, a)
+	return newError(ErrInternalService, format, a...)
 }
 
 // BadRequest creates a new error to represent an error caused by the client sending
 // an invalid request. This is non-retryable unless the request is modified.
 func BadRequest(format string, a ...interface{}) *Error {
-	return newError(ErrBadRequest, format, a)
+	return newError(ErrBadRequest, format, a...)
 }
 
 // Forbidden creates a new error representing a resource that cannot be accessed with
 // the current authorisation credentials. The user may need authorising, or if authorised,
 // may not be permitted to perform this action.
 func Forbidden(format string, a ...interface{}) *Error {
-	return newError(ErrForbidden, format, a)
+	return newError(ErrForbidden, format, a...)
 }
 
 // NotFound creates a new error representing a resource that cannot be found
 func NotFound(format string, a ...interface{}) *Error {
-	return newError(ErrNotFound, format, a)
+	return newError(ErrNotFound, format, a...)
 }
 
 // PreconditionFailed creates a new error indicating that one or more conditions
 // given in the request evaluated to false when tested on the server
 func PreconditionFailed(format string, a ...interface{}) *Error {
-	return newError(ErrPreconditionFailed, format, a)
+	return newError(ErrPreconditionFailed, format, a...)
 }
 
 // Timeout creates a new error representing a timeout from client to server
 func Timeout(format string, a ...interface{}) *Error {
-	return newError(ErrTimeout, format, a)
+	return newError(ErrTimeout, format, a...)
 }
 
 // Unauthorized creates a new error indicating that authentication is required,
 // but has either failed or not been provided.
 func Unauthorized(format string, a ...interface{}) *Error {
-	return newError(ErrUnauthorized, format, a)
+	return newError(ErrUnauthorized, format, a...)
 }
 
+// Wrap converts the error to an Error with the given metadata. If err is already
+// an Error, its code, message and whether it is retryable are kept, and the
+// metadata is merged with its existing metadata, keeping the existing value of
+// any key that is in both. Otherwise, the new Error is an internal service error.
 func Wrap(err error, metadata map[string]string) *Error {
-	return &Error{ErrInternalService, err.Error(), metadata}
+	if e, ok := err.(*Error); ok {
+		return &Error{
+			Code:      e.Code,
+			Message:   e.Message,
+			Metadata:  mergeMetadata(e.Metadata, metadata),
+			Retryable: e.Retryable,
+		}
+	}
+
+	return &Error{
+		Code:     ErrInternalService,
+		Message:  err.Error(),
+		Metadata: mergeMetadata(nil, metadata),
+	}
+}
+
+// MarkRetryable wraps the error in the same way as Wrap
+// and marks it as worth retrying. See Retryable.
+func MarkRetryable(err error, metadata map[string]string) *Error {
+	e := Wrap(err, metadata)
+	e.Retryable = true
+	return e
+}
+
+// Retryable returns whether the error was marked as worth retrying.
+// Errors that are not an Error are never retryable.
+func Retryable(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Retryable
+}
+
+// mergeMetadata returns a new map with all entries from current and
+// any entries from new whose keys are not already in current
+func mergeMetadata(current, new map[string]string) map[string]string {
+	if len(current) == 0 && len(new) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]string, len(current)+len(new))
+	for k, v := range new {
+		merged[k] = v
+	}
+	for k, v := range current {
+		merged[k] = v
+	}
+
+	return merged
 }
 
 // newError returns a new Error with the given code. The message is formatted using Sprintf.
 // If the last parameter is a map[string]string, it is assumed to be the error params.
 func newError(code, format string, params ...interface{}) *Error {
+	if len(params) == 0 {
+		return &Error{Code: code, Message: format}
+	}
+
 	// Take the last parameter
 	last := params[len(params)-1]
 
@@ -134,5 +192,5 @@ func newError(code, format string, params ...interface{}) *Error {
 		message = fmt.Sprintf(format, params...)
 	}
 
-	return &Error{code, message, metadata}
+	return &Error{Code: code, Message: message, Metadata: metadata}
 }
@@ -0,0 +1,73 @@
+package errors
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		err  *Error
+		want int
+	}{
+		{BadRequest("foo"), http.StatusBadRequest},
+		{Forbidden("foo"), http.StatusForbidden},
+		{InternalService("foo"), http.StatusInternalServerError},
+		{NotFound("foo"), http.StatusNotFound},
+		{PreconditionFailed("foo"), http.StatusPreconditionFailed},
+		{Timeout("foo"), http.StatusRequestTimeout},
+		{Unauthorized("foo"), http.StatusUnauthorized},
+		{&Error{Code: "unknown"}, http.StatusInternalServerError},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.err.Code, func(t *testing.T) {
+			assert.Equal(t, tc.err.HTTPStatus(), tc.want)
+		})
+	}
+}
+
+func TestNewErrorFormat(t *testing.T) {
+	err := BadRequest("invalid %s", "limit")
+	assert.Equal(t, err.Code, ErrBadRequest)
+	assert.Equal(t, err.Message, "invalid limit")
+	assert.Equal(t, err.Error(), "bad_request: invalid limit")
+}
+
+func TestWrap(t *testing.T) {
+	// Errors that are not an Error become internal service errors
+	err := Wrap(fmt.Errorf("boom"), map[string]string{"service": "foo"})
+	assert.Equal(t, err.Code, ErrInternalService)
+	assert.Equal(t, err.Message, "boom")
+	assert.DeepEqual(t, err.Metadata, map[string]string{"service": "foo"})
+
+	// Wrapping an Error keeps its code and merges the metadata
+	inner := &Error{Code: ErrBadRequest, Message: "invalid limit", Metadata: map[string]string{"limit": "-1"}}
+	err = Wrap(inner, map[string]string{"limit": "ignored", "service": "foo"})
+	assert.Equal(t, err.Code, ErrBadRequest)
+	assert.Equal(t, err.Message, "invalid limit")
+	assert.DeepEqual(t, err.Metadata, map[string]string{"limit": "-1", "service": "foo"})
+
+	// Nested wraps keep all of the keys
+	err = Wrap(err, map[string]string{"request": "123"})
+	assert.DeepEqual(t, err.Metadata, map[string]string{"limit": "-1", "service": "foo", "request": "123"})
+
+	// The original error is not modified
+	assert.DeepEqual(t, inner.Metadata, map[string]string{"limit": "-1"})
+}
+
+func TestRetryable(t *testing.T) {
+	assert.Assert(t, !Retryable(fmt.Errorf("boom")))
+	assert.Assert(t, !Retryable(InternalService("boom")))
+
+	err := MarkRetryable(fmt.Errorf("read failed"), map[string]string{"filename": "messages"})
+	assert.Assert(t, Retryable(err))
+	assert.Equal(t, err.Code, ErrInternalService)
+	assert.DeepEqual(t, err.Metadata, map[string]string{"filename": "messages"})
+
+	// Wrapping keeps the error retryable
+	assert.Assert(t, Retryable(Wrap(err, map[string]string{"service": "foo"})))
+}
@@ -12,46 +12,36 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
+// MaxBodyBytes is the largest request body that Decode will read.
+// Larger bodies are rejected with a BadRequest error.
+var MaxBodyBytes int64 = 1 << 20 // 1MB
+
 // Decode unmarshals URL parameters and the JSON body of the given request into the output interface.
 // Parameters can be unmarshalled into primitive types or time.Time providing it conforms to time.RFC3339.
+// Values in the body take precedence over query parameters, which take precedence over route parameters.
+// The result is then checked with Validate.
 func Decode(r *http.Request, v interface{}) error {
-	// This does a load of reflection to unmarshal a map into the type of v
-	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		DecodeHook:       mapstructure.StringToTimeHookFunc(time.RFC3339),
-		WeaklyTypedInput: true,
-		Result:           v,
+	if err := decode(r, v); err != nil {
+		return err
+	}
 
-		// Override the TagName to match the one used by the encoding/json package
-		// so users of this function only have to define a single tag on struct fields
-		TagName: "json",
-	})
+	return Validate(v)
+}
+
+func decode(r *http.Request, v interface{}) error {
+	decoder, err := newDecoder(v)
 	if err != nil {
-		return errors.Wrap(err, nil)
+		return err
 	}
 
 	// Unmarshal route parameters
 	if err := decoder.Decode(mux.Vars(r)); err != nil {
-		return errors.Wrap(err, nil)
-	}
-
-	// Query parameters come out as a map[string][]string so we loop through them all
-	// to remove the unnecessary slice if the parameter just has a single value
-	paramSlices := r.URL.Query()
-	params := map[string]interface{}{}
-	for key, value := range paramSlices {
-		switch len(value) {
-		case 0:
-			params[key] = nil
-		case 1:
-			params[key] = value[0]
-		default:
-			params[key] = value
-		}
+		return errors.BadRequest("invalid route parameters: %v", err)
 	}
 
 	// Unmarshal query parameters
-	if err := decoder.Decode(params); err != nil {
-		return errors.Wrap(err, nil)
+	if err := DecodeQuery(r, v); err != nil {
+		return err
 	}
 
 	// If there's no body, return early
@@ -59,10 +49,14 @@ func Decode(r *http.Request, v interface{}) error {
 		return nil
 	}
 
-	// Read the body of the request
+	// Read the body of the request, stopping if it is too large. A nil
+	// ResponseWriter is fine because the connection is left to the server.
 	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, MaxBodyBytes))
 	if err != nil {
+		if int64(len(body)) >= MaxBodyBytes {
+			return errors.BadRequest("request body must not be larger than %d bytes", MaxBodyBytes)
+		}
 		return errors.Wrap(err, nil)
 	}
 
@@ -73,8 +67,58 @@ func Decode(r *http.Request, v interface{}) error {
 
 	// Assume the body is JSON and unmarshal into v
 	if err := json.Unmarshal(body, v); err != nil {
-		return errors.Wrap(err, nil)
+		return errors.BadRequest("invalid JSON body: %v", err)
 	}
 
 	return nil
 }
+
+// DecodeQuery unmarshals the URL query parameters of the given request into the
+// output interface, using the same json tags as the body. This allows GET requests
+// to be made with a shareable URL, e.g. /?services=service.foo&severity=3
+func DecodeQuery(r *http.Request, v interface{}) error {
+	decoder, err := newDecoder(v)
+	if err != nil {
+		return err
+	}
+
+	// Query parameters come out as a map[string][]string so we loop through them all
+	// to remove the unnecessary slice if the parameter just has a single value
+	paramSlices := r.URL.Query()
+	params := map[string]interface{}{}
+	for key, value := range paramSlices {
+		switch len(value) {
+		case 0:
+			params[key] = nil
+		case 1:
+			params[key] = value[0]
+		default:
+			params[key] = value
+		}
+	}
+
+	if err := decoder.Decode(params); err != nil {
+		return errors.BadRequest("invalid query parameters: %v", err)
+	}
+
+	return nil
+}
+
+// newDecoder returns a decoder that unmarshals maps into v
+func newDecoder(v interface{}) (*mapstructure.Decoder, error) {
+	// This does a load of reflection to unmarshal a map into the type of v
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeHookFunc(time.RFC3339),
+		WeaklyTypedInput: true,
+		Result:           v,
+
+		// Override the TagName to match the one used by the encoding/json package
+		// so users of this function only have to define a single tag on struct fields
+		TagName: "json",
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, nil)
+	}
+
+	return decoder, nil
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/jakewright/home-automation/libraries/go/errors"
+
 	"github.com/gorilla/mux"
 	"gotest.tools/assert"
 )
@@ -91,3 +93,62 @@ func TestDecodeComplexParamNames(t *testing.T) {
 	assert.Equal(t, v.HouseName, "Buckingham Palace")
 	assert.Equal(t, v.FavoriteNumber, 3)
 }
+
+func TestDecodeInvalidBody(t *testing.T) {
+	body := []byte("{\"foo\":")
+	r, err := http.NewRequest("POST", "/foo", bytes.NewBuffer(body))
+	assert.NilError(t, err)
+
+	var v struct {
+		Foo string
+	}
+
+	err = Decode(r, &v)
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+}
+
+func TestDecodeQueryOnly(t *testing.T) {
+	body := []byte("{\"foo\":\"ignored\"}")
+	r, err := http.NewRequest("GET", "/?services=service.foo&severity=40&reverse=true", bytes.NewBuffer(body))
+	assert.NilError(t, err)
+
+	var v struct {
+		Foo      string `json:"foo"`
+		Services string `json:"services"`
+		Severity int    `json:"severity"`
+		Reverse  bool   `json:"reverse"`
+	}
+
+	err = DecodeQuery(r, &v)
+	assert.NilError(t, err)
+
+	assert.Equal(t, v.Foo, "")
+	assert.Equal(t, v.Services, "service.foo")
+	assert.Equal(t, v.Severity, 40)
+	assert.Equal(t, v.Reverse, true)
+
+	// Invalid values are the client's fault
+	r, err = http.NewRequest("GET", "/?severity=high", nil)
+	assert.NilError(t, err)
+	err = DecodeQuery(r, &v)
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+}
+
+func TestDecodeBodyTooLarge(t *testing.T) {
+	defer func(n int64) { MaxBodyBytes = n }(MaxBodyBytes)
+	MaxBodyBytes = 16
+
+	var v struct {
+		Foo string
+	}
+
+	// A body exactly at the limit is fine
+	r, err := http.NewRequest("POST", "/foo", bytes.NewBufferString(`{"foo":"barbaz"}`))
+	assert.NilError(t, err)
+	assert.NilError(t, Decode(r, &v))
+
+	r, err = http.NewRequest("POST", "/foo", bytes.NewBufferString(`{"foo":"barbazz"}`))
+	assert.NilError(t, err)
+	err = Decode(r, &v)
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+}
@@ -0,0 +1,129 @@
+package request
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+)
+
+// Validator can be implemented by request types to check
+// conditions that involve more than one field
+type Validator interface {
+	Validate() error
+}
+
+// Validate checks the fields of the struct against the rules in their validate tags
+// and then calls the struct's Validate method if it implements Validator. A BadRequest
+// error listing every problem is returned if any fail. Rules are comma-separated:
+//
+//	min=N       the number must be at least N
+//	max=N       the number must be at most N
+//	oneof=A B   the value must be one of the space-separated values
+//
+// Fields are referred to by their json tag name in the error message.
+func Validate(v interface{}) error {
+	var problems []string
+
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() == reflect.Struct {
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			field := rt.Field(i)
+			tag := field.Tag.Get("validate")
+			if tag == "" {
+				continue
+			}
+
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+
+			for _, rule := range strings.Split(tag, ",") {
+				problem, err := checkRule(name, rule, rv.Field(i))
+				if err != nil {
+					return err
+				}
+				if problem != "" {
+					problems = append(problems, problem)
+				}
+			}
+		}
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			if e, ok := err.(*errors.Error); ok {
+				problems = append(problems, e.Message)
+			} else {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.BadRequest("invalid request: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// checkRule returns a description of the problem if the value does not satisfy
+// the rule. An error is returned if the rule itself is invalid.
+func checkRule(name, rule string, value reflect.Value) (string, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	key := parts[0]
+	var arg string
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+
+	switch key {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "", errors.InternalService("invalid %s rule on %s: %v", key, name, err)
+		}
+
+		n, ok := toFloat(value)
+		if !ok {
+			return "", errors.InternalService("%s rule cannot be used on %s of kind %s", key, name, value.Kind())
+		}
+
+		if key == "min" && n < limit {
+			return fmt.Sprintf("%s must be at least %s", name, arg), nil
+		}
+		if key == "max" && n > limit {
+			return fmt.Sprintf("%s must be at most %s", name, arg), nil
+		}
+
+	case "oneof":
+		s := fmt.Sprint(value.Interface())
+		for _, allowed := range strings.Fields(arg) {
+			if s == allowed {
+				return "", nil
+			}
+		}
+		return fmt.Sprintf("%s must be one of %s", name, strings.Join(strings.Fields(arg), ", ")), nil
+
+	default:
+		return "", errors.InternalService("unknown validation rule %q on %s", rule, name)
+	}
+
+	return "", nil
+}
+
+func toFloat(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
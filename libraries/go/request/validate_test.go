@@ -0,0 +1,47 @@
+package request
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+
+	"gotest.tools/assert"
+)
+
+type validatedRequest struct {
+	Severity int    `json:"severity" validate:"oneof=0 2 3"`
+	Limit    int    `json:"limit" validate:"min=0,max=100"`
+	Name     string `json:"name"`
+	invalid  bool
+}
+
+func (r *validatedRequest) Validate() error {
+	if r.invalid {
+		return fmt.Errorf("request is invalid")
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	assert.NilError(t, Validate(&validatedRequest{Severity: 2, Limit: 100}))
+
+	err := Validate(&validatedRequest{Severity: 4, Limit: -1, invalid: true})
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+	assert.Equal(t, err.(*errors.Error).Message, "invalid request: severity must be one of 0, 2, 3; limit must be at least 0; request is invalid")
+
+	err = Validate(&validatedRequest{Limit: 101})
+	assert.Equal(t, err.(*errors.Error).Message, "invalid request: limit must be at most 100")
+
+	// Values that are not structs are not validated
+	assert.NilError(t, Validate(&map[string]string{}))
+}
+
+func TestValidateUnknownRule(t *testing.T) {
+	var v struct {
+		Foo string `validate:"required"`
+	}
+
+	err := Validate(&v)
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrInternalService)
+}
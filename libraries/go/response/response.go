@@ -11,8 +11,10 @@ import (
 )
 
 type response struct {
-	Message string      `json:"message,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
+	Code      string      `json:"code,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Retryable bool        `json:"retryable,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
 }
 
 func Write(w http.ResponseWriter, buf bytes.Buffer) {
@@ -21,16 +23,23 @@ func Write(w http.ResponseWriter, buf bytes.Buffer) {
 	}
 }
 
-// WriteJSON returns a response to the client
+// WriteJSON returns a response to the client. Errors are written with a
+// status code and a stable error code so that clients can tell them apart,
+// e.g. {"code":"bad_request","message":"..."}, with "retryable":true if the
+// error was marked as retryable. Other errors are treated as internal
+// service errors.
 func WriteJSON(w http.ResponseWriter, data interface{}) {
 	status := http.StatusOK
 	payload := response{}
 
 	if e, ok := data.(*errors.Error); ok {
 		status = e.HTTPStatus()
-		payload.Message = e.Error()
+		payload.Code = e.Code
+		payload.Message = e.Message
+		payload.Retryable = e.Retryable
 	} else if e, ok := (data).(error); ok {
 		status = http.StatusInternalServerError
+		payload.Code = errors.ErrInternalService
 		payload.Message = e.Error()
 	} else {
 		payload.Data = data
@@ -0,0 +1,36 @@
+package response
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+
+	"gotest.tools/assert"
+)
+
+func TestWriteJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       interface{}
+		wantStatus int
+		wantBody   string
+	}{
+		{"data", map[string]int{"total": 1}, http.StatusOK, `{"data":{"total":1}}`},
+		{"bad request", errors.BadRequest("invalid limit"), http.StatusBadRequest, `{"code":"bad_request","message":"invalid limit"}`},
+		{"not found", errors.NotFound("no such file"), http.StatusNotFound, `{"code":"not_found","message":"no such file"}`},
+		{"plain error", fmt.Errorf("boom"), http.StatusInternalServerError, `{"code":"internal_service","message":"boom"}`},
+		{"retryable", errors.MarkRetryable(fmt.Errorf("read failed"), nil), http.StatusInternalServerError, `{"code":"internal_service","message":"read failed","retryable":true}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			WriteJSON(w, tc.data)
+			assert.Equal(t, w.Code, tc.wantStatus)
+			assert.Equal(t, w.Body.String(), tc.wantBody)
+		})
+	}
+}
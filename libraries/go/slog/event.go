@@ -70,21 +70,20 @@ func (e *Event) String() string {
 	return strings.Join([]string{timestamp, e.Severity.String(), e.Message, string(metadata)}, " ")
 }
 
-// mergeMetadata merges the metadata but preserves existing entries
+// mergeMetadata merges the metadata but preserves existing entries. A copy is
+// returned if anything is added so that the caller's map is not modified.
 func mergeMetadata(current, new map[string]string) map[string]string {
 	if len(new) == 0 {
 		return current
 	}
 
-	if current == nil {
-		current = map[string]string{}
-	}
-
+	merged := make(map[string]string, len(current)+len(new))
 	for k, v := range new {
-		if _, ok := current[k]; !ok {
-			current[k] = v
-		}
+		merged[k] = v
+	}
+	for k, v := range current {
+		merged[k] = v
 	}
 
-	return current
+	return merged
 }
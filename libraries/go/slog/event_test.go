@@ -0,0 +1,23 @@
+package slog
+
+import (
+	"testing"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+
+	"gotest.tools/assert"
+)
+
+func TestNewEventFromFormatMergesErrorMetadata(t *testing.T) {
+	metadata := map[string]string{"service": "foo"}
+	err := &errors.Error{Code: errors.ErrNotFound, Message: "no such file", Metadata: map[string]string{
+		"service":  "ignored",
+		"filename": "messages",
+	}}
+
+	event := newEventFromFormat(ErrorSeverity, "Failed: %v", err, metadata)
+	assert.DeepEqual(t, event.Metadata, map[string]string{"service": "foo", "filename": "messages"})
+
+	// The caller's map is not modified
+	assert.DeepEqual(t, metadata, map[string]string{"service": "foo"})
+}
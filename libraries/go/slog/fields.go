@@ -0,0 +1,49 @@
+package slog
+
+// FieldLogger logs events with a set of fields added to the metadata of each
+// one, so that related events can be found by the same fields. Fields given
+// to an individual call, or by an error, are merged in with precedence.
+type FieldLogger struct {
+	fields map[string]string
+}
+
+// With returns a logger that adds the fields to every event that it logs
+func With(fields map[string]string) *FieldLogger {
+	return &FieldLogger{fields: mergeMetadata(nil, fields)}
+}
+
+// With returns a logger with both sets of fields. The new
+// fields replace any existing fields with the same keys.
+func (l *FieldLogger) With(fields map[string]string) *FieldLogger {
+	return &FieldLogger{fields: mergeMetadata(mergeMetadata(nil, fields), l.fields)}
+}
+
+// Debug logs with DEBUG severity
+func (l *FieldLogger) Debug(format string, a ...interface{}) {
+	l.log(DebugSeverity, format, a...)
+}
+
+// Info logs with INFO severity
+func (l *FieldLogger) Info(format string, a ...interface{}) {
+	l.log(InfoSeverity, format, a...)
+}
+
+// Warn logs with WARNING severity
+func (l *FieldLogger) Warn(format string, a ...interface{}) {
+	l.log(WarnSeverity, format, a...)
+}
+
+// Error logs with ERROR severity
+func (l *FieldLogger) Error(format string, a ...interface{}) {
+	l.log(ErrorSeverity, format, a...)
+}
+
+func (l *FieldLogger) log(severity Severity, format string, a ...interface{}) {
+	if !enabled(severity) {
+		return
+	}
+
+	event := newEventFromFormat(severity, format, a...)
+	event.Metadata = mergeMetadata(event.Metadata, l.fields)
+	mustGetDefaultLogger().Log(event)
+}
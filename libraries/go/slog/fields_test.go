@@ -0,0 +1,31 @@
+package slog
+
+import (
+	"testing"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+
+	"gotest.tools/assert"
+)
+
+func TestWith(t *testing.T) {
+	defer func(logger Logger) { DefaultLogger = logger }(DefaultLogger)
+	logger := &recordingLogger{}
+	DefaultLogger = logger
+
+	fields := map[string]string{"service": "service.foo", "severity": "INFO"}
+	log := With(fields).With(map[string]string{"severity": "ERROR"})
+
+	log.Info("Found %d events", 3)
+	log.Error("Failed: %v", &errors.Error{Message: "broke", Metadata: map[string]string{"file": "messages"}})
+	log.Warn("Slow", map[string]string{"severity": "WARN"})
+
+	assert.Equal(t, len(logger.events), 3)
+	assert.Equal(t, logger.events[0].Message, "Found 3 events")
+	assert.DeepEqual(t, logger.events[0].Metadata, map[string]string{"service": "service.foo", "severity": "ERROR"})
+	assert.DeepEqual(t, logger.events[1].Metadata, map[string]string{"service": "service.foo", "severity": "ERROR", "file": "messages"})
+	assert.DeepEqual(t, logger.events[2].Metadata, map[string]string{"service": "service.foo", "severity": "WARN"})
+
+	// The original fields are not modified
+	assert.DeepEqual(t, fields, map[string]string{"service": "service.foo", "severity": "INFO"})
+}
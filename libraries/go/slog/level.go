@@ -0,0 +1,45 @@
+package slog
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// LevelEnvVar is the environment variable that sets the initial
+// level, e.g. LOG_LEVEL=warn. Everything is logged if it is not set.
+const LevelEnvVar = "LOG_LEVEL"
+
+// level is the minimum severity that is logged. It is accessed
+// atomically so that it can be changed while other goroutines log.
+var level = int32(DebugSeverity)
+
+func init() {
+	s := os.Getenv(LevelEnvVar)
+	if s == "" {
+		return
+	}
+
+	severity, err := ParseSeverity(s)
+	if err != nil {
+		Warn("Ignoring invalid %s: %v", LevelEnvVar, err)
+		return
+	}
+
+	SetLevel(severity)
+}
+
+// SetLevel sets the minimum severity of events that are logged by Debug,
+// Info, Warn and Error. It is safe to call while other goroutines are logging.
+func SetLevel(severity Severity) {
+	atomic.StoreInt32(&level, int32(severity))
+}
+
+// Level returns the minimum severity of events that are logged
+func Level() Severity {
+	return Severity(atomic.LoadInt32(&level))
+}
+
+// enabled returns whether events with the severity are logged
+func enabled(severity Severity) bool {
+	return severity >= Level()
+}
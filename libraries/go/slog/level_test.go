@@ -0,0 +1,38 @@
+package slog
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// recordingLogger keeps the events that it logs
+type recordingLogger struct {
+	events []*Event
+}
+
+func (l *recordingLogger) Log(event *Event) {
+	l.events = append(l.events, event)
+}
+
+func TestSetLevel(t *testing.T) {
+	defer func(logger Logger, severity Severity) {
+		DefaultLogger = logger
+		SetLevel(severity)
+	}(DefaultLogger, Level())
+
+	logger := &recordingLogger{}
+	DefaultLogger = logger
+
+	SetLevel(WarnSeverity)
+	assert.Equal(t, Level(), WarnSeverity)
+
+	Debug("debug")
+	Info("info")
+	Warn("warn")
+	Error("error")
+
+	assert.Equal(t, len(logger.events), 2)
+	assert.Equal(t, logger.events[0].Severity, WarnSeverity)
+	assert.Equal(t, logger.events[1].Severity, ErrorSeverity)
+}
@@ -18,26 +18,35 @@ func mustGetDefaultLogger() Logger {
 
 // Debug logs with DEBUG severity
 func Debug(format string, a ...interface{}) {
-	mustGetDefaultLogger().Log(newEventFromFormat(DebugSeverity, format, a...))
+	if enabled(DebugSeverity) {
+		mustGetDefaultLogger().Log(newEventFromFormat(DebugSeverity, format, a...))
+	}
 }
 
 // Info logs with INFO severity
 func Info(format string, a ...interface{}) {
-	mustGetDefaultLogger().Log(newEventFromFormat(InfoSeverity, format, a...))
+	if enabled(InfoSeverity) {
+		mustGetDefaultLogger().Log(newEventFromFormat(InfoSeverity, format, a...))
+	}
 }
 
 // Warn logs with WARNING severity
 func Warn(format string, a ...interface{}) {
-	mustGetDefaultLogger().Log(newEventFromFormat(WarnSeverity, format, a...))
+	if enabled(WarnSeverity) {
+		mustGetDefaultLogger().Log(newEventFromFormat(WarnSeverity, format, a...))
+	}
 }
 
 // Error logs with ERROR severity
 func Error(format string, a ...interface{}) {
-	mustGetDefaultLogger().Log(newEventFromFormat(ErrorSeverity, format, a...))
+	if enabled(ErrorSeverity) {
+		mustGetDefaultLogger().Log(newEventFromFormat(ErrorSeverity, format, a...))
+	}
 }
 
-// Panic logs with ERROR severity and then panics
+// Panic logs with ERROR severity, regardless of the level, and then panics
 func Panic(format string, a ...interface{}) {
-	Error(format, a...)
-	panic(newEventFromFormat(ErrorSeverity, format, a...))
+	event := newEventFromFormat(ErrorSeverity, format, a...)
+	mustGetDefaultLogger().Log(event)
+	panic(event)
 }
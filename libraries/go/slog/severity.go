@@ -2,7 +2,10 @@ package slog
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 // Severity is a subset of the syslog severity levels
@@ -25,7 +28,39 @@ const (
 	UnknownSeverity Severity = 10
 )
 
+// customNames holds a map[Severity]string of names that override the
+// built-in ones. The map is replaced, never changed, by SetSeverityNames
+// so that it can be read while other goroutines log.
+var customNames atomic.Value
+
+// SetSeverityNames names severities for organisations whose services use
+// their own levels, e.g. 5, 15 and 25. The names override the built-in
+// names, including those of the constants in this package, but severities
+// that are not in the map keep their built-in names. ParseSeverity accepts
+// the names as well unless they clash with a built-in name. It is safe to
+// call while other goroutines are logging.
+func SetSeverityNames(names map[Severity]string) {
+	m := make(map[Severity]string, len(names))
+	for s, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			m[s] = strings.ToLower(name)
+		}
+	}
+	customNames.Store(m)
+}
+
+// customName returns the lowercase name that the severity was given by SetSeverityNames
+func customName(s Severity) (string, bool) {
+	m, _ := customNames.Load().(map[Severity]string)
+	name, ok := m[s]
+	return name, ok
+}
+
 func (s Severity) String() string {
+	if name, ok := customName(s); ok {
+		return strings.ToUpper(name)
+	}
+
 	switch s {
 	case DebugSeverity:
 		return "DEBUG"
@@ -40,24 +75,123 @@ func (s Severity) String() string {
 	return "UNKNOWN"
 }
 
+// Known returns whether the severity is one of the constants in this
+// package, other than UnknownSeverity, or was named by SetSeverityNames
+func (s Severity) Known() bool {
+	if _, ok := customName(s); ok {
+		return true
+	}
+
+	switch s {
+	case DebugSeverity, InfoSeverity, WarnSeverity, ErrorSeverity:
+		return true
+	}
+
+	return false
+}
+
+// SeverityNames are the ways of showing a severity to people. Clients
+// should use these rather than mapping severities to labels themselves.
+type SeverityNames struct {
+	// Level is the numeric value of the severity, e.g. 6
+	Level int
+
+	// Short is the three letter name of the severity, e.g. "ERR"
+	Short string
+
+	// Long is the full lowercase name of the severity, e.g. "error"
+	Long string
+}
+
+// Names returns the names of the severity. A severity that is not one
+// of the constants in this package is named "UNK" and "unknown" unless
+// it was named by SetSeverityNames, in which case the short name is the
+// first three letters of its name.
+func (s Severity) Names() SeverityNames {
+	names := SeverityNames{Level: int(s)}
+
+	if name, ok := customName(s); ok {
+		short := []rune(strings.ToUpper(name))
+		if len(short) > 3 {
+			short = short[:3]
+		}
+		names.Short, names.Long = string(short), name
+		return names
+	}
+
+	switch s {
+	case DebugSeverity:
+		names.Short, names.Long = "DBG", "debug"
+	case InfoSeverity:
+		names.Short, names.Long = "INF", "info"
+	case WarnSeverity:
+		names.Short, names.Long = "WRN", "warning"
+	case ErrorSeverity:
+		names.Short, names.Long = "ERR", "error"
+	default:
+		names.Short, names.Long = "UNK", "unknown"
+	}
+
+	return names
+}
+
 func (s *Severity) UnmarshalJSON(data []byte) error {
 	var str string
 	if err := json.Unmarshal(data, &str); err != nil {
 		return err
 	}
 
+	m, _ := customNames.Load().(map[Severity]string)
+	severity, ok := severityFromName(str, m)
+	if !ok {
+		severity = UnknownSeverity
+	}
+
+	*s = severity
+	return nil
+}
+
+// ParseSeverity returns the severity with the given case-insensitive
+// name, e.g. "warn" or "ERROR". Numeric strings are also accepted.
+func ParseSeverity(str string) (Severity, error) {
+	m, _ := customNames.Load().(map[Severity]string)
+	return ParseSeverityWithNames(str, m)
+}
+
+// ParseSeverityWithNames is like ParseSeverity but accepts the names in
+// the given map instead of those set by SetSeverityNames. It can be used
+// to check a level against names that have not been set yet.
+func ParseSeverityWithNames(str string, names map[Severity]string) (Severity, error) {
+	str = strings.TrimSpace(str)
+
+	if severity, ok := severityFromName(str, names); ok {
+		return severity, nil
+	}
+
+	if i, err := strconv.Atoi(str); err == nil && i >= 0 {
+		return Severity(i), nil
+	}
+
+	return 0, fmt.Errorf("unknown severity %q", str)
+}
+
+func severityFromName(str string, names map[Severity]string) (Severity, bool) {
 	switch strings.ToLower(str) {
 	case "dbg", "debug":
-		*s = DebugSeverity
+		return DebugSeverity, true
 	case "inf", "info", "information":
-		*s = InfoSeverity
-	case "warn", "warning":
-		*s = WarnSeverity
+		return InfoSeverity, true
+	case "wrn", "warn", "warning":
+		return WarnSeverity, true
 	case "err", "error":
-		*s = ErrorSeverity
-	default:
-		*s = UnknownSeverity
+		return ErrorSeverity, true
 	}
 
-	return nil
+	for severity, name := range names {
+		if strings.EqualFold(strings.TrimSpace(name), str) {
+			return severity, true
+		}
+	}
+
+	return 0, false
 }
@@ -0,0 +1,118 @@
+package slog
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseSeverity(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Severity
+	}{
+		{"debug", DebugSeverity},
+		{"INFO", InfoSeverity},
+		{"warn", WarnSeverity},
+		{"Warning", WarnSeverity},
+		{"error", ErrorSeverity},
+		{" error ", ErrorSeverity},
+		{"5", WarnSeverity},
+		{"0", Severity(0)},
+	}
+
+	for _, tc := range tests {
+		got, err := ParseSeverity(tc.in)
+		assert.NilError(t, err, tc.in)
+		assert.Equal(t, got, tc.want, tc.in)
+	}
+}
+
+func TestParseSeverityUnknown(t *testing.T) {
+	for _, in := range []string{"", "critical", "-1"} {
+		_, err := ParseSeverity(in)
+		assert.ErrorContains(t, err, "unknown severity", in)
+	}
+}
+
+func TestSeverityRoundTrip(t *testing.T) {
+	for _, s := range []Severity{DebugSeverity, InfoSeverity, WarnSeverity, ErrorSeverity} {
+		got, err := ParseSeverity(s.String())
+		assert.NilError(t, err)
+		assert.Equal(t, got, s)
+	}
+
+	assert.Equal(t, UnknownSeverity.String(), "UNKNOWN")
+}
+
+func TestSeverityNames(t *testing.T) {
+	assert.Equal(t, ErrorSeverity.Names(), SeverityNames{Level: 6, Short: "ERR", Long: "error"})
+	assert.Equal(t, Severity(1).Names(), SeverityNames{Level: 1, Short: "UNK", Long: "unknown"})
+
+	// Both names can be parsed back into the severity
+	for _, s := range []Severity{DebugSeverity, InfoSeverity, WarnSeverity, ErrorSeverity} {
+		names := s.Names()
+		assert.Equal(t, names.Level, int(s))
+
+		got, err := ParseSeverity(names.Short)
+		assert.NilError(t, err)
+		assert.Equal(t, got, s)
+
+		got, err = ParseSeverity(names.Long)
+		assert.NilError(t, err)
+		assert.Equal(t, got, s)
+	}
+}
+
+func TestSetSeverityNames(t *testing.T) {
+	SetSeverityNames(map[Severity]string{
+		Severity(15): "Notice",
+		Severity(25): "critical",
+		WarnSeverity: "caution",
+		Severity(30): " ",
+	})
+	defer SetSeverityNames(nil)
+
+	assert.Equal(t, Severity(15).String(), "NOTICE")
+	assert.Equal(t, Severity(15).Names(), SeverityNames{Level: 15, Short: "NOT", Long: "notice"})
+	assert.Equal(t, WarnSeverity.String(), "CAUTION")
+
+	// Unnamed severities keep their built-in names
+	assert.Equal(t, ErrorSeverity.Names(), SeverityNames{Level: 6, Short: "ERR", Long: "error"})
+	assert.Equal(t, Severity(30).String(), "UNKNOWN")
+
+	// Custom names can be parsed but do not replace built-in ones
+	got, err := ParseSeverity("CRITICAL")
+	assert.NilError(t, err)
+	assert.Equal(t, got, Severity(25))
+
+	got, err = ParseSeverity("warn")
+	assert.NilError(t, err)
+	assert.Equal(t, got, WarnSeverity)
+
+	// Named severities are known
+	assert.Assert(t, Severity(15).Known())
+	assert.Assert(t, ErrorSeverity.Known())
+	assert.Assert(t, !Severity(30).Known())
+	assert.Assert(t, !UnknownSeverity.Known())
+
+	SetSeverityNames(nil)
+	assert.Equal(t, Severity(15).String(), "UNKNOWN")
+	assert.Assert(t, !Severity(15).Known())
+}
+
+func TestParseSeverityWithNames(t *testing.T) {
+	names := map[Severity]string{Severity(15): "Notice"}
+
+	got, err := ParseSeverityWithNames("notice", names)
+	assert.NilError(t, err)
+	assert.Equal(t, got, Severity(15))
+
+	got, err = ParseSeverityWithNames("error", names)
+	assert.NilError(t, err)
+	assert.Equal(t, got, ErrorSeverity)
+
+	// The names set by SetSeverityNames are not used
+	_, err = ParseSeverityWithNames("notice", nil)
+	assert.ErrorContains(t, err, "unknown severity")
+}
@@ -3,8 +3,13 @@ package domain
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"math"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jakewright/home-automation/libraries/go/slog"
 )
@@ -33,6 +38,28 @@ type Event struct {
 	// This will usually be a map[string]string.
 	Metadata interface{} `json:"metadata"`
 
+	// Fields are key/value pairs parsed from the message, which
+	// can either be in logfmt style or a JSON object.
+	Fields map[string]string `json:"-"`
+
+	// MessageJSON is the original message if it was a JSON object
+	MessageJSON []byte `json:"-"`
+
+	// TraceID identifies the request that caused the event so that
+	// events from all services for one request can be found. It is
+	// taken from the log line or, failing that, from the message.
+	TraceID string `json:"trace_id"`
+
+	// RepeatCount is the number of identical consecutive events that
+	// this event represents if they were collapsed into one. It is
+	// zero if the event was not collapsed.
+	RepeatCount int `json:"-"`
+
+	// SourceFile is the path of the log file that the event was read
+	// from. Events from one service can be in more than one file if,
+	// for example, more than one collector writes logs.
+	SourceFile string `json:"-"`
+
 	// Raw is the original log line
 	Raw []byte `json:"-"`
 }
@@ -46,15 +73,40 @@ type FormattedEvent struct {
 	// Timestamp is the time on the event
 	Timestamp string
 
-	// Severity is the severity of the event
+	// Severity is the severity of the event, e.g. "ERROR"
 	Severity string
 
+	// SeverityName is the long name of the severity, e.g. "warning".
+	// It is the same as SeverityNames.Long.
+	SeverityName string
+
+	// SeverityClass is a CSS class for styling the event
+	// by its severity, e.g. "sev-error" or "sev-warn"
+	SeverityClass string
+
+	// SeverityLevel is the numeric value of the severity.
+	// It is the same as SeverityNames.Level.
+	SeverityLevel int
+
+	// SeverityNames are the level and the short and long names of
+	// the severity, e.g. 6, "ERR" and "error", so that clients do not
+	// need their own mapping from severities to labels
+	SeverityNames slog.SeverityNames
+
 	// Service is the name of the service from which the event came
 	Service string
 
 	// Message is converted to template.HTML as-is
 	Message template.HTML
 
+	// TruncatedMessage is the start of the message if it is longer than the
+	// length given to Truncate, otherwise it is the whole message. It is
+	// empty if Truncate has not been called.
+	TruncatedMessage template.HTML
+
+	// Truncated is whether TruncatedMessage is shorter than Message
+	Truncated bool
+
 	// Metadata is converted to template.HTML in its raw form
 	Metadata template.HTML
 
@@ -62,6 +114,24 @@ type FormattedEvent struct {
 	// otherwise it will be equal to Metadata.
 	MetadataPretty template.HTML
 
+	// Fields are the key/value pairs parsed from the message
+	Fields map[string]string
+
+	// TraceID identifies the request that caused the event
+	TraceID string
+
+	// RepeatCount is the number of identical events
+	// that were collapsed into this one, if any
+	RepeatCount int
+
+	// SourceFile is the path of the log file that the event was read from
+	SourceFile string
+
+	// MessageJSON is the original message, indented, if it was a JSON
+	// object. Otherwise it is empty. The Message will be taken from
+	// one of the well-known keys in the object.
+	MessageJSON template.HTML
+
 	// Raw is the original log line
 	Raw template.HTML
 }
@@ -85,9 +155,24 @@ func NewEventFromBytes(b []byte) *Event {
 		slog.Warn("Event timestamp was zero: %v", string(e.Raw))
 	}
 
+	e.parseMessage()
 	return &e
 }
 
+// parseMessage sets the fields, and the trace ID if it is
+// not already set, from the event's message
+func (e *Event) parseMessage() {
+	// Services can log JSON objects instead of plain text. If the message
+	// isn't valid JSON then fall back to treating it as plain text.
+	if !e.parseJSONMessage() {
+		e.Fields = ParseFields(e.Message)
+	}
+
+	if e.TraceID == "" {
+		e.TraceID = e.parseTraceID()
+	}
+}
+
 // Format returns a formatted event that can be passed to an HTML template
 func (e *Event) Format() *FormattedEvent {
 	var metadataPretty []byte
@@ -100,20 +185,92 @@ func (e *Event) Format() *FormattedEvent {
 		}
 	}
 
-	raw := template.HTML(formatRaw(e.Raw))
+	raw := template.HTML(Redact(formatRaw(e.Raw)))
+
+	// Fields are parsed from the message so they need redacting too
+	var fields map[string]string
+	if e.Fields != nil {
+		fields = make(map[string]string, len(e.Fields))
+		for k, v := range e.Fields {
+			fields[k] = Redact(v)
+		}
+	}
+
+	names := e.Severity.Names()
 
 	return &FormattedEvent{
 		UUID:           e.UUID,
 		Timestamp:      e.Timestamp.Format(time.Stamp),
 		Severity:       e.Severity.String(),
+		SeverityName:   names.Long,
+		SeverityClass:  "sev-" + strings.ToLower(e.Severity.String()),
+		SeverityLevel:  names.Level,
+		SeverityNames:  names,
 		Service:        e.Service,
-		Message:        template.HTML(e.Message),
-		Metadata:       template.HTML(metadata),
-		MetadataPretty: template.HTML(metadataPretty),
+		Message:        template.HTML(Redact(e.Message)),
+		Metadata:       template.HTML(Redact(string(metadata))),
+		MetadataPretty: template.HTML(Redact(string(metadataPretty))),
+		Fields:         fields,
+		TraceID:        e.TraceID,
+		RepeatCount:    e.RepeatCount,
+		SourceFile:     e.SourceFile,
+		MessageJSON:    template.HTML(Redact(formatRaw(e.MessageJSON))),
 		Raw:            raw,
 	}
 }
 
+// CompactEvent is a minimal representation of an event for clients on slow
+// or metered connections. It is encoded as a JSON array instead of an
+// object so that no bytes are spent on keys:
+//
+//	[uuid, timestamp, severity, service, message]
+//
+// The timestamp is RFC 3339 with nanoseconds, the severity is the numeric
+// level and the message is redacted in the same way as FormattedEvent.
+// Fields, metadata and the raw line are left out.
+type CompactEvent [5]interface{}
+
+// Compact returns the compact representation of the event
+func (e *Event) Compact() CompactEvent {
+	return CompactEvent{
+		e.UUID,
+		e.Timestamp.Format(time.RFC3339Nano),
+		int(e.Severity),
+		e.Service,
+		Redact(e.Message),
+	}
+}
+
+// Before returns whether the event comes before the other event in the
+// order that events are returned in. Events are ordered by timestamp and
+// then by UUID, so that events with the same timestamp are always in the
+// same order, even if they were read from different log files.
+func (e *Event) Before(other *Event) bool {
+	if !e.Timestamp.Equal(other.Timestamp) {
+		return e.Timestamp.Before(other.Timestamp)
+	}
+	return e.UUID < other.UUID
+}
+
+// Truncate sets TruncatedMessage to at most max bytes of the message.
+// The message is cut at a UTF-8 character boundary.
+func (f *FormattedEvent) Truncate(max int) {
+	if len(f.Message) <= max {
+		f.TruncatedMessage = f.Message
+		f.Truncated = false
+		return
+	}
+
+	// Move back to the start of a character so one isn't split in half
+	n := max
+	for n > 0 && !utf8.RuneStart(f.Message[n]) {
+		n--
+	}
+
+	f.TruncatedMessage = f.Message[:n] + "…"
+	f.Truncated = true
+}
+
 func formatRaw(b []byte) string {
 	var buf bytes.Buffer
 	err := json.Indent(&buf, b, "", jsonIndent)
@@ -123,3 +280,88 @@ func formatRaw(b []byte) string {
 
 	return buf.String()
 }
+
+// Well-known keys in JSON messages
+var (
+	jsonLevelKeys     = []string{"level", "severity"}
+	jsonMessageKeys   = []string{"msg", "message"}
+	jsonTimestampKeys = []string{"ts", "time", "timestamp"}
+)
+
+// parseJSONMessage populates the event's fields from the message if it is a JSON
+// object. The message, severity and, if not already set, timestamp are taken from
+// well-known keys. It returns false if the message is not a JSON object.
+func (e *Event) parseJSONMessage() bool {
+	msg := bytes.TrimSpace([]byte(e.Message))
+	if len(msg) == 0 || msg[0] != '{' {
+		return false
+	}
+
+	// Use json.Number so that integers aren't formatted as floats
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return false
+	}
+
+	e.MessageJSON = msg
+	e.Fields = make(map[string]string, len(obj))
+	for k, v := range obj {
+		e.Fields[k] = jsonFieldString(v)
+	}
+
+	if v, ok := firstField(e.Fields, jsonMessageKeys); ok {
+		e.Message = v
+	}
+
+	if v, ok := firstField(e.Fields, jsonLevelKeys); ok {
+		if severity, err := slog.ParseSeverity(v); err == nil {
+			e.Severity = severity
+		}
+	}
+
+	if v, ok := firstField(e.Fields, jsonTimestampKeys); ok && e.Timestamp.IsZero() {
+		e.Timestamp = parseJSONTimestamp(v)
+	}
+
+	return true
+}
+
+// jsonFieldString returns strings as they are and anything else as JSON
+func jsonFieldString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+// firstField returns the value of the first key that exists in fields
+func firstField(fields map[string]string, keys []string) (string, bool) {
+	for _, k := range keys {
+		if v, ok := fields[k]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// parseJSONTimestamp parses an RFC3339 time or a Unix time in seconds.
+// The zero time is returned if the value is in neither format.
+func parseJSONTimestamp(v string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t
+	}
+
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,80 @@
+package domain
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ParseFields extracts logfmt-style key/value pairs from a message, e.g.
+// `level=info msg="all done" duration=12ms` gives three fields. Values may
+// be double-quoted to include spaces, and quotes within them can be escaped
+// with a backslash. Words that are not key/value pairs are ignored, so a
+// message that is not logfmt results in an empty map.
+func ParseFields(message string) map[string]string {
+	fields := map[string]string{}
+
+	s := message
+	for len(s) > 0 {
+		// Skip leading whitespace
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			break
+		}
+
+		// Read the key up to the next space or equals sign
+		i := strings.IndexFunc(s, func(r rune) bool {
+			return r == '=' || unicode.IsSpace(r)
+		})
+		if i <= 0 || s[i] != '=' {
+			// This isn't a key so skip to the next word
+			s = skipWord(s)
+			continue
+		}
+
+		key := s[:i]
+		s = s[i+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			value, s = readQuoted(s[1:])
+		} else {
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+
+		fields[key] = value
+	}
+
+	return fields
+}
+
+// skipWord returns s with everything up to the next whitespace removed
+func skipWord(s string) string {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return ""
+	}
+	return s[i:]
+}
+
+// readQuoted reads a quoted value up to the closing quote and returns the
+// unescaped value and the remainder of the string after the closing quote.
+// If there is no closing quote, the rest of the string is the value.
+func readQuoted(s string) (string, string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case c == '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), ""
+}
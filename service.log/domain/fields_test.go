@@ -0,0 +1,43 @@
+package domain
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		message string
+		want    map[string]string
+	}{
+		{
+			message: `level=info msg="done" duration=12ms user_id=42`,
+			want:    map[string]string{"level": "info", "msg": "done", "duration": "12ms", "user_id": "42"},
+		},
+		{
+			message: `msg="it \"worked\" fine" ok=true`,
+			want:    map[string]string{"msg": `it "worked" fine`, "ok": "true"},
+		},
+		{
+			message: `Failed to connect to host=db.local after 3 attempts`,
+			want:    map[string]string{"host": "db.local"},
+		},
+		{
+			message: `empty= next=1 =bad`,
+			want:    map[string]string{"empty": "", "next": "1"},
+		},
+		{
+			message: `msg="unterminated value`,
+			want:    map[string]string{"msg": "unterminated value"},
+		},
+		{
+			message: `This is a plain message`,
+			want:    map[string]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		assert.DeepEqual(t, ParseFields(tc.message), tc.want)
+	}
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/slog"
+)
+
+// DefaultTimestampLayout is used to parse the timestamp
+// group of a line format if no layout is given
+const DefaultTimestampLayout = time.RFC3339
+
+// NewEventFromFormat returns a structured event from a log line that is
+// not written by logstash. The format's named groups "timestamp",
+// "severity", "service" and "message" are used for the event's values,
+// and "uuid" if there is one. Like NewEventFromBytes, it is best-effort:
+// if the line does not match, the whole line is used as the message.
+func NewEventFromFormat(b []byte, format *regexp.Regexp, timestampLayout string) *Event {
+	e := Event{
+		Message: string(b),
+		Raw:     b,
+	}
+
+	if timestampLayout == "" {
+		timestampLayout = DefaultTimestampLayout
+	}
+
+	if m := format.FindSubmatch(b); m == nil {
+		slog.Warn("Event did not match the line format: %s", b)
+	} else {
+		for i, name := range format.SubexpNames() {
+			if i == 0 || m[i] == nil {
+				continue
+			}
+
+			value := string(m[i])
+			switch name {
+			case "uuid":
+				e.UUID = value
+			case "timestamp":
+				t, err := time.Parse(timestampLayout, value)
+				if err != nil {
+					slog.Warn("Failed to parse event timestamp: %v", err)
+					continue
+				}
+				e.Timestamp = t
+			case "severity":
+				severity, err := slog.ParseSeverity(value)
+				if err != nil {
+					severity = slog.UnknownSeverity
+				}
+				e.Severity = severity
+			case "service":
+				e.Service = value
+			case "message":
+				e.Message = value
+			}
+		}
+	}
+
+	// Events are followed by their UUID so one is needed
+	// even if the line does not have one of its own
+	if e.UUID == "" {
+		h := fnv.New64a()
+		h.Write(b)
+		e.UUID = fmt.Sprintf("%016x", h.Sum64())
+	}
+
+	e.parseMessage()
+	return &e
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/slog"
+
+	"gotest.tools/assert"
+)
+
+// legacyFormat matches lines like "[02/01/2019 15:04:05] WARN service.foo: message"
+var legacyFormat = regexp.MustCompile(`^\[(?P<timestamp>[^\]]+)\] (?P<severity>\w+) (?P<service>[\w.]+): (?P<message>.*)$`)
+
+const legacyLayout = "02/01/2006 15:04:05"
+
+func TestNewEventFromFormat(t *testing.T) {
+	b := []byte(`[02/01/2019 15:04:05] WARN service.foo: Slow request user_id=42`)
+
+	e := NewEventFromFormat(b, legacyFormat, legacyLayout)
+	assert.Equal(t, e.Timestamp, time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC))
+	assert.Equal(t, e.Severity, slog.WarnSeverity)
+	assert.Equal(t, e.Service, "service.foo")
+	assert.Equal(t, e.Message, "Slow request user_id=42")
+	assert.Equal(t, e.Fields["user_id"], "42")
+	assert.Equal(t, string(e.Raw), string(b))
+
+	// A UUID is derived from the line so that events can be followed
+	assert.Assert(t, e.UUID != "")
+	assert.Equal(t, NewEventFromFormat(b, legacyFormat, legacyLayout).UUID, e.UUID)
+}
+
+func TestNewEventFromFormatNoMatch(t *testing.T) {
+	b := []byte(`something else entirely`)
+
+	e := NewEventFromFormat(b, legacyFormat, legacyLayout)
+	assert.Equal(t, e.Message, "something else entirely")
+	assert.Assert(t, e.Timestamp.IsZero())
+}
+
+func TestNewEventFromFormatDefaultLayout(t *testing.T) {
+	format := regexp.MustCompile(`^(?P<timestamp>\S+) (?P<message>.*)$`)
+
+	e := NewEventFromFormat([]byte(`2019-01-02T15:04:05Z hello`), format, "")
+	assert.Equal(t, e.Timestamp, time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC))
+	assert.Equal(t, e.Message, "hello")
+}
@@ -0,0 +1,31 @@
+package domain
+
+import "regexp"
+
+// redacted replaces anything matched by one of the Redactors
+const redacted = "***"
+
+// Built-in redactors for sensitive values that are commonly logged by accident
+var (
+	// EmailRedactor matches email addresses
+	EmailRedactor = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+	// BearerTokenRedactor matches bearer tokens in authorization headers
+	BearerTokenRedactor = regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9\-._~+/]+=*`)
+)
+
+// Redactors are applied to every formatted event. Anything they match is
+// replaced with "***" so that it never reaches the client. More can be
+// appended at startup but the slice should not be changed afterwards.
+var Redactors = []*regexp.Regexp{
+	EmailRedactor,
+	BearerTokenRedactor,
+}
+
+// Redact replaces everything in s that matches one of the Redactors
+func Redact(s string) string {
+	for _, re := range Redactors {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
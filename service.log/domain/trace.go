@@ -0,0 +1,34 @@
+package domain
+
+import "regexp"
+
+// traceIDKeys are the fields that a trace ID is taken from, in order of preference
+var traceIDKeys = []string{"trace_id", "traceId", "traceID"}
+
+// TraceIDRegexp is used to find a trace ID in the message of events that do
+// not have a trace ID field. If the pattern has a capturing group, the first
+// group is the trace ID, otherwise it is the whole match. It is not used if
+// nil. It can be set at startup but should not be changed afterwards.
+var TraceIDRegexp *regexp.Regexp
+
+// parseTraceID returns the event's trace ID from its fields or
+// from its message, or an empty string if it does not have one
+func (e *Event) parseTraceID() string {
+	if v, ok := firstField(e.Fields, traceIDKeys); ok {
+		return v
+	}
+
+	if TraceIDRegexp == nil {
+		return ""
+	}
+
+	m := TraceIDRegexp.FindStringSubmatch(e.Message)
+	switch len(m) {
+	case 0:
+		return ""
+	case 1:
+		return m[0]
+	default:
+		return m[1]
+	}
+}
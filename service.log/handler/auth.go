@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+)
+
+// Auth is middleware that only allows requests
+// with one of the configured bearer tokens
+type Auth struct {
+	// Tokens are the bearer tokens that are accepted. If empty, every
+	// request is allowed so that no token is needed in development.
+	Tokens []string
+}
+
+// Middleware responds with 401 Unauthorized unless the request has an
+// "Authorization: Bearer <token>" header with one of the tokens. It must
+// come before any middleware that reads the request or upgrades it to a
+// WebSocket connection.
+func (a *Auth) Middleware(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if len(a.Tokens) == 0 || a.authorised(r) {
+		next(w, r)
+		return
+	}
+
+	slog.Warn("Rejected unauthorised request to %s from %s", r.URL.Path, r.RemoteAddr)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="service.log"`)
+	response.WriteJSON(w, errors.Unauthorized("a valid bearer token is required"))
+}
+
+// authorised returns whether the request's bearer token is one of the tokens
+func (a *Auth) authorised(r *http.Request) bool {
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return false
+	}
+	token := []byte(header[len(prefix):])
+
+	// Compare in constant time so the token cannot be guessed from the
+	// response time. Every token is checked for the same reason.
+	var ok bool
+	for _, t := range a.Tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		tokens []string
+		header string
+		want   int
+	}{
+		{nil, "", http.StatusOK},
+		{[]string{"secret"}, "", http.StatusUnauthorized},
+		{[]string{"secret"}, "Bearer secret", http.StatusOK},
+		{[]string{"secret"}, "bearer secret", http.StatusOK},
+		{[]string{"secret"}, "Bearer wrong", http.StatusUnauthorized},
+		{[]string{"secret"}, "Basic secret", http.StatusUnauthorized},
+		{[]string{"secret"}, "Bearer ", http.StatusUnauthorized},
+		{[]string{"old", "new"}, "Bearer new", http.StatusOK},
+	}
+
+	next := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	for _, tc := range tests {
+		a := &Auth{Tokens: tc.tokens}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+
+		w := httptest.NewRecorder()
+		a.Middleware(w, r, next)
+		assert.Equal(t, w.Code, tc.want, tc.header)
+	}
+}
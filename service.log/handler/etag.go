@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+// isLive returns whether new events could still be added to the query's results.
+// It must be called before the default time window is applied. A tail is
+// always live because it ignores the time window.
+func isLive(query *repository.LogQuery) bool {
+	return query.Tail > 0 || query.UntilTime.IsZero() || query.UntilTime.After(time.Now())
+}
+
+// eTag returns an entity tag for the response to a query. It changes if the
+// query, the way the response is rendered or the newest event changes. The
+// tag is weak because the response is the same whether it is compressed or not.
+func eTag(r *http.Request, query *repository.LogQuery, options *renderOptions, lastUUID string, n int) (string, error) {
+	h := sha1.New()
+
+	// The compiled regexp and location marshal to {} so they are covered
+	// by MessagePattern and the location's name instead.
+	for _, v := range []interface{}{query, options, options.Location.String()} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+	}
+
+	// The format of the response depends on the Accept header
+	fmt.Fprintf(h, "%s\n%s\n%d", r.Header.Get("Accept"), lastUUID, n)
+
+	return `W/"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+}
+
+// matchesETag returns whether the request's If-None-Match header contains
+// the tag. Tags are compared weakly, i.e. ignoring whether they are weak.
+func matchesETag(r *http.Request, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == tag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/repository"
+
+	"gotest.tools/assert"
+)
+
+func TestIsLive(t *testing.T) {
+	assert.Equal(t, isLive(&repository.LogQuery{}), true)
+	assert.Equal(t, isLive(&repository.LogQuery{UntilTime: time.Now().Add(time.Hour)}), true)
+	assert.Equal(t, isLive(&repository.LogQuery{UntilTime: time.Now().Add(-time.Hour)}), false)
+}
+
+func TestETag(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	assert.NilError(t, err)
+
+	query := &repository.LogQuery{Services: []string{"service.foo"}}
+	options := &renderOptions{Location: time.UTC}
+
+	tag, err := eTag(r, query, options, "1", 10)
+	assert.NilError(t, err)
+
+	// The same query gives the same tag
+	same, err := eTag(r, query, options, "1", 10)
+	assert.NilError(t, err)
+	assert.Equal(t, same, tag)
+
+	// A new event changes the tag
+	other, err := eTag(r, query, options, "2", 11)
+	assert.NilError(t, err)
+	assert.Assert(t, other != tag)
+
+	// A different query changes the tag
+	other, err = eTag(r, &repository.LogQuery{Services: []string{"service.bar"}}, options, "1", 10)
+	assert.NilError(t, err)
+	assert.Assert(t, other != tag)
+
+	// The tag is weak so that it covers compressed responses too
+	assert.Assert(t, strings.HasPrefix(tag, `W/"`))
+
+	r.Header.Set("If-None-Match", `"abc", `+tag)
+	assert.Equal(t, matchesETag(r, tag), true)
+	assert.Equal(t, matchesETag(r, `"def"`), false)
+
+	// Strong tags match the weak tag
+	r.Header.Set("If-None-Match", strings.TrimPrefix(tag, "W/"))
+	assert.Equal(t, matchesETag(r, tag), true)
+}
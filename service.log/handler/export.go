@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/metrics"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+const contentTypeZip = "application/zip"
+
+// exportManifestName is the name of the manifest in an export
+const exportManifestName = "manifest.json"
+
+// exportManifest describes the contents of an export
+type exportManifest struct {
+	// Query is the query that the events matched
+	Query map[string]string `json:"query"`
+
+	// Files are the files of raw lines in the export
+	Files []*exportFile `json:"files"`
+
+	// Created is when the export was made
+	Created time.Time `json:"created"`
+}
+
+// exportFile is a file of the raw lines of one service's events
+type exportFile struct {
+	Name    string `json:"name"`
+	Service string `json:"service"`
+	Events  int    `json:"events"`
+}
+
+// HandleExport writes a zip of the raw lines of the events that match the
+// query, with a file for each service and a manifest of the query. The lines
+// are as they were written, other than redaction. The log files are read in
+// one pass, with each service's lines spooled to a temporary file until the
+// zip is written, so that memory use does not grow with the number of events.
+// Exports are not paginated.
+func (h *ReadHandler) HandleExport(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+
+	if query.Limit > 0 || query.Offset > 0 || query.Tail > 0 {
+		response.WriteJSON(w, errors.BadRequest("limit, offset and tail are not supported by exports"))
+		return
+	}
+
+	h.setDefaultTimeWindow(query)
+	metrics.Reads.Inc()
+
+	// Read the events before anything is written so that errors can be returned
+	spools, err := h.spoolExport(r, query)
+	defer removeSpools(spools)
+	if err != nil {
+		if isCancelled(err) {
+			logger.Debug("Request cancelled: %v", err)
+			return
+		}
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to read events: %v", err)
+		response.WriteJSON(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeZip)
+	w.Header().Set("Content-Disposition", `attachment; filename="logs.zip"`)
+
+	// The status has been sent once anything is written
+	// so from here on errors can only be logged
+	zw := zip.NewWriter(w)
+	var files []*exportFile
+	for _, spool := range spools {
+		if err := writeExportFile(zw, spool); err != nil {
+			logger.Error("Failed to export events: %v", err)
+			return
+		}
+		files = append(files, spool.file)
+	}
+
+	manifest := &exportManifest{
+		Query:   metadata,
+		Files:   files,
+		Created: time.Now().UTC(),
+	}
+	if err := writeExportManifest(zw, manifest); err != nil {
+		logger.Error("Failed to write manifest: %v", err)
+		return
+	}
+
+	if err := zw.Close(); err != nil {
+		logger.Error("Failed to write zip: %v", err)
+	}
+}
+
+// exportSpool holds the raw lines of a service's events until they are
+// written to the zip, because only one file in a zip can be written at a time
+type exportSpool struct {
+	file *exportFile
+	tmp  *os.File
+}
+
+// spoolExport reads the events that match the query, oldest first, and
+// writes the raw lines of each service's events to its own spool. The
+// spools are sorted by file name. Services are matched exactly, so
+// services whose names only differ in case have their own files.
+func (h *ReadHandler) spoolExport(r *http.Request, query *repository.LogQuery) ([]*exportSpool, error) {
+	byService := map[string]*exportSpool{}
+	names := map[string]bool{}
+	var spools []*exportSpool
+
+	q := *query
+	q.Reverse = false
+
+	err := h.LogRepository.FindStream(r.Context(), &q, func(event *domain.Event) error {
+		spool, ok := byService[event.Service]
+		if !ok {
+			tmp, err := ioutil.TempFile("", "service.log-export")
+			if err != nil {
+				return errors.Wrap(err, nil)
+			}
+
+			spool = &exportSpool{
+				file: &exportFile{
+					Name:    uniqueExportFilename(names, event.Service),
+					Service: event.Service,
+				},
+				tmp: tmp,
+			}
+			byService[event.Service] = spool
+			spools = append(spools, spool)
+		}
+
+		spool.file.Events++
+		if _, err := spool.tmp.WriteString(domain.Redact(string(event.Raw)) + "\n"); err != nil {
+			return errors.Wrap(err, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return spools, err
+	}
+
+	sort.Slice(spools, func(i, j int) bool {
+		return spools[i].file.Name < spools[j].file.Name
+	})
+	return spools, nil
+}
+
+// removeSpools closes and removes the spools' temporary files
+func removeSpools(spools []*exportSpool) {
+	for _, spool := range spools {
+		_ = spool.tmp.Close()
+		_ = os.Remove(spool.tmp.Name())
+	}
+}
+
+// writeExportFile copies the spool's lines to a file in the zip
+func writeExportFile(zw *zip.Writer, spool *exportSpool) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     spool.file.Name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, nil)
+	}
+
+	if _, err := spool.tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, nil)
+	}
+	if _, err := io.Copy(fw, spool.tmp); err != nil {
+		return errors.Wrap(err, nil)
+	}
+	return nil
+}
+
+func writeExportManifest(zw *zip.Writer, manifest *exportManifest) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     exportManifestName,
+		Method:   zip.Deflate,
+		Modified: manifest.Created,
+	})
+	if err != nil {
+		return errors.Wrap(err, nil)
+	}
+
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return errors.Wrap(err, nil)
+	}
+	return nil
+}
+
+// exportFilename returns the name of the file for the service's events.
+// Characters that could make the name a path are replaced.
+func exportFilename(service string) string {
+	if service == "" {
+		service = "unknown"
+	}
+
+	name := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':':
+			return '_'
+		}
+		return r
+	}, service)
+
+	return name + ".log"
+}
+
+// uniqueExportFilename returns the name of the file for the service's events,
+// with a number added if another service's file already has the name, e.g.
+// for "a/b" and "a_b". The name is added to the names that have been used.
+func uniqueExportFilename(used map[string]bool, service string) string {
+	name := exportFilename(service)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d.log", strings.TrimSuffix(exportFilename(service), ".log"), i)
+	}
+	used[name] = true
+	return name
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/repository"
+
+	"gotest.tools/assert"
+)
+
+func TestHandleExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The spacing of the lines is kept and continuation lines stay with their event
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	foo := []string{
+		fmt.Sprintf(`{"uuid":"1", "@timestamp":%q, "service":"service.foo", "severity":"info", "message":"a"}`, timestamp),
+		fmt.Sprintf(`{"uuid":"3","@timestamp":%q,"service":"service.foo","severity":"error","message":"b"}`, timestamp),
+		"    at main.go:10",
+	}
+	bar := []string{
+		fmt.Sprintf(`{"uuid":"2","@timestamp":%q,"service":"service/bar","severity":"info","message":"c"}`, timestamp),
+	}
+
+	// Services are matched exactly so these have their own files
+	fooUpper := fmt.Sprintf(`{"uuid":"4","@timestamp":%q,"service":"Service.foo","severity":"info","message":"d"}`, timestamp)
+	barUnderscore := fmt.Sprintf(`{"uuid":"5","@timestamp":%q,"service":"service_bar","severity":"info","message":"e"}`, timestamp)
+
+	lines := []string{foo[0], bar[0], foo[1], foo[2], fooUpper, barUnderscore}
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	h := &ReadHandler{LogRepository: repository.NewLogRepository(dir)}
+	r := httptest.NewRequest(http.MethodGet, "/export?services=service*", nil)
+	w := httptest.NewRecorder()
+	h.DecodeBody(w, r, h.HandleExport)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/zip")
+	assert.Equal(t, w.Header().Get("Content-Disposition"), `attachment; filename="logs.zip"`)
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	assert.NilError(t, err)
+
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.NilError(t, err)
+		b, err := ioutil.ReadAll(rc)
+		assert.NilError(t, err)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+
+	assert.Equal(t, len(files), 5)
+	assert.Equal(t, files["service.foo.log"], strings.Join(foo, "\n")+"\n")
+	assert.Equal(t, files["service_bar.log"], bar[0]+"\n")
+	assert.Equal(t, files["Service.foo.log"], fooUpper+"\n")
+	assert.Equal(t, files["service_bar-2.log"], barUnderscore+"\n")
+
+	manifest := &exportManifest{}
+	assert.NilError(t, json.Unmarshal([]byte(files["manifest.json"]), manifest))
+	assert.Equal(t, manifest.Query["services"], "service*")
+	assert.DeepEqual(t, manifest.Files, []*exportFile{
+		{Name: "Service.foo.log", Service: "Service.foo", Events: 1},
+		{Name: "service.foo.log", Service: "service.foo", Events: 2},
+		{Name: "service_bar-2.log", Service: "service_bar", Events: 1},
+		{Name: "service_bar.log", Service: "service/bar", Events: 1},
+	})
+}
+
+func TestHandleExportPaginated(t *testing.T) {
+	h := &ReadHandler{}
+	r := httptest.NewRequest(http.MethodGet, "/export?limit=10", nil)
+	w := httptest.NewRecorder()
+	h.DecodeBody(w, r, h.HandleExport)
+
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+// HandleFacets returns the number of events that match the query
+// for each value of the requested fields, e.g.
+// {"status_code": {"200": 990, "500": 10}}
+func (h *ReadHandler) HandleFacets(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+	options := r.Context().Value("options").(*renderOptions)
+
+	if len(options.Facets) == 0 {
+		response.WriteJSON(w, errors.BadRequest("facets must not be empty"))
+		return
+	}
+
+	h.setDefaultTimeWindow(query)
+
+	// Count every matching event, not just a single page
+	query.Limit = 0
+	query.Offset = 0
+	query.Tail = 0
+
+	rsp := map[string]map[string]int{}
+	for _, field := range options.Facets {
+		values, err := h.LogRepository.DistinctFieldValues(r.Context(), field, query)
+		if err != nil {
+			if isCancelled(err) {
+				logger.Debug("Request cancelled: %v", err)
+				return
+			}
+			err = errors.Wrap(err, metadata)
+			logger.Error("Failed to find values of field %q: %v", field, err)
+			response.WriteJSON(w, err)
+			return
+		}
+
+		rsp[field] = values
+	}
+
+	response.WriteJSON(w, rsp)
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeCSV    = "text/csv"
+	contentTypeHTML   = "text/html"
+	contentTypeText   = "text/plain"
+)
+
+// plaintextTimeFormat is the default time format for the plaintext renderer
+const plaintextTimeFormat = "2006-01-02 15:04:05"
+
+// namedTimeFormats can be given as the time_format instead of a Go layout
+var namedTimeFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"stamp":       time.Stamp,
+	"kitchen":     time.Kitchen,
+}
+
+const formatCSV = "csv"
+
+// Orders in which events can be returned to the client
+const (
+	orderAsc  = "asc"
+	orderDesc = "desc"
+)
+
+// renderOptions control how events are written to the response
+type renderOptions struct {
+	// Format is an explicitly requested output format, e.g. "csv".
+	// It takes precedence over the request's Accept header.
+	Format string
+
+	// TimeFormat is the layout used to format timestamps in plaintext
+	// output. It can be a Go time layout or one of namedTimeFormats.
+	TimeFormat string
+
+	// Bucket is the width of each bucket in a histogram
+	Bucket time.Duration
+
+	// Facets are the names of the fields to aggregate
+	Facets []string
+
+	// Columns are the names of the fields that the
+	// HTML view shows as columns of their own
+	Columns []string
+
+	// Order is the order in which events are returned, either "asc" for
+	// oldest first or "desc" for newest first. If empty, the order of
+	// the query's Reverse option is used.
+	Order string
+
+	// Location is the time zone that timestamps are written in
+	Location *time.Location
+
+	// Backlog is the number of recent events that are sent to
+	// a streaming client before any new events, like tail -f
+	Backlog int
+
+	// Buffer is the number of events that a streaming client's
+	// subscription can hold, overriding the watcher's BufferSize
+	Buffer int
+
+	// Compact makes the JSON streams write each event as a
+	// domain.CompactEvent instead of a domain.FormattedEvent
+	Compact bool
+}
+
+// jsonEvent returns the representation of the event
+// that is written to NDJSON and streaming responses
+func (o *renderOptions) jsonEvent(event *domain.Event) interface{} {
+	if o.Compact {
+		return event.Compact()
+	}
+	return event.Format()
+}
+
+// localise converts the events' timestamps to the requested time zone
+func (o *renderOptions) localise(events []*domain.Event) {
+	if o.Location == nil {
+		return
+	}
+
+	for _, event := range events {
+		event.Timestamp = event.Timestamp.In(o.Location)
+	}
+}
+
+// sortEvents orders the events according to Order, in the same order as
+// the repository (see domain.Event.Before). The sort is stable so events
+// that are equal keep their relative order.
+func (o *renderOptions) sortEvents(events []*domain.Event) {
+	switch o.Order {
+	case orderAsc:
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Before(events[j])
+		})
+	case orderDesc:
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[j].Before(events[i])
+		})
+	}
+}
+
+// newestFirst returns whether events are returned newest first
+func (o *renderOptions) newestFirst(q *repository.LogQuery) bool {
+	if o.Order == "" {
+		return q.Reverse
+	}
+	return o.Order == orderDesc
+}
+
+// timeLayout returns the Go time layout to use for plaintext output
+func (o *renderOptions) timeLayout() string {
+	if o.TimeFormat == "" {
+		return plaintextTimeFormat
+	}
+	if layout, ok := namedTimeFormats[strings.ToLower(o.TimeFormat)]; ok {
+		return layout
+	}
+	return o.TimeFormat
+}
+
+// accepts returns whether the request's Accept header contains the media type
+func accepts(r *http.Request, mediaType string) bool {
+	return strings.Contains(r.Header.Get("Accept"), mediaType)
+}
+
+// acceptsPlaintext returns whether the client asked for plaintext in preference to HTML
+func acceptsPlaintext(r *http.Request) bool {
+	return accepts(r, contentTypeText) && !accepts(r, contentTypeHTML)
+}
+
+// eventEncoder writes events to the response one at a time so that
+// the full response is never held in memory. Nothing is written to
+// the response, including headers, until the first event is encoded
+// or the encoder is closed.
+type eventEncoder interface {
+	// encode writes the event to the response
+	encode(event *domain.Event) error
+
+	// close writes anything that is still buffered
+	close() error
+
+	// started returns whether anything has been written
+	started() bool
+}
+
+// newEventEncoder returns the encoder for the requested format
+// or nil if the events should not be encoded one at a time
+func newEventEncoder(w http.ResponseWriter, r *http.Request, options *renderOptions) eventEncoder {
+	switch {
+	case options.Format == formatCSV:
+		return &csvEncoder{w: w}
+	case accepts(r, contentTypeNDJSON):
+		return &ndjsonEncoder{w: w, options: options}
+	}
+	return nil
+}
+
+// writeEvents encodes each of the events and closes the encoder
+func writeEvents(enc eventEncoder, events []*domain.Event, logger *slog.FieldLogger) {
+	for _, event := range events {
+		if err := enc.encode(event); err != nil {
+			logger.Error("Failed to write event: %v", err)
+			return
+		}
+	}
+
+	if err := enc.close(); err != nil {
+		logger.Error("Failed to flush response: %v", err)
+	}
+}
+
+// ndjsonEncoder writes each event as a JSON object followed by a new line
+type ndjsonEncoder struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	options *renderOptions
+}
+
+func (e *ndjsonEncoder) start() {
+	if e.enc == nil {
+		e.w.Header().Set("Content-Type", contentTypeNDJSON)
+		e.enc = json.NewEncoder(e.w)
+	}
+}
+
+func (e *ndjsonEncoder) encode(event *domain.Event) error {
+	e.start()
+	return e.enc.Encode(e.options.jsonEvent(event))
+}
+
+func (e *ndjsonEncoder) close() error {
+	e.start()
+	return nil
+}
+
+func (e *ndjsonEncoder) started() bool {
+	return e.enc != nil
+}
+
+// csvEncoder writes a header row followed by one record per
+// event as an attachment so that browsers download the file
+type csvEncoder struct {
+	w  http.ResponseWriter
+	cw *csv.Writer
+}
+
+func (e *csvEncoder) start() error {
+	if e.cw != nil {
+		return nil
+	}
+
+	e.w.Header().Set("Content-Type", contentTypeCSV)
+	e.w.Header().Set("Content-Disposition", `attachment; filename="logs.csv"`)
+
+	e.cw = csv.NewWriter(e.w)
+	return e.cw.Write([]string{"timestamp", "service", "severity", "message"})
+}
+
+func (e *csvEncoder) encode(event *domain.Event) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+
+	return e.cw.Write([]string{
+		event.Timestamp.Format(time.RFC3339),
+		event.Service,
+		event.Severity.String(),
+		domain.Redact(event.Message),
+	})
+}
+
+func (e *csvEncoder) close() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+func (e *csvEncoder) started() bool {
+	return e.cw != nil
+}
+
+// writePlaintext writes each event on its own line in a compact format
+// that is easy to read in a terminal, e.g.
+// 2006-01-02 15:04:05 [service.foo] ERROR Something went wrong
+func writePlaintext(w http.ResponseWriter, events []*domain.Event, options *renderOptions, logger *slog.FieldLogger) {
+	w.Header().Set("Content-Type", contentTypeText+"; charset=UTF-8")
+
+	layout := options.timeLayout()
+	for _, event := range events {
+		_, err := fmt.Fprintf(w, "%s [%s] %s %s\n",
+			event.Timestamp.Format(layout),
+			event.Service,
+			event.Severity.String(),
+			domain.Redact(event.Message),
+		)
+		if err != nil {
+			logger.Error("Failed to write event: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+
+	"gotest.tools/assert"
+)
+
+func TestRenderOptionsSortEvents(t *testing.T) {
+	now := time.Now()
+	events := func() []*domain.Event {
+		return []*domain.Event{
+			{UUID: "new", Timestamp: now},
+			{UUID: "old", Timestamp: now.Add(-time.Minute)},
+		}
+	}
+
+	uuids := func(events []*domain.Event) []string {
+		var u []string
+		for _, e := range events {
+			u = append(u, e.UUID)
+		}
+		return u
+	}
+
+	e := events()
+	(&renderOptions{Order: orderAsc}).sortEvents(e)
+	assert.DeepEqual(t, uuids(e), []string{"old", "new"})
+
+	e = events()
+	(&renderOptions{Order: orderDesc}).sortEvents(e)
+	assert.DeepEqual(t, uuids(e), []string{"new", "old"})
+
+	// Without an order, events are left as they are
+	e = events()
+	(&renderOptions{}).sortEvents(e)
+	assert.DeepEqual(t, uuids(e), []string{"new", "old"})
+}
+
+func TestRenderOptionsNewestFirst(t *testing.T) {
+	q := &repository.LogQuery{Reverse: true}
+	assert.Equal(t, (&renderOptions{}).newestFirst(q), true)
+	assert.Equal(t, (&renderOptions{Order: orderAsc}).newestFirst(q), false)
+	assert.Equal(t, (&renderOptions{Order: orderDesc}).newestFirst(&repository.LogQuery{}), true)
+}
+
+func TestNDJSONEncoderCompact(t *testing.T) {
+	event := &domain.Event{
+		UUID:      "1",
+		Timestamp: time.Date(2019, 6, 1, 12, 30, 0, 500, time.UTC),
+		Severity:  slog.ErrorSeverity,
+		Service:   "service.foo",
+		Message:   "Failed to reach jake@example.com",
+		Metadata:  map[string]string{"foo": "bar"},
+	}
+
+	w := httptest.NewRecorder()
+	enc := &ndjsonEncoder{w: w, options: &renderOptions{Compact: true}}
+	assert.NilError(t, enc.encode(event))
+	assert.NilError(t, enc.close())
+
+	assert.Equal(t, w.Header().Get("Content-Type"), contentTypeNDJSON)
+	assert.Equal(t, w.Body.String(), `["1","2019-06-01T12:30:00.0000005Z",6,"service.foo","Failed to reach ***"]`+"\n")
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// gzipResponseWriter compresses everything written to the response. The
+// gzip writer is only created once the status is known to allow a body.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if bodyAllowed(w.r, status) {
+		// The length of the compressed body will be different
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		// Sniff the content type from the uncompressed bytes otherwise
+		// net/http will detect it as gzip from the compressed bytes
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush writes any buffered compressed data to the client
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close writes the end of the compressed body, if there is one
+func (w *gzipResponseWriter) close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// bodyAllowed returns whether the response to the request can have a body
+func bodyAllowed(r *http.Request, status int) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// Gzip is middleware that compresses the response if the client accepts
+// gzip encoding. WebSocket upgrade requests are passed through untouched.
+func Gzip(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if websocket.IsWebSocketUpgrade(r) {
+		next(w, r)
+		return
+	}
+
+	// Caches must not give compressed responses to clients that do not accept them
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		next(w, r)
+		return
+	}
+
+	gw := &gzipResponseWriter{ResponseWriter: w, r: r}
+	defer gw.close()
+
+	next(gw, r)
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func writeHello(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "<html>hello</html>")
+}
+
+func TestGzip(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+
+	Gzip(w, r, writeHello)
+
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "gzip")
+	assert.Equal(t, w.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	assert.Equal(t, w.Header().Get("Vary"), "Accept-Encoding")
+
+	gz, err := gzip.NewReader(w.Body)
+	assert.NilError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "<html>hello</html>")
+}
+
+func TestGzipNotAccepted(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+
+	Gzip(w, r, writeHello)
+
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "")
+	assert.Equal(t, w.Header().Get("Vary"), "Accept-Encoding")
+	assert.Equal(t, w.Body.String(), "<html>hello</html>")
+}
+
+func TestGzipNoBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{"not modified", "GET", http.StatusNotModified},
+		{"no content", "GET", http.StatusNoContent},
+		{"head", "HEAD", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+
+			Gzip(w, r, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			})
+
+			assert.Equal(t, w.Code, tc.status)
+			assert.Equal(t, w.Header().Get("Content-Encoding"), "")
+			assert.Equal(t, w.Body.Len(), 0)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+// maxHistogramBuckets stops clients asking for a huge response
+const maxHistogramBuckets = 10000
+
+type histogramBucket struct {
+	Start      time.Time      `json:"start"`
+	Count      int            `json:"count"`
+	BySeverity map[string]int `json:"by_severity"`
+}
+
+// HandleHistogram returns the number of events that match the query in
+// fixed-width time buckets between the query's SinceTime and UntilTime.
+// Buckets with no events are included so the result is continuous.
+func (h *ReadHandler) HandleHistogram(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+	options := r.Context().Value("options").(*renderOptions)
+
+	if options.Bucket <= 0 {
+		response.WriteJSON(w, errors.BadRequest("bucket must be a positive duration"))
+		return
+	}
+
+	h.setDefaultTimeWindow(query)
+
+	if err := checkWindow(query.SinceTime, query.UntilTime); err != nil {
+		response.WriteJSON(w, err)
+		return
+	}
+
+	// Align the buckets to the bucket width so they're easier to read
+	start := query.SinceTime.Truncate(options.Bucket)
+	n := int(query.UntilTime.Sub(start)/options.Bucket) + 1
+	if n > maxHistogramBuckets {
+		response.WriteJSON(w, errors.BadRequest("bucket %s would produce %d buckets, the maximum is %d", options.Bucket, n, maxHistogramBuckets))
+		return
+	}
+
+	// Count every matching event, not just a single page
+	query.Limit = 0
+	query.Offset = 0
+	query.Tail = 0
+
+	buckets := make([]*histogramBucket, n)
+	for i := range buckets {
+		buckets[i] = &histogramBucket{
+			Start:      start.Add(time.Duration(i) * options.Bucket),
+			BySeverity: map[string]int{},
+		}
+	}
+
+	// The events are streamed rather than found so that
+	// busy windows are not truncated by MaxResults
+	err := h.LogRepository.FindStream(r.Context(), query, func(event *domain.Event) error {
+		i := int(event.Timestamp.Sub(start) / options.Bucket)
+		if i < 0 || i >= n {
+			return nil
+		}
+
+		buckets[i].Count++
+		buckets[i].BySeverity[strings.ToLower(event.Severity.String())]++
+		return nil
+	})
+	if err != nil {
+		if isCancelled(err) {
+			logger.Debug("Request cancelled: %v", err)
+			return
+		}
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to find events: %v", err)
+		response.WriteJSON(w, err)
+		return
+	}
+
+	response.WriteJSON(w, buckets)
+}
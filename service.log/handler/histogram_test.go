@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/repository"
+
+	"gotest.tools/assert"
+)
+
+func TestHandleHistogram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	var lines []string
+	for i, severity := range []string{"info", "error", "info"} {
+		lines = append(lines, fmt.Sprintf(
+			`{"uuid":"%d","@timestamp":%q,"service":"service.foo","severity":%q,"message":"hello"}`,
+			i+1, time.Now().UTC().Format(time.RFC3339), severity,
+		))
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	// Every event is counted even if there are more than MaxResults
+	repo := repository.NewLogRepository(dir)
+	repo.MaxResults = 1
+	h := &ReadHandler{LogRepository: repo}
+	r := httptest.NewRequest(http.MethodGet, "/histogram?bucket=2h", nil)
+	w := httptest.NewRecorder()
+	h.DecodeBody(w, r, h.HandleHistogram)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	var rsp struct {
+		Data []*histogramBucket `json:"data"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+
+	var count int
+	bySeverity := map[string]int{}
+	for _, b := range rsp.Data {
+		count += b.Count
+		for severity, n := range b.BySeverity {
+			bySeverity[severity] += n
+		}
+	}
+	assert.Equal(t, count, 3)
+	assert.DeepEqual(t, bySeverity, map[string]int{"info": 2, "error": 1})
+}
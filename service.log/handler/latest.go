@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+// latestResponse identifies the newest matching event. Both
+// values are null if no events match the query.
+type latestResponse struct {
+	UUID      *string    `json:"uuid"`
+	Timestamp *time.Time `json:"timestamp"`
+}
+
+// HandleLatest returns the UUID and timestamp of the newest event that
+// matches the query. It is much cheaper than HandleRead so pollers can
+// call it to find out whether anything has changed since they last
+// fetched the events. The default time window is not applied.
+func (h *ReadHandler) HandleLatest(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+
+	event, err := h.LogRepository.Latest(r.Context(), query)
+	if err != nil {
+		if isCancelled(err) {
+			logger.Debug("Request cancelled: %v", err)
+			return
+		}
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to find latest event: %v", err)
+		response.WriteJSON(w, err)
+		return
+	}
+
+	rsp := &latestResponse{}
+	if event != nil {
+		rsp.UUID = &event.UUID
+		rsp.Timestamp = &event.Timestamp
+	}
+
+	response.WriteJSON(w, rsp)
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/request"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+)
+
+// logLevelRequest changes the level of the service's own logs
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// logLevelResponse is the current level of the service's own logs
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// HandleGetLogLevel returns the minimum severity of
+// the service's own logs, e.g. {"level":"warn"}
+func HandleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	response.WriteJSON(w, &logLevelResponse{
+		Level: strings.ToLower(slog.Level().String()),
+	})
+}
+
+// HandleSetLogLevel changes the minimum severity of the service's own logs
+// without a restart. It does not affect the severity of queried events.
+func HandleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	body := logLevelRequest{}
+	if err := request.Decode(r, &body); err != nil {
+		response.WriteJSON(w, err)
+		return
+	}
+
+	severity, err := slog.ParseSeverity(body.Level)
+	if err != nil {
+		response.WriteJSON(w, errors.BadRequest("invalid level: %v", err))
+		return
+	}
+
+	// Record the change while the more verbose of the two levels is in force
+	previous := slog.Level()
+	if severity > previous {
+		slog.Info("Changing log level from %s to %s", previous, severity)
+		slog.SetLevel(severity)
+	} else {
+		slog.SetLevel(severity)
+		slog.Info("Changed log level from %s to %s", previous, severity)
+	}
+
+	response.WriteJSON(w, &logLevelResponse{
+		Level: strings.ToLower(severity.String()),
+	})
+}
@@ -1,14 +1,17 @@
 package handler
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"encoding/json"
+	"fmt"
 	"html/template"
 	"net/http"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jakewright/home-automation/libraries/go/errors"
@@ -16,231 +19,904 @@ import (
 	"github.com/jakewright/home-automation/libraries/go/response"
 	"github.com/jakewright/home-automation/libraries/go/slog"
 	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/live"
+	"github.com/jakewright/home-automation/service.log/metrics"
 	"github.com/jakewright/home-automation/service.log/repository"
 	"github.com/jakewright/home-automation/service.log/watch"
-
-	"github.com/gorilla/websocket"
 )
 
 const htmlTimeFormat = "2006-01-02T15:04"
 
+// timeFormats are the accepted formats of since_time and until_time. Browsers
+// include seconds in datetime-local inputs if the step is less than a minute.
+var timeFormats = []string{htmlTimeFormat, "2006-01-02T15:04:05", time.RFC3339}
+
+// localTimeFormats are the timeFormats that are in the request's time zone
+var localTimeFormats = timeFormats[:2]
+
+// defaultMaxMessageLength is used if ReadHandler.MaxMessageLength is not set
+const defaultMaxMessageLength = 2000
+
+// defaultWindow is used if ReadHandler.DefaultWindow is not set
+const defaultWindow = time.Hour
+
+// invertedWindowMessage is the error message for an until time before the since time
+const invertedWindowMessage = "until_time must not be before since_time"
+
 type ReadHandler struct {
 	TemplateDirectory string
 	LogRepository     *repository.LogRepository
 	Watcher           *watch.Watcher
+
+	// PingInterval is how often WebSocket clients are sent
+	// a ping to keep the connection alive through proxies.
+	// Defaults to 30 seconds if not set.
+	PingInterval time.Duration
+
+	// DefaultWindow is how far back to read when a request does not give
+	// a since_time. A request can still read further back for a single
+	// call with a relative since, e.g. since=24h. Defaults to one hour.
+	// It is replaced by Live's DefaultWindow once Live holds settings.
+	DefaultWindow time.Duration
+
+	// HeartbeatInterval is how often streaming clients are sent a
+	// heartbeat message while no events are sent, so that they can tell
+	// a quiet stream from a dead connection. Heartbeats are disabled if
+	// it is zero. Unlike pings, browsers can see heartbeats.
+	HeartbeatInterval time.Duration
+
+	// MaxConnectionDuration is how long a streaming client can stay
+	// connected before it is told to reconnect, which bounds the life of
+	// its subscription and any state that builds up for it. WebSocket
+	// clients are sent a close frame with the service restart code. There
+	// is no limit if it is zero.
+	MaxConnectionDuration time.Duration
+
+	// WriteTimeout is how long to wait for a WebSocket client to
+	// accept a message before disconnecting it, so that a client
+	// that stops reading does not hold on to its subscription.
+	// Defaults to 10 seconds if not set.
+	WriteTimeout time.Duration
+
+	// EnableCompression compresses each message sent to WebSocket
+	// clients that support the permessage-deflate extension. This trades
+	// CPU for bandwidth: a typical 1KB event compresses to about half its
+	// size and batches of events compress much further because the events
+	// repeat the same keys.
+	EnableCompression bool
+
+	// ReloadTemplates causes the template to be parsed on every
+	// request, which is useful when editing it in development.
+	// Otherwise it is parsed once and cached.
+	ReloadTemplates bool
+
+	// MaxMessageLength is the number of bytes after which messages
+	// are truncated in the HTML view. The full message can still be
+	// expanded. Defaults to 2000. Other formats are never truncated.
+	MaxMessageLength int
+
+	// AllowedOrigins are the origins that browsers may open a WebSocket
+	// from, e.g. "https://logs.example.com". An origin of "*" allows any
+	// origin, which is only intended for development. If empty, only
+	// pages served from localhost may connect. It is replaced by
+	// Live's AllowedOrigins once Live holds settings.
+	AllowedOrigins []string
+
+	// Live holds the settings that are reloaded while serving requests
+	Live *live.Value
+
+	templateMux sync.Mutex
+	template    *template.Template
+
+	servicesCache servicesCache
+}
+
+// readResponse is the data used to render the index template
+type readResponse struct {
+	FormattedEvents []*domain.FormattedEvent
+	Services        string
+	ExcludeServices string
+	Severity        int
+	MaxSeverity     int
+	Message         string
+	MessagePattern  string
+	MessagePrefix   string
+	TraceID         string
+	SourceFile      string
+	Fields          string
+	SinceTime       string
+	UntilTime       string
+	Timezone        string
+	LastUUID        string
+	Truncated       bool
+	Reverse         bool
+	Dedupe          bool
+	Order           string
+	NewestFirst     bool
+	Limit           int
+	Offset          int
+	Tail            int
+	PrevOffset      int
+	NextOffset      int
+	FirstMatch      int
+	LastMatch       int
+	TotalMatches    int
+
+	// Summary counts the events that are shown by service and severity
+	Summary *resultSummary
+
+	// Columns are the names of fields that are shown in their own
+	// column. ColumnCount is the total number of columns in the table.
+	Columns     []string
+	ColumnCount int
 }
 
 type readRequest struct {
-	Services  string `json:"services"`
-	Severity  int    `json:"severity"`
-	SinceTime string `json:"since_time"` // The HTML datetime-local element formats time weirdly so we need to unmarshal to a string
-	UntilTime string `json:"until_time"`
-	SinceUUID string `json:"since_uuid"`
-	Reverse   bool   `json:"reverse"`
+	Services        string `json:"services"`
+	ExcludeServices string `json:"exclude_services"`
+	Severity        int    `json:"severity" validate:"min=0"`
+	SeverityName    string `json:"severity_name"`
+	MinSeverity     int    `json:"min_severity" validate:"min=0"`
+	MaxSeverity     int    `json:"max_severity" validate:"min=0"`
+	Message         string `json:"message"`
+	MessagePattern  string `json:"message_pattern"`
+	MessagePrefix   string `json:"message_prefix"`
+	TraceID         string `json:"trace_id"`
+	SourceFile      string `json:"source_file"`
+	Fields          string `json:"fields"`
+	SinceTime       string `json:"since_time"` // The HTML datetime-local element formats time weirdly so we need to unmarshal to a string
+	UntilTime       string `json:"until_time"`
+	Since           string `json:"since"` // A duration before now, e.g. "15m", as an alternative to since_time
+	Until           string `json:"until"`
+	SinceUUID       string `json:"since_uuid"`
+	IncludeSince    bool   `json:"include_since"`
+	UntilUUID       string `json:"until_uuid"`
+	IncludeUntil    bool   `json:"include_until"`
+	Reverse         bool   `json:"reverse"`
+	Dedupe          bool   `json:"dedupe"`
+	Limit           int    `json:"limit" validate:"min=0"`
+	Offset          int    `json:"offset" validate:"min=0"`
+	Tail            int    `json:"tail" validate:"min=0"`
+	Backlog         int    `json:"backlog" validate:"min=0"`
+	Buffer          int    `json:"buffer" validate:"min=0,max=10000"`
+	Compact         bool   `json:"compact"`
+	Format          string `json:"format"`
+	TimeFormat      string `json:"time_format"`
+	Bucket          string `json:"bucket"`
+	Facets          string `json:"facets"`
+	Columns         string `json:"columns"`
+	Order           string `json:"order"`
+	Timezone        string `json:"timezone"`
+
+	// Search is a repository.Search, either as an object
+	// in a JSON body or as a string of JSON in the URL
+	Search interface{} `json:"search"`
+}
+
+// Validate checks that the severities are known, including any custom
+// levels, and that the time window is not inverted. Mixed absolute and
+// relative times are not checked because they are resolved in parseQuery.
+func (r *readRequest) Validate() error {
+	for _, s := range []struct {
+		name  string
+		value int
+	}{
+		{"severity", r.Severity},
+		{"min_severity", r.MinSeverity},
+		{"max_severity", r.MaxSeverity},
+	} {
+		if s.value != 0 && !slog.Severity(s.value).Known() {
+			return errors.BadRequest("%s %d is not a known severity", s.name, s.value)
+		}
+	}
+
+	if r.SinceTime != "" && r.UntilTime != "" {
+		// Times without offsets are both in the request's time zone so they can
+		// be compared without it. Times with offsets are checked in parseQuery.
+		since, sinceErr := parseTime(r.SinceTime, localTimeFormats, time.UTC)
+		until, untilErr := parseTime(r.UntilTime, localTimeFormats, time.UTC)
+		if sinceErr == nil && untilErr == nil && until.Before(since) {
+			return errors.BadRequest(invertedWindowMessage)
+		}
+	}
+
+	if r.Since != "" && r.Until != "" {
+		since, sinceErr := time.ParseDuration(r.Since)
+		until, untilErr := time.ParseDuration(r.Until)
+		if sinceErr == nil && untilErr == nil && until > since {
+			return errors.BadRequest("until must not be before since")
+		}
+	}
+
+	return nil
 }
 
 func (h *ReadHandler) DecodeBody(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	// The ID is returned even if the request is invalid so
+	// that clients can refer to it when reporting problems
+	id := requestID(r)
+	w.Header().Set(requestIDHeader, id)
+
 	body := readRequest{}
 	if err := request.Decode(r, &body); err != nil {
 		response.WriteJSON(w, err)
 		return
 	}
 
-	query, err := parseQuery(&body)
+	location, err := parseTimezone(body.Timezone)
+	if err != nil {
+		response.WriteJSON(w, err)
+		return
+	}
+
+	query, err := parseQuery(&body, location)
+	if err != nil {
+		slog.With(map[string]string{"requestID": id}).Error("Failed to parse options from body: %v", err)
+		response.WriteJSON(w, err)
+		return
+	}
+
+	search, err := parseSearch(body.Search)
 	if err != nil {
-		slog.Error("Failed to parse options from body: %v", err)
 		response.WriteJSON(w, err)
 		return
 	}
 
 	metadata := map[string]string{
-		"services":  strings.Join(query.Services, ", "),
-		"severity":  query.Severity.String(),
-		"sinceTime": query.SinceTime.Format(time.RFC3339),
-		"untilTime": query.UntilTime.Format(time.RFC3339),
-		"sinceUUID": query.SinceUUID,
-		"reverse":   strconv.FormatBool(query.Reverse),
+		"requestID":      id,
+		"services":       strings.Join(query.Services, ", "),
+		"severity":       query.Severity.String(),
+		"message":        query.Message,
+		"messagePattern": query.MessagePattern,
+		"messagePrefix":  query.MessagePrefix,
+		"traceID":        query.TraceID,
+		"sourceFile":     query.SourceFile,
+		"fields":         formatFields(query.Fields),
+		"sinceTime":      query.SinceTime.Format(time.RFC3339),
+		"untilTime":      query.UntilTime.Format(time.RFC3339),
+		"sinceUUID":      query.SinceUUID,
+		"untilUUID":      query.UntilUUID,
+		"reverse":        strconv.FormatBool(query.Reverse),
+		"dedupe":         strconv.FormatBool(query.Dedupe),
+		"limit":          strconv.Itoa(query.Limit),
+		"offset":         strconv.Itoa(query.Offset),
+		"tail":           strconv.Itoa(query.Tail),
+	}
+
+	options := &renderOptions{
+		Format:     strings.ToLower(body.Format),
+		TimeFormat: body.TimeFormat,
+		Order:      strings.ToLower(body.Order),
+		Location:   location,
+		Backlog:    body.Backlog,
+		Buffer:     body.Buffer,
+		Compact:    body.Compact,
+	}
+
+	if options.Format != "" && options.Format != formatCSV {
+		response.WriteJSON(w, errors.BadRequest("unsupported format %q", body.Format))
+		return
+	}
+
+	switch options.Order {
+	case "", orderAsc, orderDesc:
+	default:
+		response.WriteJSON(w, errors.BadRequest("order must be %q or %q", orderAsc, orderDesc))
+		return
+	}
+
+	if body.Bucket != "" {
+		options.Bucket, err = time.ParseDuration(body.Bucket)
+		if err != nil {
+			response.WriteJSON(w, errors.BadRequest("invalid bucket: %v", err))
+			return
+		}
+	}
+
+	if body.Facets != "" {
+		options.Facets = strings.Split(strings.Replace(body.Facets, " ", "", -1), ",")
 	}
 
-	ctx := context.WithValue(r.Context(), "query", query)
+	if body.Columns != "" {
+		options.Columns = strings.Split(strings.Replace(body.Columns, " ", "", -1), ",")
+	}
+
+	ctx := context.WithValue(r.Context(), "requestID", id)
+	ctx = context.WithValue(ctx, "query", query)
 	ctx = context.WithValue(ctx, "metadata", metadata)
+	ctx = context.WithValue(ctx, "logger", slog.With(metadata))
+	ctx = context.WithValue(ctx, "options", options)
+	ctx = context.WithValue(ctx, "search", search)
 	next(w, r.WithContext(ctx))
 }
 
 func (h *ReadHandler) HandleRead(w http.ResponseWriter, r *http.Request) {
 	query := r.Context().Value("query").(*repository.LogQuery)
 	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+	options := r.Context().Value("options").(*renderOptions)
 
-	// Default to logs from the last hour
-	if query.SinceTime.IsZero() {
-		query.SinceTime = time.Now().Add(-1 * time.Hour)
-	}
-	if query.UntilTime.IsZero() {
-		query.UntilTime = time.Now()
+	// Only closed time windows can be cached because new
+	// events could be added to the results of a live window
+	live := isLive(query)
+
+	paginated := h.prepareRead(query, options)
+
+	// Exports are streamed so that memory use does not grow with the
+	// number of events. They are not given an ETag because it depends
+	// on the events, which are not known until they have been written.
+	if enc := newEventEncoder(w, r, options); enc != nil && !paginated {
+		h.streamRead(w, r, enc)
+		return
 	}
 
-	events, err := h.LogRepository.Find(query)
+	result, err := h.LogRepository.FindWithMeta(r.Context(), query)
 	if err != nil {
-		slog.Error("Failed to find events: %v", err, metadata)
+		if isCancelled(err) {
+			logger.Debug("Request cancelled: %v", err)
+			return
+		}
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to find events: %v", err)
 		response.WriteJSON(w, err)
 		return
 	}
 
-	var lastUUID string
+	events := result.Events
+	if result.Truncated {
+		logger.Warn("Results truncated at %d events", len(events))
+	}
+
+	lastUUID := newestUUID(events, query)
 
-	if len(events) > 0 {
-		if query.Reverse {
-			lastUUID = events[0].UUID
+	if !live {
+		tag, err := eTag(r, query, options, lastUUID, len(events))
+		if err != nil {
+			logger.Error("Failed to generate ETag: %v", err)
+		} else if matchesETag(r, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
 		} else {
-			lastUUID = events[len(events)-1].UUID
+			w.Header().Set("ETag", tag)
+		}
+	}
+
+	if paginated {
+		w.Header().Set("X-Total-Count", strconv.Itoa(result.Total))
+	}
+
+	options.sortEvents(events)
+	options.localise(events)
+
+	if enc := newEventEncoder(w, r, options); enc != nil {
+		writeEvents(enc, events, logger)
+		return
+	}
+
+	if acceptsPlaintext(r) {
+		writePlaintext(w, events, options, logger)
+		return
+	}
+
+	// Offsets for the previous and next pages. There is
+	// only a next page if there are more matching events.
+	var prevOffset, nextOffset int
+	if paginated {
+		prevOffset = query.Offset - query.Limit
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		if query.Offset+len(events) < result.Total {
+			nextOffset = query.Offset + query.Limit
 		}
 	}
 
 	formattedEvents := make([]*domain.FormattedEvent, len(events))
 	for i, event := range events {
 		formattedEvents[i] = event.Format()
+		formattedEvents[i].Truncate(h.maxMessageLength())
 	}
 
-	rsp := struct {
-		FormattedEvents []*domain.FormattedEvent
-		Services        string
-		Severity        int
-		SinceTime       string
-		UntilTime       string
-		LastUUID        string
-		Reverse         bool
-	}{
+	rsp := &readResponse{
 		FormattedEvents: formattedEvents,
 		Services:        strings.Join(query.Services, ", "),
+		ExcludeServices: strings.Join(query.ExcludeServices, ", "),
 		Severity:        int(query.Severity),
-		SinceTime:       query.SinceTime.Format(htmlTimeFormat),
-		UntilTime:       query.UntilTime.Format(htmlTimeFormat),
+		MaxSeverity:     int(query.MaxSeverity),
+		Message:         query.Message,
+		MessagePattern:  query.MessagePattern,
+		MessagePrefix:   query.MessagePrefix,
+		TraceID:         query.TraceID,
+		SourceFile:      query.SourceFile,
+		Fields:          formatFields(query.Fields),
+		SinceTime:       query.SinceTime.In(options.Location).Format(htmlTimeFormat),
+		UntilTime:       query.UntilTime.In(options.Location).Format(htmlTimeFormat),
+		Timezone:        options.Location.String(),
 		LastUUID:        lastUUID,
+		Truncated:       result.Truncated,
 		Reverse:         query.Reverse,
+		Dedupe:          query.Dedupe,
+		Order:           options.Order,
+		NewestFirst:     options.newestFirst(query),
+		Limit:           query.Limit,
+		Offset:          query.Offset,
+		Tail:            query.Tail,
+		PrevOffset:      prevOffset,
+		NextOffset:      nextOffset,
+		FirstMatch:      query.Offset + 1,
+		LastMatch:       query.Offset + len(events),
+		TotalMatches:    result.Total,
+		Summary:         summarise(events, paginated, result.Truncated),
+		Columns:         options.Columns,
+		ColumnCount:     5 + len(options.Columns),
 	}
 
-	t, err := template.ParseFiles(path.Join(h.TemplateDirectory, "index.html"))
+	t, err := h.getTemplate()
 	if err != nil {
-		slog.Error("Failed to parse template: %v", err)
+		logger.Error("Failed to parse template: %v", err)
 		response.WriteJSON(w, err)
 		return
 	}
 
-	var buf bytes.Buffer
-	err = t.Execute(&buf, rsp)
+	writeTemplate(w, t, rsp, logger)
+}
+
+// readJSONResponse is the result of a read for API clients
+type readJSONResponse struct {
+	Events    []*domain.FormattedEvent `json:"events"`
+	Total     int                      `json:"total"`
+	LastUUID  string                   `json:"last_uuid"`
+	Truncated bool                     `json:"truncated"`
+}
+
+// HandleReadJSON returns the same events as HandleRead as plain JSON data,
+// for clients such as a CLI that render the events themselves. Total is the
+// number of matching events, which is more than the number returned if the
+// results are paginated. LastUUID can be given as since_uuid to a WebSocket.
+func (h *ReadHandler) HandleReadJSON(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+	options := r.Context().Value("options").(*renderOptions)
+
+	paginated := h.prepareRead(query, options)
+
+	result, err := h.LogRepository.FindWithMeta(r.Context(), query)
 	if err != nil {
-		slog.Error("Failed to execute template: %v", err)
+		if isCancelled(err) {
+			logger.Debug("Request cancelled: %v", err)
+			return
+		}
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to find events: %v", err)
 		response.WriteJSON(w, err)
 		return
 	}
 
-	response.Write(w, buf)
+	events := result.Events
+	if result.Truncated {
+		logger.Warn("Results truncated at %d events", len(events))
+	}
+
+	rsp := &readJSONResponse{
+		Events:    make([]*domain.FormattedEvent, len(events)),
+		Total:     len(events),
+		LastUUID:  newestUUID(events, query),
+		Truncated: result.Truncated,
+	}
+	if paginated {
+		rsp.Total = result.Total
+	}
+
+	options.sortEvents(events)
+	options.localise(events)
+
+	for i, event := range events {
+		rsp.Events[i] = event.Format()
+	}
+
+	response.WriteJSON(w, rsp)
+}
+
+// prepareRead applies the defaults that every view of the events shares.
+// It returns whether the results are paginated, in which case the query
+// also counts the total number of matching events.
+func (h *ReadHandler) prepareRead(query *repository.LogQuery, options *renderOptions) bool {
+	// A trace reads best as a sequence so show it oldest first
+	if query.TraceID != "" && options.Order == "" {
+		options.Order = orderAsc
+	}
+
+	h.setDefaultTimeWindow(query)
+	metrics.Reads.Inc()
+
+	// The total is needed to show where the page is in the results
+	paginated := query.Limit > 0 && query.Tail == 0
+	query.CountTotal = paginated
+	return paginated
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(_ *http.Request) bool {
-		return true
-	},
+// newestUUID returns the UUID of the newest of the events, as returned by
+// the query. This is the cursor for new events, regardless of display order.
+func newestUUID(events []*domain.Event, query *repository.LogQuery) string {
+	if len(events) == 0 {
+		return ""
+	}
+	if query.Reverse {
+		return events[0].UUID
+	}
+	return events[len(events)-1].UUID
 }
 
-func (h *ReadHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+// streamRead writes each event that matches the query to the response
+// with the encoder as soon as it is found, in the order requested
+func (h *ReadHandler) streamRead(w http.ResponseWriter, r *http.Request, enc eventEncoder) {
 	query := r.Context().Value("query").(*repository.LogQuery)
 	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+	options := r.Context().Value("options").(*renderOptions)
+
+	q := *query
+	q.Reverse = options.newestFirst(query)
+
+	err := h.LogRepository.FindStream(r.Context(), &q, func(event *domain.Event) error {
+		options.localise([]*domain.Event{event})
+		return enc.encode(event)
+	})
+	if err == nil {
+		err = enc.close()
+	}
 
-	// Upgrade the request to a WebSocket connection
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		slog.Error("Failed to create websocket upgrader: %v", err, metadata)
-		return
+	switch {
+	case err == nil:
+	case isCancelled(err):
+		logger.Debug("Request cancelled: %v", err)
+	case enc.started():
+		// The status has been sent so the error can only be logged
+		logger.Error("Failed to stream events: %v", err)
+	default:
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to find events: %v", err)
+		response.WriteJSON(w, err)
 	}
-	defer ws.Close()
+}
 
-	// A loop must be started that reads and discards messages until a non-nil
-	// error is received so that close, ping and pong messages are processed.
-	// Close a channel to signal to the for loop below that the client has gone away.
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		readLoop(ws)
-	}()
+// writeTemplate executes the template straight into the response rather than
+// buffering the whole page, which can be large. The status code and headers have
+// been sent by the time a template error occurs so the error can only be logged.
+func writeTemplate(w http.ResponseWriter, t *template.Template, rsp *readResponse, logger *slog.FieldLogger) {
+	w.Header().Set("Content-Type", contentTypeHTML+"; charset=utf-8")
 
-	// Subscribe to new events that match the query in the request
-	events := make(chan *domain.Event, 50)
-	err = h.Watcher.Subscribe(events, query)
-	if err != nil {
-		slog.Error("Failed to subscribe to the watcher: %v", err, metadata)
+	bw := bufio.NewWriter(w)
+	if err := t.Execute(bw, rsp); err != nil {
+		logger.Error("Failed to execute template: %v", err)
 		return
 	}
-	defer func() {
-		h.Watcher.Unsubscribe(events)
-	}()
 
-	for {
-		select {
-		case event, ok := <-events:
-			if !ok {
-				slog.Error("Events channel unexpectedly closed")
-				return
-			}
+	if err := bw.Flush(); err != nil {
+		logger.Error("Failed to write response: %v", err)
+	}
+}
 
-			formattedEvent := event.Format()
-			b, err := json.Marshal(formattedEvent)
-			if err != nil {
-				slog.Error("Failed to marshal event: %v", err, metadata)
-				continue
-			}
+type countResponse struct {
+	Total      int            `json:"total"`
+	Truncated  bool           `json:"truncated"`
+	BySeverity map[string]int `json:"by_severity"`
+	ByService  map[string]int `json:"by_service"`
+}
 
-			if err := ws.WriteMessage(websocket.TextMessage, b); err != nil {
-				slog.Error("Failed to write message to websocket: %v", err, metadata)
-				return
-			}
-		case <-done:
-			// The WebSocket is closed so silently return
+// HandleCount returns the number of events that match the
+// query, broken down by severity and service, without the events
+func (h *ReadHandler) HandleCount(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+
+	h.setDefaultTimeWindow(query)
+
+	// Count every matching event, not just a single page
+	query.Limit = 0
+	query.Offset = 0
+	query.Tail = 0
+
+	result, err := h.LogRepository.FindWithMeta(r.Context(), query)
+	if err != nil {
+		if isCancelled(err) {
+			logger.Debug("Request cancelled: %v", err)
 			return
 		}
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to find events: %v", err)
+		response.WriteJSON(w, err)
+		return
+	}
+
+	events := result.Events
+	rsp := &countResponse{
+		Total:      len(events),
+		Truncated:  result.Truncated,
+		BySeverity: map[string]int{},
+		ByService:  map[string]int{},
+	}
+
+	for _, event := range events {
+		rsp.BySeverity[strings.ToLower(event.Severity.String())]++
+		rsp.ByService[event.Service]++
 	}
+
+	response.WriteJSON(w, rsp)
 }
 
-func parseQuery(body *readRequest) (*repository.LogQuery, error) {
-	var services []string
-	if body.Services != "" {
-		services = strings.Split(strings.Replace(body.Services, " ", "", -1), ",")
+// parseTimezone loads the location with the given IANA name, e.g.
+// "Europe/London". UTC is returned if the name is empty.
+func parseTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
 	}
 
-	severity := slog.Severity(body.Severity)
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.BadRequest("unknown timezone %q", name)
+	}
+
+	return location, nil
+}
+
+// parseQuery converts the request into a query. Times in the
+// request are interpreted as being in the given location.
+func parseQuery(body *readRequest, location *time.Location) (*repository.LogQuery, error) {
+	services := parseServices(body.Services)
+	excludeServices := parseServices(body.ExcludeServices)
 
 	var err error
+
+	severity := slog.Severity(body.Severity)
+	if body.SeverityName != "" {
+		severity, err = slog.ParseSeverity(body.SeverityName)
+		if err != nil {
+			return nil, errors.BadRequest("invalid severity_name: %v", err)
+		}
+	}
+
+	var messageRegexp *regexp.Regexp
 	var sinceTime, untilTime time.Time
 
+	if body.MessagePattern != "" {
+		messageRegexp, err = regexp.Compile(body.MessagePattern)
+		if err != nil {
+			return nil, errors.BadRequest("invalid message_pattern: %v", err)
+		}
+	}
+
+	fields, err := parseFields(body.Fields)
+	if err != nil {
+		return nil, err
+	}
+
 	if body.SinceTime != "" {
-		sinceTime, err = time.Parse(htmlTimeFormat, body.SinceTime)
+		sinceTime, err = parseHTMLTime(body.SinceTime, location)
 		if err != nil {
-			return nil, errors.Wrap(err, nil)
+			return nil, errors.BadRequest("invalid since_time: %v", err)
 		}
 	}
 
 	if body.UntilTime != "" {
-		untilTime, err = time.Parse(htmlTimeFormat, body.UntilTime)
+		untilTime, err = parseHTMLTime(body.UntilTime, location)
 		if err != nil {
-			return nil, errors.Wrap(err, nil)
+			return nil, errors.BadRequest("invalid until_time: %v", err)
+		}
+	}
+
+	// Relative times are only used if the absolute time is not set
+	if body.Since != "" {
+		if sinceTime.IsZero() {
+			sinceTime, err = parseRelativeTime(body.Since)
+			if err != nil {
+				return nil, errors.BadRequest("invalid since: %v", err)
+			}
+		} else {
+			slog.Warn("Both since_time and since were given, using since_time")
+		}
+	}
+
+	if body.Until != "" {
+		if untilTime.IsZero() {
+			untilTime, err = parseRelativeTime(body.Until)
+			if err != nil {
+				return nil, errors.BadRequest("invalid until: %v", err)
+			}
+		} else {
+			slog.Warn("Both until_time and until were given, using until_time")
 		}
 	}
 
+	// The absolute and relative times can be mixed, e.g. since_time with
+	// until, so the window is checked again now that both ends are known
+	if err := checkWindow(sinceTime, untilTime); err != nil {
+		return nil, err
+	}
+
 	return &repository.LogQuery{
-		Services:  services,
-		Severity:  severity,
-		SinceTime: sinceTime,
-		UntilTime: untilTime,
-		SinceUUID: body.SinceUUID,
-		Reverse:   body.Reverse,
+		Services:           services,
+		ExcludeServices:    excludeServices,
+		Severity:           severity,
+		MinSeverity:        slog.Severity(body.MinSeverity),
+		MaxSeverity:        slog.Severity(body.MaxSeverity),
+		Message:            body.Message,
+		MessagePattern:     body.MessagePattern,
+		MessageRegexp:      messageRegexp,
+		MessagePrefix:      body.MessagePrefix,
+		TraceID:            strings.TrimSpace(body.TraceID),
+		SourceFile:         strings.TrimSpace(body.SourceFile),
+		Fields:             fields,
+		SinceTime:          sinceTime,
+		UntilTime:          untilTime,
+		SinceUUID:          body.SinceUUID,
+		UntilUUID:          body.UntilUUID,
+		SinceUUIDInclusive: body.IncludeSince,
+		IncludeUntil:       body.IncludeUntil,
+		Reverse:            body.Reverse,
+		Dedupe:             body.Dedupe,
+		Limit:              body.Limit,
+		Offset:             body.Offset,
+		Tail:               body.Tail,
 	}, nil
 }
 
-func readLoop(c *websocket.Conn) {
-	for {
-		if _, _, err := c.NextReader(); err != nil {
-			c.Close()
-			break
+func (h *ReadHandler) maxMessageLength() int {
+	if h.MaxMessageLength > 0 {
+		return h.MaxMessageLength
+	}
+	return defaultMaxMessageLength
+}
+
+func (h *ReadHandler) defaultWindow() time.Duration {
+	window := h.DefaultWindow
+	if s := h.Live.Load(); s != nil {
+		window = s.DefaultWindow
+	}
+
+	if window > 0 {
+		return window
+	}
+	return defaultWindow
+}
+
+// allowedOrigins returns the allowed origins. Connections that
+// are already open are not affected when they are reloaded.
+func (h *ReadHandler) allowedOrigins() []string {
+	if s := h.Live.Load(); s != nil {
+		return s.AllowedOrigins
+	}
+	return h.AllowedOrigins
+}
+
+// getTemplate returns the parsed index template. The template is only parsed
+// on the first call unless ReloadTemplates is set. If parsing fails, it will
+// be tried again on the next call.
+func (h *ReadHandler) getTemplate() (*template.Template, error) {
+	h.templateMux.Lock()
+	defer h.templateMux.Unlock()
+
+	if h.template != nil && !h.ReloadTemplates {
+		return h.template, nil
+	}
+
+	t, err := template.ParseFiles(path.Join(h.TemplateDirectory, "index.html"))
+	if err != nil {
+		return nil, errors.Wrap(err, nil)
+	}
+
+	h.template = t
+	return t, nil
+}
+
+// setDefaultTimeWindow defaults the query to logs from the default window
+func (h *ReadHandler) setDefaultTimeWindow(query *repository.LogQuery) {
+	if query.SinceTime.IsZero() {
+		query.SinceTime = time.Now().Add(-h.defaultWindow())
+	}
+	if query.UntilTime.IsZero() {
+		query.UntilTime = time.Now()
+	}
+}
+
+// checkWindow returns a bad request error if until is before since.
+// A zero time is an open end of the window so is not checked.
+func checkWindow(since, until time.Time) error {
+	if since.IsZero() || until.IsZero() || !until.Before(since) {
+		return nil
+	}
+
+	err := errors.BadRequest(invertedWindowMessage)
+	err.Metadata = map[string]string{
+		"sinceTime": since.Format(time.RFC3339),
+		"untilTime": until.Format(time.RFC3339),
+	}
+	return err
+}
+
+// parseHTMLTime parses a since_time or until_time in the location, or at its
+// own offset if it is in RFC 3339 format
+func parseHTMLTime(s string, location *time.Location) (time.Time, error) {
+	t, err := parseTime(s, timeFormats, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not in the format 2006-01-02T15:04, 2006-01-02T15:04:05 or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// parseTime parses the time using the first of the layouts that succeeds
+func parseTime(s string, layouts []string, location *time.Location) (t time.Time, err error) {
+	for _, layout := range layouts {
+		if t, err = time.ParseInLocation(layout, s, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// parseRelativeTime returns the time that is the duration before now
+func parseRelativeTime(s string) (time.Time, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if d < 0 {
+		return time.Time{}, fmt.Errorf("duration %s must not be negative", s)
+	}
+
+	return time.Now().Add(-d), nil
+}
+
+// isCancelled returns whether err was caused by the request being
+// cancelled, in which case there is no client to write a response to
+func isCancelled(err error) bool {
+	e, ok := err.(*errors.Error)
+	return ok && e.Code == repository.ErrCancelled
+}
+
+// parseServices splits a comma-separated list of service names. Each
+// name is trimmed so that spaces within a name are kept, and empty
+// names are dropped.
+func parseServices(s string) []string {
+	var services []string
+	for _, service := range strings.Split(s, ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// parseFields parses a comma-separated list of field conditions,
+// e.g. "status=failed, duration_ms>500"
+func parseFields(s string) ([]repository.FieldFilter, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var fields []repository.FieldFilter
+	for _, condition := range strings.Split(s, ",") {
+		f, err := repository.ParseFieldFilter(condition)
+		if err != nil {
+			return nil, err
 		}
+
+		fields = append(fields, f)
 	}
+
+	return fields, nil
+}
+
+// formatFields is the inverse of parseFields
+func formatFields(fields []repository.FieldFilter) string {
+	conditions := make([]string, 0, len(fields))
+	for _, f := range fields {
+		conditions = append(conditions, f.String())
+	}
+
+	sort.Strings(conditions)
+	return strings.Join(conditions, ", ")
 }
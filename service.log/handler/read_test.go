@@ -0,0 +1,292 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/request"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+	"github.com/jakewright/home-automation/service.log/watch"
+
+	"gotest.tools/assert"
+)
+
+func benchmarkGetTemplate(b *testing.B, reload bool) {
+	h := &ReadHandler{
+		TemplateDirectory: "../templates",
+		ReloadTemplates:   reload,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.getTemplate(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetTemplateCached(b *testing.B) { benchmarkGetTemplate(b, false) }
+func BenchmarkGetTemplateReload(b *testing.B) { benchmarkGetTemplate(b, true) }
+
+// discardResponseWriter is a ResponseWriter that throws away the body,
+// so that benchmarks only measure memory used while rendering
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+func benchmarkRender(b *testing.B, buffered bool) {
+	h := &ReadHandler{TemplateDirectory: "../templates"}
+	t, err := h.getTemplate()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rsp := &readResponse{}
+	for i := 0; i < 50000; i++ {
+		event := &domain.Event{
+			UUID:      strconv.Itoa(i),
+			Timestamp: time.Now(),
+			Service:   "service.foo",
+			Severity:  slog.InfoSeverity,
+			Message:   "Something happened",
+		}
+		rsp.FormattedEvents = append(rsp.FormattedEvents, event.Format())
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := &discardResponseWriter{header: http.Header{}}
+		if !buffered {
+			writeTemplate(w, t, rsp, slog.With(nil))
+			continue
+		}
+
+		// The previous implementation, for comparison
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, rsp); err != nil {
+			b.Fatal(err)
+		}
+		response.Write(w, buf)
+	}
+}
+
+func BenchmarkRenderBuffered(b *testing.B)  { benchmarkRender(b, true) }
+func BenchmarkRenderStreaming(b *testing.B) { benchmarkRender(b, false) }
+
+func TestHandleReadJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	var lines []string
+	for i, service := range []string{"service.foo", "service.bar", "service.foo", "service.foo"} {
+		lines = append(lines, fmt.Sprintf(
+			`{"uuid":"%d","@timestamp":%q,"service":%q,"severity":"info","message":"hello"}`,
+			i+1, time.Now().UTC().Format(time.RFC3339), service,
+		))
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	h := &ReadHandler{LogRepository: repository.NewLogRepository(dir)}
+	r := httptest.NewRequest(http.MethodGet, "/events?services=service.foo&limit=2&reverse=true", nil)
+	w := httptest.NewRecorder()
+	h.DecodeBody(w, r, h.HandleReadJSON)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	var rsp struct {
+		Data struct {
+			Events []struct {
+				UUID          string
+				SeverityNames slog.SeverityNames
+			} `json:"events"`
+			Total    int    `json:"total"`
+			LastUUID string `json:"last_uuid"`
+		} `json:"data"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+
+	assert.Equal(t, len(rsp.Data.Events), 2)
+	assert.Equal(t, rsp.Data.Events[0].UUID, "4")
+	assert.Equal(t, rsp.Data.Events[1].UUID, "3")
+	assert.Equal(t, rsp.Data.Events[0].SeverityNames, slog.InfoSeverity.Names())
+	assert.Equal(t, rsp.Data.Total, 3)
+	assert.Equal(t, rsp.Data.LastUUID, "4")
+}
+
+func TestParseQueryTimezone(t *testing.T) {
+	location, err := parseTimezone("America/New_York")
+	assert.NilError(t, err)
+
+	q, err := parseQuery(&readRequest{SinceTime: "2019-01-01T09:00"}, location)
+	assert.NilError(t, err)
+	assert.Equal(t, q.SinceTime.UTC(), time.Date(2019, 1, 1, 14, 0, 0, 0, time.UTC))
+
+	// UTC is the default
+	location, err = parseTimezone("")
+	assert.NilError(t, err)
+	assert.Equal(t, location, time.UTC)
+
+	_, err = parseTimezone("Not/AZone")
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+}
+
+func TestParseQueryTimeFormats(t *testing.T) {
+	location, err := parseTimezone("America/New_York")
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Time
+	}{
+		{"minutes", "2019-01-01T09:00", time.Date(2019, 1, 1, 14, 0, 0, 0, time.UTC)},
+		{"seconds", "2019-01-01T09:00:30", time.Date(2019, 1, 1, 14, 0, 30, 0, time.UTC)},
+		{"fractional seconds", "2019-01-01T09:00:30.5", time.Date(2019, 1, 1, 14, 0, 30, 500000000, time.UTC)},
+		{"RFC 3339", "2019-01-01T09:00:30Z", time.Date(2019, 1, 1, 9, 0, 30, 0, time.UTC)},
+		{"RFC 3339 with offset", "2019-01-01T09:00:30+01:00", time.Date(2019, 1, 1, 8, 0, 30, 0, time.UTC)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := parseQuery(&readRequest{SinceTime: tc.value, UntilTime: tc.value}, location)
+			assert.NilError(t, err)
+			assert.Equal(t, q.SinceTime.UTC(), tc.want)
+			assert.Equal(t, q.UntilTime.UTC(), tc.want)
+		})
+	}
+
+	_, err = parseQuery(&readRequest{SinceTime: "01/01/2019 09:00"}, location)
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+	assert.ErrorContains(t, err, "invalid since_time")
+}
+
+func TestParseQueryRelativeTime(t *testing.T) {
+	before := time.Now()
+	q, err := parseQuery(&readRequest{Since: "15m", Until: "5m"}, time.UTC)
+	assert.NilError(t, err)
+	assert.Assert(t, !q.SinceTime.Before(before.Add(-15*time.Minute)))
+	assert.Assert(t, !q.UntilTime.After(time.Now().Add(-5*time.Minute)))
+
+	// Absolute times take precedence
+	q, err = parseQuery(&readRequest{Since: "15m", SinceTime: "2019-01-01T09:00"}, time.UTC)
+	assert.NilError(t, err)
+	assert.Equal(t, q.SinceTime, time.Date(2019, 1, 1, 9, 0, 0, 0, time.UTC))
+
+	_, err = parseQuery(&readRequest{Since: "-15m"}, time.UTC)
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+
+	_, err = parseQuery(&readRequest{Until: "yesterday"}, time.UTC)
+	assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+}
+
+func TestParseQueryInvertedWindow(t *testing.T) {
+	tests := []struct {
+		name string
+		body *readRequest
+	}{
+		{"since_time after until", &readRequest{SinceTime: time.Now().Add(time.Hour).Format(htmlTimeFormat), Until: "5m"}},
+		{"since after until_time", &readRequest{Since: "1h", UntilTime: "2019-01-01T09:00"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseQuery(tc.body, time.UTC)
+			assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+			assert.ErrorContains(t, err, "until_time must not be before since_time")
+		})
+	}
+
+	// A window that is not inverted is fine
+	_, err := parseQuery(&readRequest{SinceTime: "2019-01-01T09:00", Until: "5m"}, time.UTC)
+	assert.NilError(t, err)
+
+	// The error is returned to the client as a bad request
+	h := &ReadHandler{}
+	r := httptest.NewRequest(http.MethodGet, "/?since=1h&until_time=2019-01-01T09:00", nil)
+	w := httptest.NewRecorder()
+	h.DecodeBody(w, r, func(http.ResponseWriter, *http.Request) {
+		t.Error("next handler was called")
+	})
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
+
+func TestSetDefaultTimeWindow(t *testing.T) {
+	h := &ReadHandler{DefaultWindow: 24 * time.Hour}
+
+	before := time.Now()
+	q := &repository.LogQuery{}
+	h.setDefaultTimeWindow(q)
+	assert.Assert(t, !q.SinceTime.Before(before.Add(-24*time.Hour)))
+	assert.Assert(t, q.SinceTime.Before(before.Add(-23*time.Hour)))
+	assert.Assert(t, !q.UntilTime.Before(before))
+
+	// The default is not applied if the request gives a since time
+	since := time.Date(2019, 1, 1, 9, 0, 0, 0, time.UTC)
+	q = &repository.LogQuery{SinceTime: since}
+	h.setDefaultTimeWindow(q)
+	assert.Equal(t, q.SinceTime, since)
+
+	// One hour is the default
+	h = &ReadHandler{}
+	q = &repository.LogQuery{}
+	h.setDefaultTimeWindow(q)
+	assert.Assert(t, q.SinceTime.After(before.Add(-61*time.Minute)))
+	assert.Assert(t, !q.SinceTime.After(time.Now().Add(-time.Hour)))
+}
+
+func TestParseServices(t *testing.T) {
+	assert.Assert(t, parseServices("") == nil)
+	assert.DeepEqual(t, parseServices(" TV,  hue "), []string{"TV", "hue"})
+	assert.DeepEqual(t, parseServices("living room,,kitchen"), []string{"living room", "kitchen"})
+}
+
+func TestReadRequestValidate(t *testing.T) {
+	assert.NilError(t, request.Validate(&readRequest{Severity: 3, SinceTime: "2019-01-01T09:00", UntilTime: "2019-01-01T10:00"}))
+
+	tests := []struct {
+		name string
+		body *readRequest
+	}{
+		{"unknown severity", &readRequest{Severity: 40}},
+		{"unknown max severity", &readRequest{MaxSeverity: 1}},
+		{"negative limit", &readRequest{Limit: -1}},
+		{"negative offset", &readRequest{Offset: -1}},
+		{"buffer too large", &readRequest{Buffer: watch.MaxBufferSize + 1}},
+		{"inverted window", &readRequest{SinceTime: "2019-01-01T10:00", UntilTime: "2019-01-01T09:00"}},
+		{"inverted window with seconds", &readRequest{SinceTime: "2019-01-01T09:00:30", UntilTime: "2019-01-01T09:00"}},
+		{"inverted relative window", &readRequest{Since: "5m", Until: "15m"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := request.Validate(tc.body)
+			assert.Equal(t, err.(*errors.Error).Code, errors.ErrBadRequest)
+		})
+	}
+
+	// Custom levels are known once they are named
+	slog.SetSeverityNames(map[slog.Severity]string{40: "critical"})
+	defer slog.SetSeverityNames(nil)
+	assert.NilError(t, request.Validate(&readRequest{Severity: 40, MaxSeverity: 40}))
+}
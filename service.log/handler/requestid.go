@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID that is accepted from a client
+const maxRequestIDLength = 128
+
+// requestID returns the ID that the client gave the request in the
+// X-Request-ID header or, if it did not give a usable one, a new random ID.
+// Clients' IDs end up in the logs so they are limited to printable ASCII.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// The ID is only for debugging so it is not worth failing the request
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
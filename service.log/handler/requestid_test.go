@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDecodeBodyRequestID(t *testing.T) {
+	h := &ReadHandler{}
+
+	decode := func(id string) (string, map[string]string) {
+		r := httptest.NewRequest(http.MethodGet, "/events", nil)
+		if id != "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+
+		var metadata map[string]string
+		w := httptest.NewRecorder()
+		h.DecodeBody(w, r, func(w http.ResponseWriter, r *http.Request) {
+			metadata = r.Context().Value("metadata").(map[string]string)
+			assert.Equal(t, r.Context().Value("requestID"), metadata["requestID"])
+		})
+		return w.Header().Get(requestIDHeader), metadata
+	}
+
+	// The client's ID is used if it gives one
+	got, metadata := decode("abc-123")
+	assert.Equal(t, got, "abc-123")
+	assert.Equal(t, metadata["requestID"], "abc-123")
+
+	// Otherwise a new ID is made for each request
+	first, metadata := decode("")
+	assert.Equal(t, len(first), 32)
+	assert.Equal(t, metadata["requestID"], first)
+	second, _ := decode("")
+	assert.Assert(t, first != second)
+
+	// IDs that could garble the logs are replaced
+	for _, id := range []string{"a b", "a\nb", strings.Repeat("a", maxRequestIDLength+1)} {
+		got, _ := decode(id)
+		assert.Assert(t, got != id)
+		assert.Equal(t, len(got), 32)
+	}
+}
+
+func TestDecodeBodyRequestIDInvalidRequest(t *testing.T) {
+	h := &ReadHandler{}
+	r := httptest.NewRequest(http.MethodGet, "/events?limit=-1", nil)
+	r.Header.Set(requestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	h.DecodeBody(w, r, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("Invalid request was not rejected")
+	})
+
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+	assert.Equal(t, w.Header().Get(requestIDHeader), "abc-123")
+}
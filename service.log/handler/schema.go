@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+)
+
+// readRequestDescriptions describe each of the readRequest fields by their
+// JSON name. The schema is built from the struct itself so every field
+// must be described here for it to be useful to clients.
+var readRequestDescriptions = map[string]string{
+	"services":         "Comma-separated services to include. A * matches any characters.",
+	"exclude_services": "Comma-separated services to exclude. A * matches any characters.",
+	"severity":         "Minimum severity level.",
+	"severity_name":    "Minimum severity by name, e.g. \"warning\", as an alternative to severity.",
+	"min_severity":     "Minimum severity level, the same as severity.",
+	"max_severity":     "Maximum severity level.",
+	"message":          "Text that the message must contain.",
+	"message_pattern":  "Regular expression that the message must match.",
+	"message_prefix":   "Text that the message must start with, case-sensitive, e.g. \"[HTTP]\".",
+	"trace_id":         "Only include events with this trace ID.",
+	"source_file":      "Only include events read from the log file with this path or name, e.g. \"tv.log\".",
+	"fields":           "Comma-separated conditions on metadata fields, e.g. \"status=failed, duration_ms>500\".",
+	"since_time":       "Start of the time window, formatted as 2006-01-02T15:04 or 2006-01-02T15:04:05 in the timezone, or as RFC 3339.",
+	"until_time":       "End of the time window, formatted as 2006-01-02T15:04 or 2006-01-02T15:04:05 in the timezone, or as RFC 3339.",
+	"since":            "Start of the time window as a duration before now, e.g. \"15m\". Ignored if since_time is set.",
+	"until":            "End of the time window as a duration before now, e.g. \"5m\". Ignored if until_time is set.",
+	"since_uuid":       "Only include events after the event with this UUID.",
+	"until_uuid":       "Only include events before the event with this UUID.",
+	"include_since":    "Include the since_uuid event itself.",
+	"include_until":    "Include the until_uuid event itself.",
+	"reverse":          "Return the newest events first.",
+	"dedupe":           "Collapse consecutive repeats of the same event into one.",
+	"limit":            "Maximum number of events to return. The results are paginated if set.",
+	"offset":           "Number of matching events to skip, for pagination.",
+	"tail":             "Return only this many of the newest matching events.",
+	"backlog":          "Number of recent events to send to a streaming client before any new events.",
+	"buffer":           "Number of events a streaming client's subscription can hold. Larger buffers drop fewer events in bursts.",
+	"compact":          "Write NDJSON and streamed events as [uuid, timestamp, severity, service, message] arrays to reduce their size. The HTML view is unaffected.",
+	"format":           "Output format, which takes precedence over the Accept header.",
+	"time_format":      "Go time layout or named format for timestamps in plaintext output.",
+	"bucket":           "Width of each histogram bucket as a duration, e.g. \"5m\".",
+	"facets":           "Comma-separated metadata fields to count the values of.",
+	"columns":          "Comma-separated metadata fields to show as columns in the HTML view.",
+	"order":            "Order of the events, overriding reverse.",
+	"timezone":         "IANA time zone that times are given and shown in. Defaults to UTC.",
+	"search":           "Boolean search for /search, e.g. {\"and\": [{\"service\": \"service.tv\"}, {\"or\": [{\"field\": \"status\", \"eq\": 500}, {\"severity_gte\": \"error\"}]}]}.",
+}
+
+// schemaField describes a parameter of the read endpoints
+type schemaField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+
+	// Rules are the validation rules from the field's validate tag, e.g. "min=0"
+	Rules string `json:"rules,omitempty"`
+}
+
+// querySchema describes the parameters that the read endpoints accept
+type querySchema struct {
+	Fields      []*schemaField       `json:"fields"`
+	Severities  []slog.SeverityNames `json:"severities"`
+	Formats     []string             `json:"formats"`
+	MediaTypes  []string             `json:"media_types"`
+	Orders      []string             `json:"orders"`
+	TimeFormats []string             `json:"time_formats"`
+}
+
+// HandleSchema describes the query parameters of the read endpoints, along
+// with the values that some of them accept, so that clients can build forms
+// and validate requests before sending them
+func HandleSchema(w http.ResponseWriter, r *http.Request) {
+	response.WriteJSON(w, buildSchema())
+}
+
+// buildSchema returns the schema of readRequest
+func buildSchema() *querySchema {
+	schema := &querySchema{
+		Fields:     schemaFields(reflect.TypeOf(readRequest{})),
+		Formats:    []string{formatCSV},
+		MediaTypes: []string{contentTypeHTML, contentTypeText, contentTypeNDJSON},
+		Orders:     []string{orderAsc, orderDesc},
+	}
+
+	for _, s := range []slog.Severity{slog.DebugSeverity, slog.InfoSeverity, slog.WarnSeverity, slog.ErrorSeverity} {
+		schema.Severities = append(schema.Severities, s.Names())
+	}
+
+	for name := range namedTimeFormats {
+		schema.TimeFormats = append(schema.TimeFormats, name)
+	}
+	sort.Strings(schema.TimeFormats)
+
+	return schema
+}
+
+// schemaFields describes the JSON fields of the struct type in order
+func schemaFields(t reflect.Type) []*schemaField {
+	var fields []*schemaField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		fields = append(fields, &schemaField{
+			Name:        name,
+			Type:        schemaType(field.Type.Kind()),
+			Description: readRequestDescriptions[name],
+			Rules:       field.Tag.Get("validate"),
+		})
+	}
+	return fields
+}
+
+// schemaType returns the JSON Schema name of the kind
+func schemaType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct, reflect.Interface:
+		return "object"
+	}
+	return "string"
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/jakewright/home-automation/libraries/go/slog"
+
+	"gotest.tools/assert"
+)
+
+func TestSchemaDescribesEveryField(t *testing.T) {
+	schema := buildSchema()
+	assert.Equal(t, len(schema.Fields), reflect.TypeOf(readRequest{}).NumField())
+
+	for _, field := range schema.Fields {
+		assert.Assert(t, field.Description != "", field.Name)
+	}
+
+	// Every description is for a field that exists
+	assert.Equal(t, len(readRequestDescriptions), len(schema.Fields))
+}
+
+func TestHandleSchema(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/schema", nil)
+	w := httptest.NewRecorder()
+	HandleSchema(w, r)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	var rsp struct {
+		Data struct {
+			Fields     []*schemaField       `json:"fields"`
+			Severities []slog.SeverityNames `json:"severities"`
+			Formats    []string             `json:"formats"`
+		} `json:"data"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+
+	fields := map[string]*schemaField{}
+	for _, field := range rsp.Data.Fields {
+		fields[field.Name] = field
+	}
+	assert.DeepEqual(t, fields["limit"], &schemaField{
+		Name:        "limit",
+		Type:        "integer",
+		Description: readRequestDescriptions["limit"],
+		Rules:       "min=0",
+	})
+	assert.Equal(t, fields["reverse"].Type, "boolean")
+	assert.Equal(t, fields["since_time"].Type, "string")
+
+	assert.Equal(t, len(rsp.Data.Severities), 4)
+	assert.Equal(t, rsp.Data.Severities[3], slog.ErrorSeverity.Names())
+	assert.DeepEqual(t, rsp.Data.Formats, []string{formatCSV})
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/metrics"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+// HandleSearch streams the events that match both the query and its search,
+// a boolean combination of conditions (see repository.Search). Events are
+// written as NDJSON, or as CSV if requested, in one pass over the log files
+// so that searches over long time windows do not hold every event in memory.
+// Searches are not paginated.
+func (h *ReadHandler) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+	options := r.Context().Value("options").(*renderOptions)
+	search := r.Context().Value("search").(*repository.Search)
+
+	if search == nil {
+		response.WriteJSON(w, errors.BadRequest("search must not be empty"))
+		return
+	}
+
+	if query.Limit > 0 || query.Offset > 0 || query.Tail > 0 {
+		response.WriteJSON(w, errors.BadRequest("limit, offset and tail are not supported by searches"))
+		return
+	}
+
+	match, err := search.Predicate()
+	if err != nil {
+		response.WriteJSON(w, err)
+		return
+	}
+
+	h.setDefaultTimeWindow(query)
+	metrics.Reads.Inc()
+
+	enc := newEventEncoder(w, r, options)
+	if enc == nil {
+		enc = &ndjsonEncoder{w: w, options: options}
+	}
+
+	q := *query
+	q.Reverse = options.newestFirst(query)
+
+	err = h.LogRepository.FindStream(r.Context(), &q, func(event *domain.Event) error {
+		if !match(event) {
+			return nil
+		}
+		options.localise([]*domain.Event{event})
+		return enc.encode(event)
+	})
+	if err == nil {
+		err = enc.close()
+	}
+
+	switch {
+	case err == nil:
+	case isCancelled(err):
+		logger.Debug("Request cancelled: %v", err)
+	case enc.started():
+		// The status has been sent so the error can only be logged
+		logger.Error("Failed to stream search results: %v", err)
+	default:
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to search events: %v", err)
+		response.WriteJSON(w, err)
+	}
+}
+
+// parseSearch returns the search in the request, or nil if there is none.
+// It is an object in a JSON body or a string of JSON in the URL.
+func parseSearch(v interface{}) (*repository.Search, error) {
+	var data []byte
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		data = []byte(v)
+	default:
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return nil, errors.Wrap(err, nil)
+		}
+	}
+
+	return repository.ParseSearch(data)
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+
+	"gotest.tools/assert"
+)
+
+// newSearchHandler returns a handler that reads a log file of the lines
+func newSearchHandler(t *testing.T, lines ...string) (*ReadHandler, func()) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	return &ReadHandler{LogRepository: repository.NewLogRepository(dir)}, func() { os.RemoveAll(dir) }
+}
+
+// searchUUIDs returns the UUIDs of the events in the NDJSON response
+func searchUUIDs(t *testing.T, w *httptest.ResponseRecorder) []string {
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), contentTypeNDJSON)
+
+	var uuids []string
+	s := bufio.NewScanner(w.Body)
+	for s.Scan() {
+		event := &domain.FormattedEvent{}
+		assert.NilError(t, json.Unmarshal(s.Bytes(), event))
+		uuids = append(uuids, event.UUID)
+	}
+	return uuids
+}
+
+func TestHandleSearch(t *testing.T) {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	event := func(uuid, service, severity, message string) string {
+		return fmt.Sprintf(`{"uuid":%q,"@timestamp":%q,"service":%q,"severity":%q,"message":%q}`, uuid, timestamp, service, severity, message)
+	}
+
+	h, cleanup := newSearchHandler(t,
+		event("1", "service.tv", "info", "status=500"),
+		event("2", "service.tv", "info", "status=200"),
+		event("3", "service.tv", "error", "status=200"),
+		event("4", "service.hue", "error", "status=500"),
+	)
+	defer cleanup()
+
+	search := `{"and": [{"service": "service.tv"}, {"or": [{"field": "status", "eq": 500}, {"severity_gte": "error"}]}]}`
+
+	// The search can be in a JSON body
+	body := fmt.Sprintf(`{"search": %s}`, search)
+	r := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.DecodeBody(w, r, h.HandleSearch)
+	assert.DeepEqual(t, searchUUIDs(t, w), []string{"1", "3"})
+
+	// Or in the URL, combined with the query's own filters
+	r = httptest.NewRequest(http.MethodGet, "/search?severity=6&search="+url.QueryEscape(search), nil)
+	w = httptest.NewRecorder()
+	h.DecodeBody(w, r, h.HandleSearch)
+	assert.DeepEqual(t, searchUUIDs(t, w), []string{"3"})
+}
+
+func TestHandleSearchInvalid(t *testing.T) {
+	h := &ReadHandler{}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing", `{}`},
+		{"unknown key", `{"search": {"servce": "service.tv"}}`},
+		{"no condition", `{"search": {"and": [{}]}}`},
+		{"too deep", `{"search": ` + strings.Repeat(`{"not": `, repository.MaxSearchDepth) + `{"service": "service.tv"}` + strings.Repeat(`}`, repository.MaxSearchDepth+1)},
+		{"paginated", `{"search": {"service": "service.tv"}, "limit": 10}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			h.DecodeBody(w, r, h.HandleSearch)
+			assert.Equal(t, w.Code, http.StatusBadRequest)
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+// servicesCacheTTL is how long a list of services is reused for
+const servicesCacheTTL = 30 * time.Second
+
+// servicesCache holds recent results of LogRepository.DistinctServices
+type servicesCache struct {
+	mux     sync.Mutex
+	entries map[servicesCacheKey]*servicesCacheEntry
+}
+
+// servicesCacheKey is the time window requested by the client. The zero
+// value is used for the default window so that it can still be cached.
+type servicesCacheKey struct {
+	since, until time.Time
+}
+
+type servicesCacheEntry struct {
+	services []string
+	expires  time.Time
+}
+
+func (c *servicesCache) get(key servicesCacheKey) ([]string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	return entry.services, true
+}
+
+func (c *servicesCache) set(key servicesCacheKey, services []string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[servicesCacheKey]*servicesCacheEntry{}
+	}
+
+	// Remove expired entries so the map doesn't grow forever
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = &servicesCacheEntry{
+		services: services,
+		expires:  now.Add(servicesCacheTTL),
+	}
+}
+
+// HandleServices returns the names of all services that have
+// events within the query's time window, sorted alphabetically
+func (h *ReadHandler) HandleServices(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	metadata := r.Context().Value("metadata").(map[string]string)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+
+	// Build the key before the default window is applied
+	key := servicesCacheKey{query.SinceTime, query.UntilTime}
+	if services, ok := h.servicesCache.get(key); ok {
+		response.WriteJSON(w, services)
+		return
+	}
+
+	h.setDefaultTimeWindow(query)
+
+	services, err := h.LogRepository.DistinctServices(r.Context(), query.SinceTime, query.UntilTime)
+	if err != nil {
+		if isCancelled(err) {
+			logger.Debug("Request cancelled: %v", err)
+			return
+		}
+		err = errors.Wrap(err, metadata)
+		logger.Error("Failed to find services: %v", err)
+		response.WriteJSON(w, err)
+		return
+	}
+
+	// Make sure an empty list is encoded as [] rather than null
+	if services == nil {
+		services = []string{}
+	}
+
+	h.servicesCache.set(key, services)
+	response.WriteJSON(w, services)
+}
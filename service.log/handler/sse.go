@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+const contentTypeEventStream = "text/event-stream"
+
+// HandleSSE streams new events to the client using Server-Sent Events. It
+// behaves in the same way as HandleWebSocket for clients that cannot use
+// WebSockets, e.g. because of a proxy.
+func (h *ReadHandler) HandleSSE(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+	options := r.Context().Value("options").(*renderOptions)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		response.WriteJSON(w, errors.InternalService("Streaming is not supported"))
+		return
+	}
+
+	// Pagination only makes sense for the initial page of events.
+	// All new events should be streamed to the client.
+	query.Limit = 0
+	query.Offset = 0
+	query.Tail = 0
+
+	w.Header().Set("Content-Type", contentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event *domain.Event) error {
+		options.localise([]*domain.Event{event})
+		if err := writeSSE(w, "", options.jsonEvent(event)); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	// Catch up from SinceUUID in the same way as HandleWebSocket
+	if query.SinceUUID != "" {
+		if err := h.backfill(r.Context(), query, send); err != nil {
+			logger.Error("Failed to backfill events: %v", err)
+			return
+		}
+	} else if options.Backlog > 0 {
+		if err := h.sendBacklog(r.Context(), query, options.Backlog, send); err != nil {
+			logger.Error("Failed to send backlog: %v", err)
+			return
+		}
+	} else if query.SinceTime.IsZero() {
+		query.SinceTime = time.Now()
+	}
+
+	// Subscribe to new events that match the query in the request
+	events := h.Watcher.NewChannel(options.Buffer)
+	if err := h.Watcher.Subscribe(events, query); err != nil {
+		logger.Error("Failed to subscribe to the watcher: %v", err)
+		return
+	}
+	defer h.Watcher.Unsubscribe(events)
+
+	// Send a comment periodically so that proxies don't close the connection
+	ticker := time.NewTicker(h.pingInterval())
+	defer ticker.Stop()
+
+	heartbeats, stopHeartbeats := h.heartbeats()
+	defer stopHeartbeats()
+	lastSent := time.Now()
+
+	expired, stopExpiry := h.connectionExpiry()
+	defer stopExpiry()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				logger.Error("Events channel unexpectedly closed")
+				return
+			}
+			lastSent = time.Now()
+
+			if err := send(event); err != nil {
+				logger.Error("Failed to write event to stream: %v", err)
+				return
+			}
+
+			// Let the client know if it has missed any events
+			if dropped := h.Watcher.TakeDropped(events); dropped > 0 {
+				gap := &gapMessage{Type: "gap", Dropped: dropped}
+				if err := writeSSE(w, "gap", gap); err != nil {
+					logger.Error("Failed to write gap to stream: %v", err)
+					return
+				}
+				flusher.Flush()
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				logger.Error("Failed to write ping to stream: %v", err)
+				return
+			}
+			flusher.Flush()
+		case now := <-heartbeats:
+			if now.Sub(lastSent) < h.HeartbeatInterval {
+				continue
+			}
+			lastSent = now
+
+			if err := writeSSE(w, "heartbeat", newHeartbeatMessage(now)); err != nil {
+				logger.Error("Failed to write heartbeat to stream: %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-expired:
+			// Browsers reconnect when the stream ends
+			logger.Debug("Ending stream that reached its maximum duration")
+			return
+		case <-h.Watcher.Done():
+			// The service is shutting down so end the stream
+			return
+		case <-r.Context().Done():
+			// The client has gone away so silently return
+			return
+		}
+	}
+}
+
+// writeSSE writes v as JSON in a single Server-Sent Event. If eventType
+// is empty, the client will receive it as a default "message" event.
+func writeSSE(w http.ResponseWriter, eventType string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, nil)
+	}
+
+	if eventType != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", eventType); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err
+}
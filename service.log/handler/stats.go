@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+)
+
+// HandleStats returns a summary of the log files, such as their total size
+// and the time range of their events, to help with sizing the retention period
+func (h *ReadHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.LogRepository.Stats(r.Context())
+	if err != nil {
+		if isCancelled(err) {
+			slog.Debug("Request cancelled: %v", err)
+			return
+		}
+		slog.Error("Failed to get stats: %v", err)
+		response.WriteJSON(w, err)
+		return
+	}
+
+	response.WriteJSON(w, stats)
+}
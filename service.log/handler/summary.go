@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+)
+
+// resultSummary is the number of events that are shown
+// for each service and each severity, e.g. "tv: 120, hue: 45"
+type resultSummary struct {
+	// Label says which events were counted, e.g. "50 events on this page"
+	Label string
+
+	// Services are ordered by count, most first
+	Services []summaryCount
+
+	// Severities are ordered from the most to the least severe
+	Severities []summaryCount
+}
+
+// summaryCount is the number of events with a service or severity
+type summaryCount struct {
+	Name  string
+	Count int
+
+	// Class is the CSS class of a severity, e.g. "sev-error"
+	Class string
+}
+
+// summarise counts the events by service and by severity. Only the events
+// that are shown are counted, so the label says whether they are a page
+// of the results or were truncated.
+func summarise(events []*domain.Event, paginated, truncated bool) *resultSummary {
+	summary := &resultSummary{}
+	switch {
+	case paginated:
+		summary.Label = fmt.Sprintf("%d events on this page", len(events))
+	case truncated:
+		summary.Label = fmt.Sprintf("Newest %d events", len(events))
+	default:
+		summary.Label = fmt.Sprintf("%d events", len(events))
+	}
+
+	services := map[string]int{}
+	severities := map[slog.Severity]int{}
+	for _, event := range events {
+		services[event.Service]++
+		severities[event.Severity]++
+	}
+
+	for name, count := range services {
+		summary.Services = append(summary.Services, summaryCount{Name: name, Count: count})
+	}
+	sort.Slice(summary.Services, func(i, j int) bool {
+		a, b := summary.Services[i], summary.Services[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Name < b.Name
+	})
+
+	var levels []slog.Severity
+	for severity := range severities {
+		levels = append(levels, severity)
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		// UnknownSeverity is the highest value but is not the most severe
+		if levels[i] == slog.UnknownSeverity || levels[j] == slog.UnknownSeverity {
+			return levels[j] == slog.UnknownSeverity && levels[i] != slog.UnknownSeverity
+		}
+		return levels[i] > levels[j]
+	})
+
+	for _, severity := range levels {
+		summary.Severities = append(summary.Severities, summaryCount{
+			Name:  severity.Names().Long,
+			Count: severities[severity],
+			Class: "sev-" + strings.ToLower(severity.String()),
+		})
+	}
+
+	return summary
+}
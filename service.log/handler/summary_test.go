@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+
+	"gotest.tools/assert"
+)
+
+func TestSummarise(t *testing.T) {
+	events := []*domain.Event{
+		{Service: "hue", Severity: slog.InfoSeverity},
+		{Service: "tv", Severity: slog.ErrorSeverity},
+		{Service: "tv", Severity: slog.InfoSeverity},
+		{Service: "tv", Severity: slog.UnknownSeverity},
+		{Service: "hue", Severity: slog.ErrorSeverity},
+		{Service: "tv", Severity: slog.WarnSeverity},
+	}
+
+	summary := summarise(events, true, false)
+	assert.Equal(t, summary.Label, "6 events on this page")
+	assert.DeepEqual(t, summary.Services, []summaryCount{
+		{Name: "tv", Count: 4},
+		{Name: "hue", Count: 2},
+	})
+	assert.DeepEqual(t, summary.Severities, []summaryCount{
+		{Name: "error", Count: 2, Class: "sev-error"},
+		{Name: "warning", Count: 1, Class: "sev-warn"},
+		{Name: "info", Count: 2, Class: "sev-info"},
+		{Name: "unknown", Count: 1, Class: "sev-unknown"},
+	})
+
+	assert.Equal(t, summarise(events, false, true).Label, "Newest 6 events")
+	assert.Equal(t, summarise(nil, false, false).Label, "0 events")
+}
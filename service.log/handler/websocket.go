@@ -0,0 +1,586 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/response"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+	"github.com/jakewright/home-automation/service.log/watch"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultPingInterval is used if ReadHandler.PingInterval is not set
+	defaultPingInterval = 30 * time.Second
+
+	// defaultWriteTimeout is used if ReadHandler.WriteTimeout is not set
+	defaultWriteTimeout = 10 * time.Second
+
+	// writeWait is the time allowed to write a control message to the client
+	writeWait = 10 * time.Second
+
+	// batchFlushInterval is the longest that an event is held
+	// back while a batch is collected during a burst of events
+	batchFlushInterval = 50 * time.Millisecond
+
+	// maxBatchSize is the most events that are sent in one batch
+	maxBatchSize = 100
+)
+
+// localOrigins are the hosts that are allowed if ReadHandler.AllowedOrigins is not set
+var localOrigins = []string{"localhost", "127.0.0.1", "::1"}
+
+func (h *ReadHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	query := r.Context().Value("query").(*repository.LogQuery)
+	logger := r.Context().Value("logger").(*slog.FieldLogger)
+	options := r.Context().Value("options").(*renderOptions)
+
+	// Pagination only makes sense for the initial page of events.
+	// All new events should be streamed to the client.
+	query.Limit = 0
+	query.Offset = 0
+	query.Tail = 0
+
+	// Browsers let any page open a WebSocket so the origin must
+	// be checked to stop other sites reading the logs
+	if !h.checkOrigin(r) {
+		err := errors.Forbidden("origin %q is not allowed", r.Header.Get("Origin"))
+		logger.Warn("Rejected WebSocket connection: %v", err)
+		response.WriteJSON(w, err)
+		return
+	}
+
+	// Upgrade the request to a WebSocket connection. Compression is
+	// only used if the client also asks for it during the handshake.
+	upgrader := websocket.Upgrader{
+		CheckOrigin:       h.checkOrigin,
+		EnableCompression: h.EnableCompression,
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("Failed to create websocket upgrader: %v", err)
+		return
+	}
+	defer ws.Close()
+	ws.EnableWriteCompression(h.EnableCompression)
+
+	// The client must reply to each ping within pongWait
+	// otherwise the read loop will error and return.
+	pingInterval := h.pingInterval()
+	pongWait := pingInterval * 2
+
+	// A client that stops reading would otherwise block a write forever,
+	// leaking this goroutine and its subscription
+	writeTimeout := h.writeTimeout()
+
+	events := h.Watcher.NewChannel(options.Buffer)
+
+	// Set to 1 by a control message from the client to receive events
+	// as a JSON array per frame instead of one frame per event
+	var batching int32
+
+	// A loop must be started that reads messages until a non-nil error is
+	// received so that close, ping and pong messages are processed. Control
+	// messages from the client change the live filter of the subscription.
+	// Close a channel to signal to the for loop below that the client has gone away.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readLoop(ws, pongWait, func(msg *controlMessage) {
+			if msg.Batch != nil {
+				var v int32
+				if *msg.Batch {
+					v = 1
+				}
+				atomic.StoreInt32(&batching, v)
+			}
+
+			h.applyControlMessage(events, msg, logger)
+		})
+	}()
+
+	// If the client is resuming from an earlier event, send everything that
+	// has happened since then before streaming live events. Otherwise
+	// there is nothing to catch up on so only stream events from now on.
+	send := func(event *domain.Event) error {
+		options.localise([]*domain.Event{event})
+		return writeEvent(ws, event, options, writeTimeout)
+	}
+
+	if query.SinceUUID != "" {
+		if err := h.backfill(r.Context(), query, send); err != nil {
+			logger.Error("Failed to backfill events: %v", err)
+			return
+		}
+	} else if options.Backlog > 0 {
+		if err := h.sendBacklog(r.Context(), query, options.Backlog, send); err != nil {
+			logger.Error("Failed to send backlog: %v", err)
+			return
+		}
+	} else if query.SinceTime.IsZero() {
+		query.SinceTime = time.Now()
+	}
+
+	// Subscribe to new events that match the query in the request
+	err = h.Watcher.Subscribe(events, query)
+	if err != nil {
+		logger.Error("Failed to subscribe to the watcher: %v", err)
+
+		// Tell the client why so it can decide whether to reconnect
+		code := websocket.CloseInternalServerErr
+		if e, ok := err.(*errors.Error); ok {
+			switch e.Code {
+			case watch.ErrTooManySubscribers:
+				code = websocket.CloseTryAgainLater
+			case watch.ErrStopped:
+				code = websocket.CloseGoingAway
+			}
+		}
+		writeClose(ws, code, err.Error())
+		return
+	}
+	defer func() {
+		h.Watcher.Unsubscribe(events)
+	}()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	heartbeats, stopHeartbeats := h.heartbeats()
+	defer stopHeartbeats()
+	lastSent := time.Now()
+
+	expired, stopExpiry := h.connectionExpiry()
+	defer stopExpiry()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				logger.Error("Events channel unexpectedly closed")
+				return
+			}
+			lastSent = time.Now()
+
+			if atomic.LoadInt32(&batching) == 1 {
+				batch := collectBatch(events, event, batchFlushInterval, maxBatchSize)
+				options.localise(batch)
+				err = writeBatch(ws, batch, options, writeTimeout)
+			} else {
+				err = send(event)
+			}
+			if isTimeout(err) {
+				// The client has stopped reading so treat it as gone
+				logger.Warn("Disconnecting WebSocket client that stopped reading: %v", err)
+				return
+			} else if err != nil {
+				logger.Error("Failed to write message to websocket: %v", err)
+				return
+			}
+
+			// Let the client know if it has missed any events
+			if dropped := h.Watcher.TakeDropped(events); dropped > 0 {
+				if err := writeGap(ws, dropped, writeTimeout); isTimeout(err) {
+					logger.Warn("Disconnecting WebSocket client that stopped reading: %v", err)
+					return
+				} else if err != nil {
+					logger.Error("Failed to write gap to websocket: %v", err)
+					return
+				}
+			}
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				logger.Error("Failed to write ping to websocket: %v", err)
+				return
+			}
+		case now := <-heartbeats:
+			if now.Sub(lastSent) < h.HeartbeatInterval {
+				continue
+			}
+			lastSent = now
+
+			if err := writeHeartbeat(ws, now, writeTimeout); isTimeout(err) {
+				logger.Warn("Disconnecting WebSocket client that stopped reading: %v", err)
+				return
+			} else if err != nil {
+				logger.Error("Failed to write heartbeat to websocket: %v", err)
+				return
+			}
+		case <-expired:
+			// The deferred Unsubscribe removes the subscription
+			logger.Debug("Closing WebSocket connection that reached its maximum duration")
+			writeClose(ws, websocket.CloseServiceRestart, "maximum connection duration reached, reconnect")
+			return
+		case <-h.Watcher.Done():
+			// The service is shutting down so let the client know
+			writeClose(ws, websocket.CloseGoingAway, "server shutting down")
+			return
+		case <-done:
+			// The WebSocket is closed so silently return
+			return
+		}
+	}
+}
+
+// checkOrigin returns whether the request's Origin header is one of the
+// handler's AllowedOrigins. Requests without an Origin header are not
+// from a browser so are allowed.
+func (h *ReadHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	allowedOrigins := h.allowedOrigins()
+	if len(allowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+
+		for _, host := range localOrigins {
+			if u.Hostname() == host {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// backfill sends all events after the query's SinceUUID to the client
+// and then moves SinceUUID on to the last event that was sent, so that
+// a subscription using the same query carries on where this left off.
+// If there is no event with SinceUUID, e.g. because it has been purged,
+// the events in the default time window are sent instead of every event.
+func (h *ReadHandler) backfill(ctx context.Context, query *repository.LogQuery, send func(*domain.Event) error) error {
+	since, err := h.LogRepository.FindByUUID(ctx, query, query.SinceUUID)
+	if err != nil {
+		return err
+	}
+	if since == nil {
+		query.SinceUUID = ""
+		if query.SinceTime.IsZero() {
+			query.SinceTime = time.Now().Add(-h.defaultWindow())
+		}
+	}
+
+	// Events must be sent in order so the last one is the newest
+	query.Reverse = false
+
+	events, err := h.LogRepository.Find(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	// Bound the live events by time as well in case
+	// the event with SinceUUID is rotated away
+	last := events[len(events)-1]
+	query.SinceUUID = last.UUID
+	if last.Timestamp.After(query.SinceTime) {
+		query.SinceTime = last.Timestamp
+	}
+
+	return nil
+}
+
+// sendBacklog sends the newest n events that match the query to the client
+// and moves SinceUUID on to the last of them, so that a subscription using
+// the same query streams the events after them. If there are no matching
+// events, only events from now on will be streamed.
+func (h *ReadHandler) sendBacklog(ctx context.Context, query *repository.LogQuery, n int, send func(*domain.Event) error) error {
+	q := *query
+	q.Tail = n
+	q.Reverse = false
+
+	events, err := h.LogRepository.Find(ctx, &q)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	if len(events) == 0 {
+		if query.SinceTime.IsZero() {
+			query.SinceTime = time.Now()
+		}
+		return nil
+	}
+
+	// The backlog ignores the time window so bound the live events by
+	// time as well in case the event with SinceUUID is rotated away
+	last := events[len(events)-1]
+	query.SinceUUID = last.UUID
+	if last.Timestamp.After(query.SinceTime) {
+		query.SinceTime = last.Timestamp
+	}
+
+	return nil
+}
+
+// writeEvent formats the event and writes it to the client as JSON
+func writeEvent(ws *websocket.Conn, event *domain.Event, options *renderOptions, timeout time.Duration) error {
+	b, err := json.Marshal(options.jsonEvent(event))
+	if err != nil {
+		return errors.Wrap(err, nil)
+	}
+
+	return writeMessage(ws, b, timeout)
+}
+
+// collectBatch returns first followed by any events that are received from c
+// within interval, up to max events in total. If no more events are waiting,
+// first is returned straight away so that it is not delayed when idle.
+func collectBatch(c <-chan *domain.Event, first *domain.Event, interval time.Duration, max int) []*domain.Event {
+	batch := []*domain.Event{first}
+	if len(c) == 0 {
+		return batch
+	}
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for len(batch) < max {
+		select {
+		case event, ok := <-c:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, event)
+		case <-timer.C:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// writeBatch formats the events and writes them to the client as a JSON array
+func writeBatch(ws *websocket.Conn, events []*domain.Event, options *renderOptions, timeout time.Duration) error {
+	formatted := make([]interface{}, len(events))
+	for i, event := range events {
+		formatted[i] = options.jsonEvent(event)
+	}
+
+	b, err := json.Marshal(formatted)
+	if err != nil {
+		return errors.Wrap(err, nil)
+	}
+
+	return writeMessage(ws, b, timeout)
+}
+
+// gapMessage is sent to the client when events have been dropped
+type gapMessage struct {
+	Type    string `json:"type"`
+	Dropped int    `json:"dropped"`
+}
+
+// writeGap tells the client how many events it has missed
+func writeGap(ws *websocket.Conn, dropped int, timeout time.Duration) error {
+	b, err := json.Marshal(&gapMessage{
+		Type:    "gap",
+		Dropped: dropped,
+	})
+	if err != nil {
+		return errors.Wrap(err, nil)
+	}
+
+	return writeMessage(ws, b, timeout)
+}
+
+// heartbeatMessage is sent to the client while no events are being sent
+type heartbeatMessage struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"ts"`
+}
+
+func newHeartbeatMessage(now time.Time) *heartbeatMessage {
+	return &heartbeatMessage{
+		Type:      "heartbeat",
+		Timestamp: now.UTC(),
+	}
+}
+
+// writeHeartbeat tells the client that the connection is still alive
+func writeHeartbeat(ws *websocket.Conn, now time.Time, timeout time.Duration) error {
+	b, err := json.Marshal(newHeartbeatMessage(now))
+	if err != nil {
+		return errors.Wrap(err, nil)
+	}
+
+	return writeMessage(ws, b, timeout)
+}
+
+// writeMessage writes a text message to the client, failing with a timeout
+// error if the client does not accept it in time. The connection cannot be
+// written to again after a timeout.
+func writeMessage(ws *websocket.Conn, b []byte, timeout time.Duration) error {
+	if err := ws.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	return ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// isTimeout returns whether the error is because a write deadline passed
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// writeClose sends a close frame to the client with the given code and reason
+func writeClose(ws *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+		slog.Error("Failed to write close message to websocket: %v", err)
+	}
+}
+
+func (h *ReadHandler) pingInterval() time.Duration {
+	if h.PingInterval > 0 {
+		return h.PingInterval
+	}
+	return defaultPingInterval
+}
+
+// heartbeats returns a channel that receives every HeartbeatInterval and a
+// function to stop it. The channel is nil, so never receives, if heartbeats
+// are disabled. A heartbeat is only due once a whole interval has passed
+// without sending anything so a quiet client hears from the server at
+// least every two intervals.
+func (h *ReadHandler) heartbeats() (<-chan time.Time, func()) {
+	if h.HeartbeatInterval <= 0 {
+		return nil, func() {}
+	}
+
+	ticker := time.NewTicker(h.HeartbeatInterval)
+	return ticker.C, ticker.Stop
+}
+
+// connectionExpiry returns a channel that receives once the connection has
+// lasted MaxConnectionDuration and a function to stop it. The channel is nil,
+// so never receives, if there is no limit.
+func (h *ReadHandler) connectionExpiry() (<-chan time.Time, func()) {
+	if h.MaxConnectionDuration <= 0 {
+		return nil, func() {}
+	}
+
+	timer := time.NewTimer(h.MaxConnectionDuration)
+	return timer.C, func() { timer.Stop() }
+}
+
+func (h *ReadHandler) writeTimeout() time.Duration {
+	if h.WriteTimeout > 0 {
+		return h.WriteTimeout
+	}
+	return defaultWriteTimeout
+}
+
+// controlMessage is sent by the client to change its live filter
+type controlMessage struct {
+	// Severity is the new minimum severity, as a name or a number
+	Severity json.RawMessage `json:"severity"`
+
+	// TraceID is the new trace to filter by. An empty
+	// string removes the filter and nil leaves it as is.
+	TraceID *string `json:"trace_id"`
+
+	// Batch turns batching of events on or off. Nil leaves it as is.
+	Batch *bool `json:"batch"`
+}
+
+// applyControlMessage updates the query of the subscription. Messages
+// received before the channel is subscribed are ignored.
+func (h *ReadHandler) applyControlMessage(c chan<- *domain.Event, msg *controlMessage, logger *slog.FieldLogger) {
+	var severity slog.Severity
+	if len(msg.Severity) > 0 {
+		var err error
+		severity, err = slog.ParseSeverity(strings.Trim(string(msg.Severity), `"`))
+		if err != nil {
+			logger.Debug("Ignoring invalid severity in control message: %v", err)
+			return
+		}
+	}
+
+	if len(msg.Severity) == 0 && msg.TraceID == nil {
+		return
+	}
+
+	h.Watcher.UpdateQuery(c, func(q *repository.LogQuery) {
+		if len(msg.Severity) > 0 {
+			// Set both so that the severity can be lowered as well as raised
+			q.Severity = severity
+			q.MinSeverity = severity
+		}
+
+		if msg.TraceID != nil {
+			q.TraceID = strings.TrimSpace(*msg.TraceID)
+		}
+	})
+}
+
+// readLoop reads messages until an error is received, passing any control
+// messages to handle. Messages that are not valid control messages are
+// discarded. The read deadline is extended by pongWait each time the client
+// responds to a ping.
+func readLoop(c *websocket.Conn, pongWait time.Duration, handle func(*controlMessage)) {
+	if err := c.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		c.Close()
+		return
+	}
+
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		msgType, data, err := c.ReadMessage()
+		if err != nil {
+			c.Close()
+			break
+		}
+
+		if msgType != websocket.TextMessage {
+			continue
+		}
+
+		msg := &controlMessage{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			continue
+		}
+
+		handle(msg)
+	}
+}
@@ -0,0 +1,346 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+	"github.com/jakewright/home-automation/service.log/watch"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{nil, "", true},
+		{nil, "http://localhost:7005", true},
+		{nil, "http://127.0.0.1", true},
+		{nil, "http://[::1]:7005", true},
+		{nil, "https://evil.example.com", false},
+		{nil, "http://localhost.evil.example.com", false},
+		{[]string{"https://logs.example.com"}, "https://LOGS.example.com", true},
+		{[]string{"https://logs.example.com"}, "http://logs.example.com", false},
+		{[]string{"https://logs.example.com"}, "http://localhost", false},
+		{[]string{"*"}, "https://evil.example.com", true},
+	}
+
+	for _, tc := range tests {
+		h := &ReadHandler{AllowedOrigins: tc.allowed}
+		r, err := http.NewRequest(http.MethodGet, "/ws", nil)
+		assert.NilError(t, err)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+
+		assert.Equal(t, h.checkOrigin(r), tc.want, tc.origin)
+	}
+}
+
+func TestCollectBatch(t *testing.T) {
+	c := make(chan *domain.Event, 10)
+	first := &domain.Event{UUID: "1"}
+
+	// Nothing else is waiting so the event is sent straight away
+	start := time.Now()
+	batch := collectBatch(c, first, time.Second, 3)
+	assert.Equal(t, len(batch), 1)
+	assert.Assert(t, time.Since(start) < time.Second)
+
+	// Waiting events are collected up to the max
+	for _, uuid := range []string{"2", "3", "4"} {
+		c <- &domain.Event{UUID: uuid}
+	}
+	batch = collectBatch(c, first, time.Second, 3)
+	assert.Equal(t, len(batch), 3)
+	assert.Equal(t, batch[2].UUID, "3")
+
+	// The batch is sent after the interval if it is not full
+	batch = collectBatch(c, first, 10*time.Millisecond, 3)
+	assert.Equal(t, len(batch), 2)
+	assert.Equal(t, batch[1].UUID, "4")
+}
+
+func TestBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UTC()
+	var lines []string
+	for _, e := range []struct {
+		uuid      string
+		timestamp time.Time
+	}{
+		{"old", now.Add(-2 * time.Hour)},
+		{"1", now},
+		{"2", now},
+	} {
+		lines = append(lines, fmt.Sprintf(
+			`{"uuid":%q,"@timestamp":%q,"service":"service.foo","severity":"info","message":"a"}`,
+			e.uuid, e.timestamp.Format(time.RFC3339),
+		))
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", now.Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	h := &ReadHandler{LogRepository: repository.NewLogRepository(dir)}
+
+	backfill := func(query *repository.LogQuery) []string {
+		var sent []string
+		err := h.backfill(context.Background(), query, func(e *domain.Event) error {
+			sent = append(sent, e.UUID)
+			return nil
+		})
+		assert.NilError(t, err)
+		return sent
+	}
+
+	// Everything after a known event is sent
+	query := &repository.LogQuery{SinceUUID: "old"}
+	assert.DeepEqual(t, backfill(query), []string{"1", "2"})
+	assert.Equal(t, query.SinceUUID, "2")
+	assert.Equal(t, query.SinceTime, now.Truncate(time.Second))
+
+	// An unknown event does not replay the whole history
+	query = &repository.LogQuery{SinceUUID: "purged"}
+	assert.DeepEqual(t, backfill(query), []string{"1", "2"})
+	assert.Equal(t, query.SinceUUID, "2")
+
+	// Nor does the subscription if nothing was sent
+	query = &repository.LogQuery{SinceUUID: "purged", Services: []string{"service.bar"}}
+	assert.Equal(t, len(backfill(query)), 0)
+	assert.Equal(t, query.SinceUUID, "")
+	assert.Assert(t, !query.SinceTime.IsZero())
+}
+
+func TestHandleWebSocketStalledClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, nil, 0644))
+
+	repo := repository.NewLogRepository(dir)
+	watcher := &watch.Watcher{
+		LogRepository:  repo,
+		DebounceWindow: 10 * time.Millisecond,
+		MaxSubscribers: 1,
+	}
+	go watcher.Start()
+	defer watcher.Stop(context.Background())
+
+	h := &ReadHandler{
+		LogRepository: repo,
+		Watcher:       watcher,
+		WriteTimeout:  100 * time.Millisecond,
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.DecodeBody(w, r, h.HandleWebSocket)
+	}))
+	server.Listener = smallBufferListener{server.Listener}
+	server.Start()
+	defer server.Close()
+
+	// The client never reads and both ends have tiny socket
+	// buffers so the server's writes stall almost straight away
+	dialer := &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return conn, conn.(*net.TCPConn).SetReadBuffer(1024)
+		},
+	}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NilError(t, err)
+	defer ws.Close()
+
+	// subscribed returns whether the watcher's only subscription is taken
+	probe := make(chan *domain.Event, 1)
+	subscribed := func() bool {
+		err := watcher.Subscribe(probe, &repository.LogQuery{})
+		if err == nil {
+			watcher.Unsubscribe(probe)
+			return false
+		}
+		assert.Equal(t, err.(*errors.Error).Code, watch.ErrTooManySubscribers)
+		return true
+	}
+
+	// Give the handler time to subscribe
+	time.Sleep(100 * time.Millisecond)
+	assert.Assert(t, subscribed(), "client was not subscribed")
+
+	// Write far more than the socket buffers can hold
+	message := strings.Repeat("x", 64*1024)
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NilError(t, err)
+	for i := 0; i < 16; i++ {
+		_, err := fmt.Fprintf(f, `{"uuid":"%d","@timestamp":%q,"service":"service.foo","severity":"info","message":%q}`+"\n",
+			i, time.Now().UTC().Format(time.RFC3339Nano), message)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, f.Close())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for subscribed() {
+		assert.Assert(t, time.Now().Before(deadline), "stalled client was not unsubscribed")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleWebSocketCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	line := fmt.Sprintf(`{"uuid":"1","@timestamp":%q,"service":"service.foo","severity":"info","message":"hello"}`,
+		time.Now().UTC().Format(time.RFC3339))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(line+"\n"), 0644))
+
+	for _, enabled := range []bool{true, false} {
+		repo := repository.NewLogRepository(dir)
+		h := &ReadHandler{
+			LogRepository:     repo,
+			Watcher:           &watch.Watcher{LogRepository: repo},
+			EnableCompression: enabled,
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.DecodeBody(w, r, h.HandleWebSocket)
+		}))
+
+		dialer := &websocket.Dialer{EnableCompression: true}
+		ws, rsp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?backlog=1", nil)
+		assert.NilError(t, err)
+
+		// The extension is only agreed if the handler allows it
+		negotiated := strings.Contains(rsp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+		assert.Equal(t, negotiated, enabled)
+
+		var event domain.FormattedEvent
+		assert.NilError(t, ws.ReadJSON(&event))
+		assert.Equal(t, event.UUID, "1")
+
+		ws.Close()
+		server.Close()
+	}
+}
+
+func TestHandleWebSocketHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	line := fmt.Sprintf(`{"uuid":"1","@timestamp":%q,"service":"service.foo","severity":"info","message":"hello"}`,
+		time.Now().UTC().Format(time.RFC3339))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(line+"\n"), 0644))
+
+	repo := repository.NewLogRepository(dir)
+	h := &ReadHandler{
+		LogRepository:     repo,
+		Watcher:           &watch.Watcher{LogRepository: repo},
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.DecodeBody(w, r, h.HandleWebSocket)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?backlog=1", nil)
+	assert.NilError(t, err)
+	defer ws.Close()
+
+	// The backlog is sent before any heartbeats
+	var event domain.FormattedEvent
+	assert.NilError(t, ws.ReadJSON(&event))
+	assert.Equal(t, event.UUID, "1")
+
+	// No more events are written so heartbeats follow
+	for i := 0; i < 2; i++ {
+		assert.NilError(t, ws.SetReadDeadline(time.Now().Add(time.Second)))
+		var heartbeat heartbeatMessage
+		assert.NilError(t, ws.ReadJSON(&heartbeat))
+		assert.Equal(t, heartbeat.Type, "heartbeat")
+		assert.Assert(t, !heartbeat.Timestamp.IsZero())
+	}
+}
+
+func TestHandleWebSocketMaxConnectionDuration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, nil, 0644))
+
+	repo := repository.NewLogRepository(dir)
+	watcher := &watch.Watcher{
+		LogRepository:  repo,
+		MaxSubscribers: 1,
+	}
+	h := &ReadHandler{
+		LogRepository:         repo,
+		Watcher:               watcher,
+		MaxConnectionDuration: 100 * time.Millisecond,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.DecodeBody(w, r, h.HandleWebSocket)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NilError(t, err)
+	defer ws.Close()
+
+	// The client is told to reconnect once the duration has passed
+	assert.NilError(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err = ws.ReadMessage()
+	assert.Assert(t, websocket.IsCloseError(err, websocket.CloseServiceRestart), err)
+
+	// The subscription is removed so another client can take its place
+	probe := make(chan *domain.Event, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := watcher.Subscribe(probe, &repository.LogQuery{})
+		if err == nil {
+			break
+		}
+		assert.Equal(t, err.(*errors.Error).Code, watch.ErrTooManySubscribers)
+		assert.Assert(t, time.Now().Before(deadline), "subscriber was not removed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	watcher.Unsubscribe(probe)
+}
+
+// smallBufferListener shrinks the send buffer of each accepted connection
+type smallBufferListener struct {
+	net.Listener
+}
+
+func (l smallBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return conn, conn.(*net.TCPConn).SetWriteBuffer(1024)
+}
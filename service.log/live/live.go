@@ -0,0 +1,49 @@
+package live
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Settings are the settings of the running service that can be reloaded
+// without a restart. Components that are given a Value use its settings,
+// once it holds some, instead of their own fields of the same names.
+type Settings struct {
+	// AllowedOrigins overrides handler.ReadHandler.AllowedOrigins
+	AllowedOrigins []string
+
+	// DefaultWindow overrides handler.ReadHandler.DefaultWindow
+	DefaultWindow time.Duration
+
+	// MaxSubscribers overrides watch.Watcher.MaxSubscribers
+	MaxSubscribers int
+
+	// MaxEventsPerSecond overrides watch.Watcher.MaxEventsPerSecond
+	MaxEventsPerSecond int
+
+	// Retention overrides purge.Purger.Retention
+	Retention time.Duration
+}
+
+// Value holds the current Settings. The settings are replaced as a whole,
+// never changed, so that a reader sees either all of the old settings or
+// all of the new ones. A nil *Value holds no settings.
+type Value struct {
+	v atomic.Value
+}
+
+// Load returns the current settings, or nil if none have been stored.
+// The settings must not be changed.
+func (v *Value) Load() *Settings {
+	if v == nil {
+		return nil
+	}
+	s, _ := v.v.Load().(*Settings)
+	return s
+}
+
+// Store replaces the current settings. It is safe to call while other
+// goroutines are loading them.
+func (v *Value) Store(s *Settings) {
+	v.v.Store(s)
+}
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/jakewright/home-automation/libraries/go/bootstrap"
 	"github.com/jakewright/home-automation/libraries/go/config"
 	"github.com/jakewright/home-automation/libraries/go/router"
 	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
 	"github.com/jakewright/home-automation/service.log/handler"
+	"github.com/jakewright/home-automation/service.log/live"
+	"github.com/jakewright/home-automation/service.log/metrics"
+	"github.com/jakewright/home-automation/service.log/purge"
+	"github.com/jakewright/home-automation/service.log/rate"
 	"github.com/jakewright/home-automation/service.log/repository"
+	"github.com/jakewright/home-automation/service.log/tcp"
 	"github.com/jakewright/home-automation/service.log/watch"
 )
 
@@ -15,8 +30,9 @@ func main() {
 		slog.Panic("Failed to initialise service: %v", err)
 	}
 
-	logDirectory := config.Get("logDirectory").String()
-	if logDirectory == "" {
+	// Several directories can be given as a comma-separated list
+	logDirectories := parseList(config.Get("logDirectory").String())
+	if len(logDirectories) == 0 {
 		slog.Panic("logDirectory not set in config")
 	}
 
@@ -25,24 +41,170 @@ func main() {
 		slog.Panic("templateDirectory not set in config")
 	}
 
-	logRepository := &repository.LogRepository{
-		LogDirectory: logDirectory,
+	if pattern := config.Get("traceIdPattern").String(); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			slog.Panic("Invalid traceIdPattern in config: %v", err)
+		}
+		domain.TraceIDRegexp = re
+	}
+
+	metrics.Register()
+
+	logRepository := repository.NewLogRepository(logDirectories...)
+	logRepository.CacheEvents = config.Get("queryCacheEvents").Int(0)
+
+	// Legacy services' logs can be parsed with a custom line format
+	if pattern := config.Get("lineFormat").String(); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			slog.Panic("Invalid lineFormat in config: %v", err)
+		}
+		logRepository.LineFormat = re
+		logRepository.TimestampLayout = config.Get("timestampLayout").String()
 	}
 
+	// Settings that are reloaded on SIGHUP are shared by the components that use them
+	settings := &live.Value{}
+
 	watcher := &watch.Watcher{
 		LogRepository: logRepository,
+		BufferSize:    config.Get("subscriberBufferSize").Int(0),
+		Live:          settings,
+	}
+
+	purgeInterval, err := time.ParseDuration(config.Get("purgeInterval").String("1h"))
+	if err != nil {
+		slog.Panic("Invalid purgeInterval in config: %v", err)
+	}
+
+	purger := &purge.Purger{
+		LogRepository: logRepository,
+		Interval:      purgeInterval,
+		Live:          settings,
+	}
+
+	rateSampleInterval, err := time.ParseDuration(config.Get("rateSampleInterval").String("1m"))
+	if err != nil {
+		slog.Panic("Invalid rateSampleInterval in config: %v", err)
+	}
+
+	rateLookback, err := time.ParseDuration(config.Get("rateLookback").String("5m"))
+	if err != nil {
+		slog.Panic("Invalid rateLookback in config: %v", err)
+	}
+
+	// Recent per-service event rates are exposed as metrics
+	// so that a service that stops logging can be alerted on
+	sampler := &rate.Sampler{
+		LogRepository: logRepository,
+		Interval:      rateSampleInterval,
+		Lookback:      rateLookback,
+	}
+
+	heartbeatInterval, err := time.ParseDuration(config.Get("heartbeatInterval").String("0s"))
+	if err != nil {
+		slog.Panic("Invalid heartbeatInterval in config: %v", err)
+	}
+
+	maxConnectionDuration, err := time.ParseDuration(config.Get("maxConnectionDuration").String("0s"))
+	if err != nil {
+		slog.Panic("Invalid maxConnectionDuration in config: %v", err)
+	}
+
+	readHandler := &handler.ReadHandler{
+		TemplateDirectory:     templateDirectory,
+		LogRepository:         logRepository,
+		Watcher:               watcher,
+		ReloadTemplates:       config.Get("reloadTemplates").Bool(false),
+		EnableCompression:     config.Get("websocketCompression").Bool(false),
+		HeartbeatInterval:     heartbeatInterval,
+		MaxConnectionDuration: maxConnectionDuration,
+		Live:                  settings,
 	}
 
-	readHandler := handler.ReadHandler{
-		TemplateDirectory: templateDirectory,
-		LogRepository:     logRepository,
-		Watcher:           watcher,
+	reloader := &reloader{settings: settings}
+	if err := reloader.apply(config.DefaultProvider); err != nil {
+		slog.Panic("Invalid config: %v", err)
+	}
+
+	// Some settings can be changed without dropping streaming clients
+	// by updating the config and sending the service SIGHUP
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go reloader.run(sighup, func() (config.Provider, error) {
+		if err := bootstrap.LoadConfig("service.log"); err != nil {
+			return nil, err
+		}
+		return config.DefaultProvider, nil
+	})
+
+	// Reading logs requires a token if any are configured
+	auth := &handler.Auth{
+		Tokens: parseList(config.Get("authTokens").String()),
 	}
 
 	r := router.New()
-	r.Get("/", readHandler.HandleRead, readHandler.DecodeBody)
-	r.Get("/ws", readHandler.HandleWebSocket, readHandler.DecodeBody)
+	r.Get("/", readHandler.HandleRead, auth.Middleware, handler.Gzip, readHandler.DecodeBody)
+	r.Get("/events", readHandler.HandleReadJSON, auth.Middleware, handler.Gzip, readHandler.DecodeBody)
+	r.Get("/export", readHandler.HandleExport, auth.Middleware, readHandler.DecodeBody)
+	r.Get("/latest", readHandler.HandleLatest, auth.Middleware, readHandler.DecodeBody)
+	r.Get("/count", readHandler.HandleCount, auth.Middleware, handler.Gzip, readHandler.DecodeBody)
+	r.Get("/histogram", readHandler.HandleHistogram, auth.Middleware, handler.Gzip, readHandler.DecodeBody)
+	r.Get("/facets", readHandler.HandleFacets, auth.Middleware, handler.Gzip, readHandler.DecodeBody)
+	r.Get("/search", readHandler.HandleSearch, auth.Middleware, handler.Gzip, readHandler.DecodeBody)
+	r.Post("/search", readHandler.HandleSearch, auth.Middleware, handler.Gzip, readHandler.DecodeBody)
+	r.Get("/services", readHandler.HandleServices, auth.Middleware, handler.Gzip, readHandler.DecodeBody)
+	r.Get("/ws", readHandler.HandleWebSocket, auth.Middleware, readHandler.DecodeBody)
+	r.Get("/sse", readHandler.HandleSSE, auth.Middleware, readHandler.DecodeBody)
+	r.Get("/stats", readHandler.HandleStats, auth.Middleware)
+	r.Get("/metrics", metrics.HandleMetrics)
+	r.Get("/schema", handler.HandleSchema)
+	r.Get("/loglevel", handler.HandleGetLogLevel, auth.Middleware)
+	r.Put("/loglevel", handler.HandleSetLogLevel, auth.Middleware)
 	r.Post("/write", handler.HandleWrite)
 
-	bootstrap.Run(r, watcher)
+	processes := []bootstrap.Process{r, watcher, purger, sampler}
+
+	// Log shippers that do not speak HTTP can stream events over TCP
+	if tcpAddr := config.Get("tcpAddr").String(); tcpAddr != "" {
+		processes = append(processes, &tcp.Server{
+			Addr:          tcpAddr,
+			LogRepository: logRepository,
+			Watcher:       watcher,
+			Tokens:        auth.Tokens,
+		})
+	}
+
+	bootstrap.Run(processes...)
+}
+
+// parseSeverityNames parses a list of severity names, e.g. "15=notice, 25=critical"
+func parseSeverityNames(s string) (map[slog.Severity]string, error) {
+	names := map[slog.Severity]string{}
+	for _, item := range parseList(s) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not in the form level=name", item)
+		}
+
+		level, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid level in %q: %v", item, err)
+		}
+
+		names[slog.Severity(level)] = strings.TrimSpace(parts[1])
+	}
+	return names, nil
+}
+
+// parseList splits a comma-separated config value, ignoring empty items
+func parseList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
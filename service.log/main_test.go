@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/config"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/live"
+
+	"gotest.tools/assert"
+)
+
+func newTestReloader() *reloader {
+	return &reloader{settings: &live.Value{}}
+}
+
+func TestReloadSeverity(t *testing.T) {
+	defer slog.SetLevel(slog.Level())
+	defer slog.SetSeverityNames(nil)
+	slog.SetLevel(slog.DebugSeverity)
+
+	r := newTestReloader()
+	sig := make(chan os.Signal)
+	loaded := make(chan struct{})
+	provider := config.New(map[string]interface{}{
+		"logLevel":       "error",
+		"severityNames":  "15=notice",
+		"allowedOrigins": "https://logs.example.com",
+		"maxSubscribers": 5,
+		"retention":      "24h",
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.run(sig, func() (config.Provider, error) {
+			defer close(loaded)
+			return provider, nil
+		})
+	}()
+
+	sig <- syscall.SIGHUP
+	<-loaded
+	close(sig)
+	<-done
+
+	assert.Equal(t, slog.Level(), slog.ErrorSeverity)
+	assert.Equal(t, slog.Severity(15).String(), "NOTICE")
+	assert.DeepEqual(t, r.settings.Load(), &live.Settings{
+		AllowedOrigins: []string{"https://logs.example.com"},
+		DefaultWindow:  time.Hour,
+		MaxSubscribers: 5,
+		Retention:      24 * time.Hour,
+	})
+}
+
+func TestReloadCustomLevel(t *testing.T) {
+	defer slog.SetLevel(slog.Level())
+	defer slog.SetSeverityNames(nil)
+	slog.SetLevel(slog.DebugSeverity)
+
+	// The level can be named by severityNames in the same config
+	r := newTestReloader()
+	assert.NilError(t, r.apply(config.New(map[string]interface{}{
+		"logLevel":      "notice",
+		"severityNames": "15=notice",
+	})))
+	assert.Equal(t, slog.Level(), slog.Severity(15))
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	defer slog.SetLevel(slog.Level())
+	slog.SetLevel(slog.DebugSeverity)
+
+	r := newTestReloader()
+	assert.NilError(t, r.apply(config.New(map[string]interface{}{
+		"logLevel":       "debug",
+		"allowedOrigins": "https://logs.example.com",
+	})))
+
+	// Nothing is changed if any setting is invalid
+	for _, c := range []map[string]interface{}{
+		{"logLevel": "error", "allowedOrigins": "*", "retention": "forever"},
+		{"logLevel": "error", "allowedOrigins": "*", "maxSubscribers": "lots"},
+		{"logLevel": "loud", "allowedOrigins": "*"},
+	} {
+		assert.Assert(t, r.apply(config.New(c)) != nil)
+		assert.Equal(t, slog.Level(), slog.DebugSeverity)
+		assert.DeepEqual(t, r.settings.Load().AllowedOrigins, []string{"https://logs.example.com"})
+	}
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "service_log"
+
+var (
+	// Reads is the number of requests for events
+	Reads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reads_total",
+		Help:      "Number of requests for events",
+	})
+
+	// Subscriptions is the number of times the watcher has been subscribed to
+	Subscriptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "subscriptions_total",
+		Help:      "Number of subscriptions to new events",
+	})
+
+	// Subscribers is the number of current subscribers
+	Subscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "subscribers",
+		Help:      "Number of current subscribers to new events",
+	})
+
+	// DroppedEvents is the number of events that
+	// could not be sent to a subscriber in time
+	DroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_events_total",
+		Help:      "Number of events dropped because a subscriber was too slow",
+	})
+
+	// FindDuration is the latency of LogRepository.Find
+	// labelled by whether the results were truncated
+	FindDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "find_duration_seconds",
+		Help:      "Time taken to find events in the log files",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"truncated"})
+
+	// QueryCacheHits is the number of queries whose
+	// results were found in the LogRepository's cache
+	QueryCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_cache_hits_total",
+		Help:      "Number of queries answered from the result cache",
+	})
+
+	// QueryCacheMisses is the number of cacheable queries
+	// whose results were not in the LogRepository's cache
+	QueryCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_cache_misses_total",
+		Help:      "Number of cacheable queries that read the log files",
+	})
+
+	// ServiceEventRate is the number of events per minute that each
+	// service has logged recently, labelled by the name of the service.
+	// A service whose rate drops to zero has probably stopped running.
+	ServiceEventRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_events_per_minute",
+		Help:      "Recent number of events per minute logged by each service",
+	}, []string{"service"})
+)
+
+// Register registers all of the collectors with the default registry.
+// It should be called once at startup.
+func Register() {
+	prometheus.MustRegister(
+		Reads,
+		Subscriptions,
+		Subscribers,
+		DroppedEvents,
+		FindDuration,
+		QueryCacheHits,
+		QueryCacheMisses,
+		ServiceEventRate,
+	)
+}
+
+var handler = promhttp.Handler()
+
+// HandleMetrics writes the current value of all registered metrics
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,162 @@
+package purge
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/live"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+const (
+	// defaultRetention is used if Purger.Retention is not set
+	defaultRetention = 30 * 24 * time.Hour
+
+	// defaultInterval is used if Purger.Interval is not set
+	defaultInterval = time.Hour
+)
+
+// Purger periodically deletes log files that are older than the retention period
+type Purger struct {
+	// LogRepository provides access to the log files
+	LogRepository *repository.LogRepository
+
+	// Retention is how long events are kept for. A file is deleted once
+	// its newest event is older than this. Defaults to 30 days. It is
+	// replaced by Live's Retention once Live holds settings.
+	Retention time.Duration
+
+	// Live holds the settings that are reloaded while the purger is running
+	Live *live.Value
+
+	// Interval is how often to look for files to delete. Defaults to an hour.
+	Interval time.Duration
+
+	stop     chan struct{} // Closed to stop the purger
+	stopOnce sync.Once     // Makes Stop safe to call more than once
+	mux      sync.Mutex    // Guards the stop channel
+}
+
+// GetName returns the name "purger"
+func (p *Purger) GetName() string {
+	return "purger"
+}
+
+// Start deletes old log files every interval until Stop is called
+func (p *Purger) Start() error {
+	// Make sure the receiver struct has been initialised properly
+	if p.LogRepository == nil {
+		return errors.InternalService("LogRepository is not set")
+	}
+	if len(p.LogRepository.LogDirectories) == 0 {
+		return errors.InternalService("Log directories are not set")
+	}
+
+	stop := p.stopChan()
+
+	ticker := time.NewTicker(p.interval())
+	defer ticker.Stop()
+
+	for {
+		p.purge()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// Stop stops the purger. It is safe to call Stop more than once.
+func (p *Purger) Stop(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		close(p.stopChan())
+	})
+	return nil
+}
+
+// purge deletes every log file, other than the active one,
+// whose newest event is older than the retention period
+func (p *Purger) purge() {
+	files, err := p.LogRepository.LogFiles()
+	if err != nil {
+		slog.Error("Failed to list log files: %v", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-p.retention())
+	active := map[string]bool{}
+	for _, filename := range p.LogRepository.ActiveLogFiles() {
+		active[filename] = true
+	}
+
+	for _, filename := range files {
+		if active[filename] {
+			continue
+		}
+
+		newest, err := p.LogRepository.NewestEventTime(filename)
+		if err != nil {
+			slog.Error("Failed to read log file %s: %v", filename, err)
+			continue
+		}
+
+		// A file with no events is only deleted if it hasn't been written to
+		if newest.IsZero() {
+			info, err := os.Stat(filename)
+			if err != nil {
+				slog.Error("Failed to stat log file %s: %v", filename, err)
+				continue
+			}
+			newest = info.ModTime()
+		}
+
+		if !newest.Before(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(filename); err != nil {
+			slog.Error("Failed to delete log file %s: %v", filename, err)
+			continue
+		}
+
+		slog.Info("Deleted log file %s with newest event at %s", filename, newest.Format(time.RFC3339))
+	}
+}
+
+func (p *Purger) stopChan() chan struct{} {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.stop == nil {
+		p.stop = make(chan struct{})
+	}
+
+	return p.stop
+}
+
+// retention returns the retention period. A reloaded
+// retention takes effect from the next purge onwards.
+func (p *Purger) retention() time.Duration {
+	retention := p.Retention
+	if s := p.Live.Load(); s != nil {
+		retention = s.Retention
+	}
+
+	if retention > 0 {
+		return retention
+	}
+	return defaultRetention
+}
+
+func (p *Purger) interval() time.Duration {
+	if p.Interval > 0 {
+		return p.Interval
+	}
+	return defaultInterval
+}
@@ -0,0 +1,52 @@
+package purge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/repository"
+
+	"gotest.tools/assert"
+)
+
+// writeLogFile writes a single event with the timestamp to the file
+func writeLogFile(t *testing.T, filename string, timestamp time.Time) {
+	content := fmt.Sprintf(
+		`{"uuid":"1","@timestamp":%q,"service":"service.foo","severity":"info","message":"hello"}`+"\n",
+		timestamp.UTC().Format(time.RFC3339),
+	)
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+}
+
+func TestPurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := &repository.LogRepository{LogDirectories: []string{dir}}
+	now := time.Now().UTC()
+
+	old := filepath.Join(dir, fmt.Sprintf("messages-%s", now.AddDate(0, 0, -10).Format("2006-01-02")))
+	writeLogFile(t, old, now.AddDate(0, 0, -10))
+
+	// Named for an old date but contains a recent event
+	late := filepath.Join(dir, fmt.Sprintf("messages-%s", now.AddDate(0, 0, -9).Format("2006-01-02")))
+	writeLogFile(t, late, now.AddDate(0, 0, -1))
+
+	// The active file is never deleted, even with an old event
+	writeLogFile(t, r.ActiveLogFiles()[0], now.AddDate(0, 0, -10))
+
+	p := &Purger{
+		LogRepository: r,
+		Retention:     5 * 24 * time.Hour,
+	}
+	p.purge()
+
+	files, err := r.LogFiles()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, files, []string{late, r.ActiveLogFiles()[0]})
+}
@@ -0,0 +1,157 @@
+package rate
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/metrics"
+	"github.com/jakewright/home-automation/service.log/repository"
+)
+
+const (
+	// defaultInterval is used if Sampler.Interval is not set
+	defaultInterval = time.Minute
+
+	// defaultLookback is used if Sampler.Lookback is not set
+	defaultLookback = 5 * time.Minute
+)
+
+// Sampler periodically counts the events that each service has logged
+// recently and sets metrics.ServiceEventRate so that a service that has
+// stopped logging can be alerted on
+type Sampler struct {
+	// LogRepository provides access to the log files
+	LogRepository *repository.LogRepository
+
+	// Interval is how often to sample the rates. Defaults to a minute.
+	Interval time.Duration
+
+	// Lookback is the width of the window before each sample that events
+	// are counted in. Longer windows smooth out bursts. Defaults to 5 minutes.
+	Lookback time.Duration
+
+	// seen are the services that have been sampled before. Their rate
+	// is set to zero, rather than left as it was, once they stop logging.
+	seen map[string]bool
+
+	stop     chan struct{} // Closed to stop the sampler
+	stopOnce sync.Once     // Makes Stop safe to call more than once
+	mux      sync.Mutex    // Guards the stop channel
+}
+
+// GetName returns the name "rate sampler"
+func (s *Sampler) GetName() string {
+	return "rate sampler"
+}
+
+// Start samples the rates every interval until Stop is called
+func (s *Sampler) Start() error {
+	// Make sure the receiver struct has been initialised properly
+	if s.LogRepository == nil {
+		return errors.InternalService("LogRepository is not set")
+	}
+
+	stop := s.stopChan()
+
+	ticker := time.NewTicker(s.interval())
+	defer ticker.Stop()
+
+	for {
+		s.sample(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// Stop stops the sampler. It is safe to call Stop more than once.
+func (s *Sampler) Stop(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.stopChan())
+	})
+	return nil
+}
+
+// sample sets the rate of each service from the events in the lookback before now
+func (s *Sampler) sample(now time.Time) {
+	rates, err := s.rates(now)
+	if err != nil {
+		slog.Error("Failed to sample rates: %v", err)
+		return
+	}
+
+	for service, rate := range rates {
+		metrics.ServiceEventRate.WithLabelValues(service).Set(rate)
+	}
+}
+
+// rates returns the number of events per minute that each service logged in
+// the lookback before now, including zero for services that have stopped
+func (s *Sampler) rates(now time.Time) (map[string]float64, error) {
+	lookback := s.lookback()
+
+	// The window is left open so that samples are not cached by the repository
+	result, err := s.LogRepository.FindWithMeta(context.Background(), &repository.LogQuery{
+		SinceTime: now.Add(-lookback),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The counts of some services would be too low
+	if result.Truncated {
+		return nil, errors.InternalService("too many events in the last %s", lookback)
+	}
+
+	counts := map[string]int{}
+	for _, event := range result.Events {
+		if event.Service != "" {
+			counts[event.Service]++
+		}
+	}
+
+	if s.seen == nil {
+		s.seen = map[string]bool{}
+	}
+	for service := range counts {
+		s.seen[service] = true
+	}
+
+	rates := make(map[string]float64, len(s.seen))
+	for service := range s.seen {
+		rates[service] = float64(counts[service]) / lookback.Minutes()
+	}
+
+	return rates, nil
+}
+
+func (s *Sampler) stopChan() chan struct{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+
+	return s.stop
+}
+
+func (s *Sampler) interval() time.Duration {
+	if s.Interval > 0 {
+		return s.Interval
+	}
+	return defaultInterval
+}
+
+func (s *Sampler) lookback() time.Duration {
+	if s.Lookback > 0 {
+		return s.Lookback
+	}
+	return defaultLookback
+}
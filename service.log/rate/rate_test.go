@@ -0,0 +1,67 @@
+package rate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/repository"
+
+	"gotest.tools/assert"
+)
+
+// writeLogFile writes an event from each of the services to the active log file
+func writeLogFile(t *testing.T, r *repository.LogRepository, timestamp time.Time, services ...string) {
+	var lines []string
+	for i, service := range services {
+		lines = append(lines, fmt.Sprintf(
+			`{"uuid":"%d","@timestamp":%q,"service":%q,"severity":"info","message":"hello"}`,
+			i, timestamp.UTC().Format(time.RFC3339), service,
+		))
+	}
+
+	filename := r.ActiveLogFiles()[0]
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+}
+
+func TestRates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := &repository.LogRepository{LogDirectories: []string{dir}}
+	now := time.Now().UTC()
+
+	// Events before the lookback are not counted
+	writeLogFile(t, r, now.Add(-time.Minute), "service.foo", "service.foo", "service.foo", "service.foo", "service.bar")
+	assert.NilError(t, ioutil.WriteFile(
+		filepath.Join(dir, fmt.Sprintf("messages-%s", now.AddDate(0, 0, -1).Format("2006-01-02"))),
+		[]byte(fmt.Sprintf(`{"uuid":"old","@timestamp":%q,"service":"service.old","severity":"info","message":"hello"}`+"\n", now.AddDate(0, 0, -1).Format(time.RFC3339))),
+		0644,
+	))
+
+	s := &Sampler{
+		LogRepository: r,
+		Lookback:      2 * time.Minute,
+	}
+
+	rates, err := s.rates(now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rates, map[string]float64{
+		"service.foo": 2,
+		"service.bar": 0.5,
+	})
+
+	// A service that stops logging drops to zero
+	writeLogFile(t, r, now.Add(-time.Minute), "service.foo")
+	rates, err = s.rates(now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rates, map[string]float64{
+		"service.foo": 0.5,
+		"service.bar": 0,
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/config"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/live"
+)
+
+// liveSettings are the settings that are reloaded when the service receives
+// SIGHUP, without a restart that would disconnect every streaming client:
+//
+//	logLevel            the minimum severity of the service's own logs
+//	severityNames       names of custom severities, e.g. "15=notice"
+//	allowedOrigins      origins that browsers may stream events from
+//	defaultWindow       how far back to read if no since_time is given
+//	maxSubscribers      the most streaming clients at once
+//	maxEventsPerSecond  the rate limit of new streaming clients
+//	retention           how long log files are kept for
+//
+// Every other setting only takes effect after a restart.
+type liveSettings struct {
+	logLevel      slog.Severity // Zero if not set, leaving the level as it is
+	severityNames map[slog.Severity]string
+	settings      *live.Settings
+}
+
+// parseLiveSettings reads the live settings from the config. Nothing is
+// returned unless every setting is valid so that a mistake in the config
+// does not leave the service with some of its settings changed.
+func parseLiveSettings(c config.Provider) (s *liveSettings, err error) {
+	// Values of the wrong type make the config panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	s = &liveSettings{
+		settings: &live.Settings{
+			AllowedOrigins:     parseList(c.Get("allowedOrigins").String()),
+			MaxSubscribers:     c.Get("maxSubscribers").Int(0),
+			MaxEventsPerSecond: c.Get("maxEventsPerSecond").Int(0),
+		},
+	}
+
+	if s.severityNames, err = parseSeverityNames(c.Get("severityNames").String()); err != nil {
+		return nil, fmt.Errorf("invalid severityNames: %v", err)
+	}
+
+	// The level can be one of the names from the same config
+	if level := c.Get("logLevel").String(); level != "" {
+		if s.logLevel, err = slog.ParseSeverityWithNames(level, s.severityNames); err != nil {
+			return nil, fmt.Errorf("invalid logLevel: %v", err)
+		}
+	}
+
+	if s.settings.DefaultWindow, err = time.ParseDuration(c.Get("defaultWindow").String("1h")); err != nil {
+		return nil, fmt.Errorf("invalid defaultWindow: %v", err)
+	}
+
+	if s.settings.Retention, err = time.ParseDuration(c.Get("retention").String("720h")); err != nil {
+		return nil, fmt.Errorf("invalid retention: %v", err)
+	}
+
+	return s, nil
+}
+
+// reloader applies the live settings to the running service. The settings
+// are stored as one value, shared by the components that use them, so that
+// a request never sees some of the old settings and some of the new ones.
+type reloader struct {
+	settings *live.Value
+}
+
+// apply changes the service's live settings to those in the config
+func (r *reloader) apply(c config.Provider) error {
+	s, err := parseLiveSettings(c)
+	if err != nil {
+		return err
+	}
+
+	if s.logLevel != 0 {
+		slog.SetLevel(s.logLevel)
+	}
+	slog.SetSeverityNames(s.severityNames)
+	r.settings.Store(s.settings)
+	return nil
+}
+
+// run reloads the config with load and applies it each time a signal is
+// received until sig is closed. The running settings are kept if the config
+// cannot be loaded or is invalid.
+func (r *reloader) run(sig <-chan os.Signal, load func() (config.Provider, error)) {
+	for s := range sig {
+		slog.Info("Received %v signal, reloading config", s)
+
+		c, err := load()
+		if err != nil {
+			slog.Error("Failed to reload config: %v", err)
+			continue
+		}
+
+		if err := r.apply(c); err != nil {
+			slog.Error("Failed to apply reloaded config: %v", err)
+			continue
+		}
+
+		slog.Info("Reloaded config")
+	}
+}
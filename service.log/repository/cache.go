@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/metrics"
+)
+
+// resultCache holds the results of recent queries, evicting the least
+// recently used results once they hold more than max events in total
+type resultCache struct {
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // Of *resultCacheEntry, most recently used first
+	events  int
+}
+
+type resultCacheEntry struct {
+	key    string
+	result *FindResult
+}
+
+// get returns a copy of the result that is cached for the key
+func (c *resultCache) get(key string) (*FindResult, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		metrics.QueryCacheMisses.Inc()
+		return nil, false
+	}
+
+	metrics.QueryCacheHits.Inc()
+	c.lru.MoveToFront(e)
+	return copyResult(e.Value.(*resultCacheEntry).result), true
+}
+
+// put caches a copy of the result for the key unless it has more than max events
+func (c *resultCache) put(key string, result *FindResult, max int) {
+	if len(result.Events) > max {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]*list.Element{}
+	}
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	c.entries[key] = c.lru.PushFront(&resultCacheEntry{key: key, result: copyResult(result)})
+	c.events += len(result.Events)
+
+	for c.events > max {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *resultCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*resultCacheEntry)
+	delete(c.entries, entry.key)
+	c.events -= len(entry.result.Events)
+}
+
+// copyResult returns a copy of the result with copies of its events so that
+// callers can change the events, e.g. their time zones, without affecting
+// the cache. The events' fields, metadata and raw lines are shared.
+func copyResult(result *FindResult) *FindResult {
+	c := *result
+	c.Events = make([]*domain.Event, len(result.Events))
+	for i, event := range result.Events {
+		e := *event
+		c.Events[i] = &e
+	}
+	return &c
+}
+
+// cacheKey returns the key of the query's results in the result cache.
+// Queries that differ only in ways that do not change their results,
+// such as the order of their services, have the same key. The query's
+// results can only be cached if its time window has ended.
+func cacheKey(q *LogQuery) (string, bool) {
+	if q.UntilTime.IsZero() || !q.UntilTime.Before(time.Now()) || q.Tail > 0 {
+		return "", false
+	}
+
+	k := *q
+	k.MessageRegexp = nil
+	k.Message = strings.ToLower(k.Message)
+	k.Services = normaliseServices(k.Services)
+	k.ExcludeServices = normaliseServices(k.ExcludeServices)
+	k.SinceTime = k.SinceTime.UTC()
+	k.UntilTime = k.UntilTime.UTC()
+
+	b, err := json.Marshal(&k)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// normaliseServices returns a sorted copy of the service patterns in
+// lower case because they are matched without regard to case
+func normaliseServices(services []string) []string {
+	if len(services) == 0 {
+		return nil
+	}
+
+	n := make([]string, len(services))
+	for i, s := range services {
+		n[i] = strings.ToLower(s)
+	}
+	sort.Strings(n)
+	return n
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/service.log/domain"
+
+	"gotest.tools/assert"
+)
+
+func TestFindCachesEndedWindow(t *testing.T) {
+	then := time.Now().UTC().Add(-2 * time.Hour)
+	r, cleanup := newTestRepository(t, lineAt("1", then), lineAt("2", then.Add(time.Second)))
+	defer cleanup()
+	r.CacheEvents = 10
+
+	q := &LogQuery{
+		Services:  []string{"service.foo", "service.bar"},
+		SinceTime: then.Add(-time.Hour),
+		UntilTime: then.Add(time.Hour),
+	}
+	assert.DeepEqual(t, uuids(t, r, q), []string{"1", "2"})
+
+	// Changing the events that are returned does not change the cache
+	events, err := r.Find(context.Background(), q)
+	assert.NilError(t, err)
+	events[0].UUID = "changed"
+
+	// The files are not read again for the same query, even if it is
+	// written differently, so the events are found after the file is gone
+	assert.NilError(t, os.Remove(r.ActiveLogFiles()[0]))
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{
+		Services:  []string{"SERVICE.BAR", "service.foo"},
+		SinceTime: q.SinceTime.In(time.FixedZone("UTC+1", 3600)),
+		UntilTime: q.UntilTime,
+	}), []string{"1", "2"})
+
+	// A different query is not cached
+	assert.Equal(t, len(uuids(t, r, &LogQuery{SinceTime: q.SinceTime, UntilTime: q.UntilTime})), 0)
+
+	// Neither is a window that has not ended
+	q.UntilTime = time.Now().Add(time.Hour)
+	assert.Equal(t, len(uuids(t, r, q)), 0)
+}
+
+func TestResultCacheEvicts(t *testing.T) {
+	c := &resultCache{}
+	result := func(uuids ...string) *FindResult {
+		result := &FindResult{}
+		for _, uuid := range uuids {
+			result.Events = append(result.Events, &domain.Event{UUID: uuid})
+		}
+		return result
+	}
+
+	c.put("a", result("1", "2"), 4)
+	c.put("b", result("3"), 4)
+
+	// Using a makes b the least recently used
+	_, ok := c.get("a")
+	assert.Assert(t, ok)
+
+	c.put("c", result("4", "5"), 4)
+	_, ok = c.get("b")
+	assert.Assert(t, !ok)
+	_, ok = c.get("a")
+	assert.Assert(t, ok)
+	_, ok = c.get("c")
+	assert.Assert(t, ok)
+	assert.Equal(t, c.events, 4)
+
+	// A result that could never fit is not cached
+	c.put("d", result("6", "7", "8", "9", "10"), 4)
+	_, ok = c.get("d")
+	assert.Assert(t, !ok)
+	assert.Equal(t, c.events, 4)
+}
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+)
+
+// Operators that a FieldFilter can compare a field's value with
+const (
+	OpEqual          = "="
+	OpGreater        = ">"
+	OpGreaterOrEqual = ">="
+	OpLess           = "<"
+	OpLessOrEqual    = "<="
+)
+
+// FieldFilter is a condition on the value of one of an event's fields
+type FieldFilter struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// ParseFieldFilter parses a condition such as "status=failed" or
+// "duration_ms>500". Spaces around the key and value are removed.
+func ParseFieldFilter(s string) (FieldFilter, error) {
+	i := strings.IndexAny(s, "<>=")
+	if i < 0 {
+		return FieldFilter{}, errors.BadRequest("invalid field %q, expected a key, an operator and a value", s)
+	}
+
+	op := s[i : i+1]
+	if op != OpEqual && strings.HasPrefix(s[i+1:], "=") {
+		op += "="
+	}
+
+	f := FieldFilter{
+		Key:   strings.TrimSpace(s[:i]),
+		Op:    op,
+		Value: strings.TrimSpace(s[i+len(op):]),
+	}
+	if f.Key == "" {
+		return FieldFilter{}, errors.BadRequest("invalid field %q, the key is empty", s)
+	}
+
+	return f, nil
+}
+
+// String returns the filter in the form parsed by ParseFieldFilter
+func (f FieldFilter) String() string {
+	return f.Key + f.Op + f.Value
+}
+
+// matches returns whether the fields have a value for the filter's key that
+// satisfies it. The values are compared as numbers if they both are numbers.
+// Otherwise, only OpEqual can match and the values are compared as strings.
+func (f FieldFilter) matches(fields map[string]string) bool {
+	v, ok := fields[f.Key]
+	if !ok {
+		return false
+	}
+
+	got, gotErr := strconv.ParseFloat(v, 64)
+	want, wantErr := strconv.ParseFloat(f.Value, 64)
+	if gotErr != nil || wantErr != nil {
+		return f.Op == OpEqual && v == f.Value
+	}
+
+	switch f.Op {
+	case OpEqual:
+		return got == want
+	case OpGreater:
+		return got > want
+	case OpGreaterOrEqual:
+		return got >= want
+	case OpLess:
+		return got < want
+	case OpLessOrEqual:
+		return got <= want
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseFieldFilter(t *testing.T) {
+	tests := []struct {
+		in   string
+		want FieldFilter
+	}{
+		{"status=failed", FieldFilter{"status", OpEqual, "failed"}},
+		{" duration_ms > 500 ", FieldFilter{"duration_ms", OpGreater, "500"}},
+		{"status_code>=400", FieldFilter{"status_code", OpGreaterOrEqual, "400"}},
+		{"retries<3", FieldFilter{"retries", OpLess, "3"}},
+		{"retries<=3", FieldFilter{"retries", OpLessOrEqual, "3"}},
+		{"query=a=b", FieldFilter{"query", OpEqual, "a=b"}},
+		{"empty=", FieldFilter{"empty", OpEqual, ""}},
+	}
+
+	for _, tc := range tests {
+		got, err := ParseFieldFilter(tc.in)
+		assert.NilError(t, err)
+		assert.Equal(t, got, tc.want)
+	}
+
+	for _, in := range []string{"status", "=failed", ">500"} {
+		_, err := ParseFieldFilter(in)
+		assert.ErrorContains(t, err, "invalid field")
+	}
+}
+
+func TestFieldFilterMatches(t *testing.T) {
+	fields := map[string]string{
+		"duration_ms": "750",
+		"status_code": "404",
+		"status":      "failed",
+		"version":     "1.10",
+	}
+
+	tests := []struct {
+		filter FieldFilter
+		want   bool
+	}{
+		{FieldFilter{"duration_ms", OpGreater, "500"}, true},
+		{FieldFilter{"duration_ms", OpGreater, "750"}, false},
+		{FieldFilter{"duration_ms", OpGreaterOrEqual, "750"}, true},
+		{FieldFilter{"status_code", OpLess, "500"}, true},
+		{FieldFilter{"status_code", OpLessOrEqual, "403"}, false},
+		{FieldFilter{"status_code", OpEqual, "404.0"}, true},
+		{FieldFilter{"version", OpEqual, "1.1"}, true},
+		{FieldFilter{"status", OpEqual, "failed"}, true},
+		{FieldFilter{"status", OpGreater, "a"}, false},
+		{FieldFilter{"status_code", OpGreater, "abc"}, false},
+		{FieldFilter{"missing", OpEqual, ""}, false},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.filter.matches(fields), tc.want, tc.filter.String())
+	}
+}
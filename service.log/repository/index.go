@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+)
+
+// indexInterval is the approximate number of bytes between index entries
+const indexInterval = 64 * 1024
+
+// indexEntry records the timestamp of the event that starts at offset
+type indexEntry struct {
+	offset    int64
+	timestamp time.Time
+}
+
+// fileIndex maps byte offsets in a log file to the timestamps of the events
+// at those offsets so that reads can start near the beginning of a time window.
+// It is only valid for the version of the file with the same modTime and size.
+type fileIndex struct {
+	modTime time.Time
+	size    int64
+	entries []indexEntry
+}
+
+// indexCache holds the index of each log file that has been read
+type indexCache struct {
+	mux     sync.Mutex
+	indexes map[string]*fileIndex
+}
+
+// get returns the index for the file, or nil if there is no index
+// or the file has changed since the index was built
+func (c *indexCache) get(filename string, info os.FileInfo) *fileIndex {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	idx, ok := c.indexes[filename]
+	if !ok || !idx.modTime.Equal(info.ModTime()) || idx.size != info.Size() {
+		return nil
+	}
+
+	return idx
+}
+
+func (c *indexCache) put(filename string, idx *fileIndex) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.indexes == nil {
+		c.indexes = map[string]*fileIndex{}
+	}
+
+	c.indexes[filename] = idx
+}
+
+// offsetBefore returns the offset of the last indexed event
+// before since. Reading from here will include every event
+// at or after since, assuming the file is in time order.
+func (idx *fileIndex) offsetBefore(since time.Time) int64 {
+	if since.IsZero() {
+		return 0
+	}
+
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return !idx.entries[i].timestamp.Before(since)
+	})
+
+	if i == 0 {
+		return 0
+	}
+
+	return idx.entries[i-1].offset
+}
+
+// buildIndex samples the start of an event roughly every indexInterval bytes
+func (r *LogRepository) buildIndex(data []byte, info os.FileInfo) *fileIndex {
+	start := r.eventStart()
+	idx := &fileIndex{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+
+	var offset, next int64
+	for len(data) > 0 {
+		line := data
+		n := bytes.IndexByte(data, '\n')
+		if n >= 0 {
+			line = data[:n]
+			data = data[n+1:]
+		} else {
+			data = nil
+		}
+
+		if offset >= next && len(line) > 0 && start.Match(line) {
+			if t := r.parseLine(line).Timestamp; !t.IsZero() {
+				idx.entries = append(idx.entries, indexEntry{offset, t})
+				next = offset + indexInterval
+			}
+		}
+
+		offset += int64(len(line)) + 1
+	}
+
+	return idx
+}
+
+// indexableFile is a file that can be indexed, such as an *os.File
+type indexableFile interface {
+	io.ReadSeeker
+	Stat() (os.FileInfo, error)
+}
+
+// readFile returns the contents of the log file. If the file has been indexed,
+// reading starts from the last indexed event before since. Otherwise, the
+// whole file is read and an index is built for subsequent reads.
+func (r *LogRepository) readFile(filename string, since time.Time) ([]byte, error) {
+	f, err := r.store().Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Compressed files cannot be seeked so are not indexed
+	file, ok := f.(indexableFile)
+	if !ok {
+		return readAll(f)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, nil)
+	}
+
+	if idx := r.index.get(filename, info); idx != nil {
+		if _, err := file.Seek(idx.offsetBefore(since), io.SeekStart); err != nil {
+			return nil, errors.Wrap(err, nil)
+		}
+		return readAll(file)
+	}
+
+	data, err := readAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	r.index.put(filename, r.buildIndex(data, info))
+	return data, nil
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, nil)
+	}
+	return data, nil
+}
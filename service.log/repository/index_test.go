@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestFindUsesIndex(t *testing.T) {
+	// Enough events to span several index entries
+	start := time.Now().UTC().Truncate(24 * time.Hour)
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, fmt.Sprintf(
+			`{"uuid":"%d","@timestamp":%q,"service":"service.foo","severity":"info","message":%q}`,
+			i, start.Add(time.Duration(i)*time.Second).Format(time.RFC3339), strings.Repeat("x", 100),
+		))
+	}
+
+	r, cleanup := newTestRepository(t, lines...)
+	defer cleanup()
+	filename := filepath.Join(r.LogDirectories[0], fmt.Sprintf("messages-%s", start.Format("2006-01-02")))
+
+	since := start.Add(1990 * time.Second)
+	got := uuids(t, r, &LogQuery{SinceTime: since})
+	assert.Equal(t, len(got), 10)
+
+	// The first read builds the index
+	info, err := os.Stat(filename)
+	assert.NilError(t, err)
+	idx := r.index.get(filename, info)
+	assert.Assert(t, idx != nil)
+	assert.Assert(t, len(idx.entries) > 1)
+	assert.Assert(t, idx.offsetBefore(since) > 0)
+
+	// Subsequent reads seek and return the same events
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{SinceTime: since}), got)
+	assert.Equal(t, len(uuids(t, r, &LogQuery{})), 2000)
+}
+
+func TestIndexInvalidatedOnChange(t *testing.T) {
+	r, cleanup := newTestRepository(t, line("1", "service.foo", "info", "a"))
+	defer cleanup()
+	filename := filepath.Join(r.LogDirectories[0], fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{}), []string{"1"})
+
+	err := ioutil.WriteFile(filename, []byte(line("2", "service.foo", "info", "b")+"\n"), 0644)
+	assert.NilError(t, err)
+	assert.NilError(t, os.Chtimes(filename, time.Now(), time.Now().Add(time.Minute)))
+
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{}), []string{"2"})
+}
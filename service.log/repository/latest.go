@@ -0,0 +1,143 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"os"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/service.log/domain"
+)
+
+// latestTailBytes is how much of the end of each active log
+// file Latest reads before falling back to a full search
+const latestTailBytes = 64 * 1024
+
+// Latest returns the newest event that matches the query, or nil if there
+// are no matching events. It is intended to be polled to find out whether
+// there are new events, so usually only the end of each of today's log files
+// is read. Limit, Offset, Tail, Reverse and Dedupe are ignored.
+func (r *LogRepository) Latest(ctx context.Context, q *LogQuery) (*domain.Event, error) {
+	tq := *q
+	tq.Limit = 1
+	tq.Offset = 0
+	tq.Tail = 0
+	tq.Reverse = true
+	tq.Dedupe = false
+	tq.CountTotal = false
+
+	if ok, err := tq.prepare(); err != nil || !ok {
+		return nil, err
+	}
+
+	// The events with SinceUUID and UntilUUID need finding first
+	if tq.SinceUUID != "" || tq.UntilUUID != "" {
+		return r.first(ctx, &tq)
+	}
+
+	// The newest event in the end of any of the active files is the newest
+	// event overall, unless another file may have a newer match before its end
+	var latest *domain.Event
+	conclusive := true
+	for _, filename := range r.ActiveLogFiles() {
+		result, err := r.findInTail(ctx, filename, &tq)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case result.newest != nil:
+			if event := result.newest; latest == nil || latest.Before(event) {
+				latest = event
+			}
+		case !result.done:
+			conclusive = false
+		}
+	}
+
+	if latest != nil && conclusive {
+		return latest, nil
+	}
+
+	return r.first(ctx, &tq)
+}
+
+// first returns the first event that Find returns, or nil if there are none
+func (r *LogRepository) first(ctx context.Context, q *LogQuery) (*domain.Event, error) {
+	events, err := r.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	return events[0], nil
+}
+
+// findInTail looks for the newest event that matches the query in the last
+// latestTailBytes of the file. The result is done if the whole file has been
+// searched or an event before the query's window was found.
+func (r *LogRepository) findInTail(ctx context.Context, filename string, q *LogQuery) (*fileResult, error) {
+	size, err := r.store().Size(filename)
+	if os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.MarkRetryable(err, map[string]string{"filename": filename})
+	}
+
+	offset := size - latestTailBytes
+	if offset < 0 {
+		offset = 0
+	}
+
+	data, err := r.store().ReadFrom(filename, offset)
+	if os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.MarkRetryable(err, map[string]string{"filename": filename})
+	}
+
+	// The read probably started part way through an event so skip to the
+	// first line that starts one. If the partial event would have been the
+	// only match, the result is not done and Latest falls back to Find.
+	if offset > 0 {
+		start := r.eventStart()
+		for len(data) > 0 {
+			n := bytes.IndexByte(data, '\n')
+			if n < 0 {
+				data = nil
+				break
+			}
+			data = data[n+1:]
+
+			line := data
+			if n := bytes.IndexByte(data, '\n'); n >= 0 {
+				line = data[:n]
+			}
+			if start.Match(line) {
+				break
+			}
+		}
+	}
+
+	groups := r.splitGroups(data)
+	result := r.matchGroups(ctx, filename, groups, q, 1)
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	if offset == 0 {
+		result.done = true
+		return result, nil
+	}
+
+	// Events before the tail at the same time as the newest event could
+	// come after it, in which case Latest falls back to Find
+	if result.newest != nil && !result.done && r.newEvent(groups[0]).Timestamp.Equal(result.newest.Timestamp) {
+		return &fileResult{}, nil
+	}
+
+	return result, nil
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestLatest(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.bar", "info", "b"),
+		line("3", "service.foo", "info", "c"),
+		line("4", "service.bar", "info", "d"),
+	)
+	defer cleanup()
+
+	event, err := r.Latest(context.Background(), &LogQuery{Services: []string{"service.foo"}})
+	assert.NilError(t, err)
+	assert.Equal(t, event.UUID, "3")
+
+	// Pagination options are ignored
+	event, err = r.Latest(context.Background(), &LogQuery{Limit: 3, Offset: 2})
+	assert.NilError(t, err)
+	assert.Equal(t, event.UUID, "4")
+
+	event, err = r.Latest(context.Background(), &LogQuery{Services: []string{"service.baz"}})
+	assert.NilError(t, err)
+	assert.Assert(t, event == nil)
+}
+
+func TestLatestBeforeTail(t *testing.T) {
+	// The only matching event is followed by more than the tail that is read
+	lines := []string{line("match", "service.foo", "info", "a")}
+	filler := strings.Repeat("x", 1000)
+	for i := 0; len(lines)*len(filler) < 2*latestTailBytes; i++ {
+		lines = append(lines, line(fmt.Sprintf("filler-%d", i), "service.bar", "info", filler))
+	}
+
+	r, cleanup := newTestRepository(t, lines...)
+	defer cleanup()
+
+	event, err := r.Latest(context.Background(), &LogQuery{Services: []string{"service.foo"}})
+	assert.NilError(t, err)
+	assert.Equal(t, event.UUID, "match")
+
+	// The events are all at the same time so the newest is the one with the
+	// greatest UUID, which is before the tail
+	event, err = r.Latest(context.Background(), &LogQuery{})
+	assert.NilError(t, err)
+	assert.Equal(t, event.UUID, "match")
+}
+
+func TestLatestMissingFile(t *testing.T) {
+	r, cleanup := newTestRepository(t)
+	defer cleanup()
+	assert.NilError(t, os.Remove(r.ActiveLogFiles()[0]))
+
+	event, err := r.Latest(context.Background(), &LogQuery{})
+	assert.NilError(t, err)
+	assert.Assert(t, event == nil)
+}
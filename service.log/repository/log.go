@@ -2,35 +2,171 @@ package repository
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jakewright/home-automation/libraries/go/errors"
 	"github.com/jakewright/home-automation/libraries/go/slog"
 	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/metrics"
 )
 
+// DefaultEventStart matches lines that start a new event. These are
+// either JSON objects written by logstash or start with a timestamp.
+var DefaultEventStart = regexp.MustCompile(`^(\{|\d{4}-\d{2}-\d{2})`)
+
+// DefaultMaxResults is used if LogRepository.MaxResults is not set
+const DefaultMaxResults = 50000
+
+// DefaultWorkers is used if LogRepository.Workers is not set
+const DefaultWorkers = 4
+
+// ErrCancelled is the code of the error returned when a
+// query is abandoned because its context was cancelled
+const ErrCancelled = "cancelled"
+
+// cancelCheckInterval is the number of events that are
+// read from a file between checks of the query's context
+const cancelCheckInterval = 1000
+
 // LogRepository provides a query interface to the log file
 type LogRepository struct {
-	// LogDirectory is the path to the directory containing daily log files
-	LogDirectory string
+	// LogDirectories are the paths to the directories containing daily
+	// log files. Events from every directory are merged by timestamp.
+	LogDirectories []string
+
+	// File is a single log file to read instead of the daily log files in
+	// LogDirectories, e.g. to query an arbitrary file with the same parsing
+	// and filtering as the service. It can contain events from any number
+	// of days. A repository with a File cannot be watched or purged.
+	File string
+
+	// Store is where the log files are read from. If nil, they are read
+	// from the filesystem by a FileLogStore of LogDirectories and File.
+	Store LogStore
+
+	// MaxResults is the most events that Find will read into memory
+	// before it stops and marks the result as truncated. This protects
+	// against very broad queries. Defaults to DefaultMaxResults.
+	MaxResults int
+
+	// EventStart matches lines that start a new event. Any line that
+	// does not match, such as a line in a stack trace, is appended to
+	// the message of the event before it. Defaults to LineFormat if it
+	// is set, otherwise DefaultEventStart.
+	EventStart *regexp.Regexp
+
+	// LineFormat parses lines that are not written by logstash, e.g.
+	// from legacy services. Its named groups "timestamp", "severity",
+	// "service" and "message" are used for the values of each event.
+	// If nil, lines are parsed as JSON objects written by logstash.
+	LineFormat *regexp.Regexp
+
+	// TimestampLayout is the Go time layout of the "timestamp" group
+	// in LineFormat. Defaults to domain.DefaultTimestampLayout.
+	TimestampLayout string
+
+	// Workers is the number of days of log files that Find
+	// reads concurrently. Defaults to DefaultWorkers.
+	Workers int
+
+	// CacheEvents is the most events to keep in memory from the results
+	// of queries whose time window has ended, so that repeating one does
+	// not read the log files again. The least recently used results are
+	// evicted first. Events that are written with a timestamp in a window
+	// after it has ended are not seen until its results are evicted. If
+	// zero, results are not cached.
+	CacheEvents int
+
+	// index caches the timestamp index of each log file
+	index indexCache
+
+	// positions caches where the newest events returned by FindSince are
+	positions positionCache
+
+	// cache holds the results of recent queries
+	cache resultCache
+}
+
+// NewLogRepository returns a LogRepository that reads the daily
+// log files in each of the directories
+func NewLogRepository(logDirectories ...string) *LogRepository {
+	return &LogRepository{LogDirectories: logDirectories}
+}
+
+// NewFileRepository returns a LogRepository that reads the single log
+// file, which is decompressed if its name has a ".gz" suffix
+func NewFileRepository(filename string) *LogRepository {
+	return &LogRepository{File: filename}
 }
 
 // LogQuery is a set of conditions to apply when finding events
 type LogQuery struct {
 	// Services is a slice of service name patterns to filter by.
 	// If the slice is empty, then events from all services will
-	// be returned. Patterns may end with a wildcard "*" character.
+	// be returned. Patterns may contain wildcard "*" characters, e.g.
+	// "sensor.*" or "*.kitchen", and are otherwise matched exactly.
 	Services []string
 
+	// ExcludeServices is a slice of service name patterns to exclude.
+	// Patterns are matched in the same way as Services. If a service
+	// matches both Services and ExcludeServices, it is excluded.
+	ExcludeServices []string
+
 	// Severity is the minimum severity that events need to have.
-	// Set this to slog.Severity(0) to return all events.
+	// Set this to slog.Severity(0) to return all events. It is kept
+	// for older callers and is equivalent to setting MinSeverity.
 	Severity slog.Severity
 
+	// MinSeverity is the inclusive lower bound of the severity range.
+	// If both MinSeverity and Severity are set, the higher one is used.
+	MinSeverity slog.Severity
+
+	// MaxSeverity is the inclusive upper bound of the severity range.
+	// Set this to slog.Severity(0) to leave the range unbounded. If
+	// it is lower than the minimum, no events will be returned.
+	MaxSeverity slog.Severity
+
+	// Message is a string that the event's message must contain. The
+	// comparison is case-insensitive. Set to an empty string to
+	// return events regardless of their message.
+	Message string
+
+	// MessagePattern is a regular expression that the event's message
+	// must match. If both MessagePattern and Message are set, the
+	// pattern wins and the Message substring filter is ignored.
+	MessagePattern string
+
+	// MessageRegexp is the compiled form of MessagePattern. If it is
+	// nil, Find will compile MessagePattern itself on each call.
+	MessageRegexp *regexp.Regexp
+
+	// MessagePrefix is a string that the event's message must start
+	// with, e.g. "[HTTP]". The comparison is case-sensitive. Unlike
+	// Message and MessagePattern, it is cheap so it is checked first,
+	// and it applies as well as either of them.
+	MessagePrefix string
+
+	// SourceFile, if set, only matches events read from the log file
+	// with this path or base name, e.g. "messages-2019-01-01" or
+	// "tv.log". Rotated files keep the name they had before rotation.
+	SourceFile string
+
+	// TraceID, if set, only matches events with exactly this trace ID
+	TraceID string
+
+	// Fields are conditions that the event's fields, which are parsed
+	// from its message, must all satisfy, e.g. "duration_ms>500"
+	Fields []FieldFilter
+
 	// SinceTime is the earliest inclusive time that events should
 	// be from. Set to the zero value to return all events.
 	SinceTime time.Time
@@ -41,115 +177,774 @@ type LogQuery struct {
 
 	// SinceUUID is a UUID of an event. If not an empty string, only
 	// events that happened _after_ this event will be returned. The
-	// event with the given UUID itself will not be returned.
+	// event with the given UUID itself will not be returned unless
+	// SinceUUIDInclusive is set. Other events at the same time are only
+	// returned if they come after it in the order of domain.Event.Before,
+	// i.e. their UUID is greater, so that paging through events never
+	// skips or repeats any. If there is no event with this UUID in the
+	// time window, it is ignored.
 	SinceUUID string
 
+	// SinceUUIDInclusive returns the event with SinceUUID as well, if it
+	// matches the other conditions, to show an event and everything after
+	// it. The watcher always uses exclusive semantics, whatever the
+	// subscription's query says, because it resumes after the last event
+	// that was sent and must not send it again.
+	SinceUUIDInclusive bool
+
+	// UntilUUID is a UUID of an event. If not an empty string, only
+	// events that happened _before_ this event will be returned, so with
+	// SinceUUID it finds the events between two known events. Other
+	// events at the same time are only returned if their UUID is less
+	// than it. If there is no event with this UUID in the time window,
+	// no events will be returned.
+	UntilUUID string
+
+	// IncludeUntil returns the event with UntilUUID as well, if it
+	// matches the other conditions
+	IncludeUntil bool
+
 	// Reverse will change the order of the returned results. If false,
 	// events will be returned in chronological order, i.e. oldest first.
 	Reverse bool
+
+	// Limit is the maximum number of events to return. Set to
+	// zero to return all events that match the other conditions.
+	Limit int
+
+	// Offset is the number of matching events to skip before events
+	// start being returned. Events are counted from the newest event
+	// regardless of Reverse, so an offset of zero is the latest page.
+	Offset int
+
+	// Tail is the number of matching events to return from the end of
+	// the log. If greater than zero, the time window, Limit and Offset
+	// are ignored and only as many files are read as are needed.
+	Tail int
+
+	// CountTotal will set the Total of the result to the number of events
+	// that match the query, ignoring Limit and Offset. This means that every
+	// file in the time window is read, even if the page is filled early.
+	CountTotal bool
+
+	// Dedupe collapses each run of consecutive events with the same
+	// service and message into the newest event of the run, which has
+	// its RepeatCount set to the length of the run. Limit, Offset and
+	// CountTotal count the collapsed events.
+	Dedupe bool
+}
+
+// FindResult is the result of a query
+type FindResult struct {
+	// Events are the events that matched the query
+	Events []*domain.Event
+
+	// Truncated is true if there were more matching events than
+	// the repository's MaxResults, in which case only the newest
+	// MaxResults events are included.
+	Truncated bool
+
+	// Total is the number of events that matched the query, ignoring
+	// Limit and Offset. It is only set if the query's CountTotal is set
+	// and is not accurate if the result was truncated.
+	Total int
+}
+
+// Find returns all events that match the given query. Use FindWithMeta
+// to find out whether the events were truncated by MaxResults. If ctx is
+// cancelled, reading stops and an error with code ErrCancelled is returned.
+//
+// Errors reading a log file are marked as retryable (see errors.Retryable)
+// because they are usually caused by transient I/O problems. Invalid queries,
+// which are bad requests, and cancelled queries are not retryable.
+func (r *LogRepository) Find(ctx context.Context, q *LogQuery) ([]*domain.Event, error) {
+	result, err := r.FindWithMeta(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Events, nil
 }
 
-// Find returns all events that match the given query
-func (r *LogRepository) Find(q *LogQuery) ([]*domain.Event, error) {
-	events, err := r.findEvents(q)
+// FindWithMeta returns all events that match the given query along with
+// information about the result.
+func (r *LogRepository) FindWithMeta(ctx context.Context, q *LogQuery) (*FindResult, error) {
+	if q.Tail > 0 {
+		return r.tail(ctx, q)
+	}
+
+	if ok, err := q.prepare(); err != nil {
+		return nil, err
+	} else if !ok {
+		return &FindResult{}, nil
+	}
+
+	// The results of a window that has ended should not change
+	var key string
+	var cacheable bool
+	if r.CacheEvents > 0 {
+		key, cacheable = cacheKey(q)
+	}
+	if cacheable {
+		if result, ok := r.cache.get(key); ok {
+			return result, nil
+		}
+	}
+
+	q, err := r.boundUUIDs(ctx, q)
 	if err != nil {
 		return nil, err
+	} else if q == nil {
+		return &FindResult{}, nil
 	}
 
+	start := time.Now()
+	result, err := r.find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	metrics.FindDuration.WithLabelValues(strconv.FormatBool(result.Truncated)).Observe(time.Since(start).Seconds())
+
 	// This is counter-intuitive but it is correct
 	if !q.Reverse {
-		reverse(events)
+		reverse(result.Events)
 	}
 
-	return events, nil
+	if cacheable {
+		r.cache.put(key, result, r.CacheEvents)
+	}
+
+	return result, nil
 }
 
-func (r *LogRepository) findEvents(q *LogQuery) ([]*domain.Event, error) {
-	var events []*domain.Event
-	date := time.Now().UTC()
+// prepare compiles the message pattern once rather than per event.
+// It returns false if the query can never match any events.
+func (q *LogQuery) prepare() (bool, error) {
+	if q.MessagePattern != "" && q.MessageRegexp == nil {
+		re, err := regexp.Compile(q.MessagePattern)
+		if err != nil {
+			return false, errors.BadRequest("invalid message pattern: %v", err)
+		}
+		q.MessageRegexp = re
+	}
 
-	for {
-		filename := filepath.Join(r.LogDirectory, fmt.Sprintf("messages-%s", date.Format("2006-01-02")))
+	// An inverted severity range can never match anything
+	if q.MaxSeverity > 0 && q.minSeverity() > q.MaxSeverity {
+		return false, nil
+	}
 
-		lines, err := readLines(filename)
-		if err != nil {
-			// We expect to eventually find a file that does not exist so
-			// don't return an error, just return the events found so far.
-			if os.IsNotExist(err) {
-				return events, nil
-			}
+	return true, nil
+}
+
+// boundUUIDs returns a copy of the query that is also bounded by the times
+// of the events with its SinceUUID and UntilUUID, if they are set, or nil if
+// there is no UntilUUID event in the time window
+func (r *LogRepository) boundUUIDs(ctx context.Context, q *LogQuery) (*LogQuery, error) {
+	if q.UntilUUID != "" {
+		uq, err := r.boundUntil(ctx, q)
+		if err != nil || uq == nil {
+			return nil, err
+		}
+		q = uq
+	}
 
-			// Any other error is unexpected
+	if q.SinceUUID != "" {
+		since, err := r.findByUUID(ctx, q, q.SinceUUID)
+		if err != nil {
 			return nil, err
 		}
+		q = boundSince(q, since)
+	}
+
+	return q, nil
+}
+
+// boundUntil returns a copy of the query that is also bounded by the
+// time of the event with the query's UntilUUID, or nil if there is no
+// such event in the time window
+func (r *LogRepository) boundUntil(ctx context.Context, q *LogQuery) (*LogQuery, error) {
+	event, err := r.findByUUID(ctx, q, q.UntilUUID)
+	if err != nil || event == nil {
+		return nil, err
+	}
+
+	uq := *q
+	if uq.UntilTime.IsZero() || !event.Timestamp.After(uq.UntilTime) {
+		uq.UntilTime = event.Timestamp
+	} else {
+		// The time window already ends before the event
+		uq.UntilUUID = ""
+	}
+	return &uq, nil
+}
+
+// boundSince returns a copy of the query whose SinceTime is the time of the
+// since event, which must have the query's SinceUUID, so that only events
+// at exactly that time need comparing with it. SinceUUID is cleared if the
+// event is nil, because it is not in the time window, or the time window
+// already starts after it.
+func boundSince(q *LogQuery, since *domain.Event) *LogQuery {
+	sq := *q
+	if since != nil && (sq.SinceTime.IsZero() || !since.Timestamp.Before(sq.SinceTime)) {
+		sq.SinceTime = since.Timestamp
+	} else {
+		sq.SinceUUID = ""
+	}
+	return &sq
+}
 
-		// Iterate backwards so we process newer log lines first
-		for i := len(lines) - 1; i >= 0; i-- {
-			// Skip empty lines
-			if len(lines[i]) == 0 {
+// FindByUUID returns the event with the UUID, or nil if there is no such
+// event in the query's time window, e.g. because it has been purged. The
+// rest of the query's conditions are ignored.
+func (r *LogRepository) FindByUUID(ctx context.Context, q *LogQuery, uuid string) (*domain.Event, error) {
+	return r.findByUUID(ctx, q, uuid)
+}
+
+// findByUUID returns the event with the UUID, or nil if there is no
+// such event in the query's time window. Log files are searched newest
+// first because the event is usually recent.
+func (r *LogRepository) findByUUID(ctx context.Context, q *LogQuery, uuid string) (*domain.Event, error) {
+	for _, filenames := range r.daysInWindow(q) {
+		for _, filename := range filenames {
+			groups, err := r.readGroups(filename, time.Time{})
+			if os.IsNotExist(err) {
+				// The file could have been purged since the list was made
 				continue
+			} else if err != nil {
+				return nil, errors.MarkRetryable(err, map[string]string{"filename": filename})
 			}
 
-			event := domain.NewEventFromBytes(lines[i])
+			// The event is probably near the end so search backwards
+			for i := len(groups) - 1; i >= 0; i-- {
+				if (len(groups)-1-i)%cancelCheckInterval == 0 {
+					if err := cancelled(ctx); err != nil {
+						return nil, err
+					}
+				}
 
-			// Filter by severity
-			if event.Severity < q.Severity {
-				continue
+				// Only lines written by logstash contain the UUID
+				// so only they can be skipped without parsing
+				if r.LineFormat == nil && !bytes.Contains(groups[i][0], []byte(uuid)) {
+					continue
+				}
+
+				if event := r.newEvent(groups[i]); event.UUID == uuid {
+					return event, nil
+				}
 			}
+		}
+	}
+
+	return nil, nil
+}
+
+// tail returns the newest q.Tail events that match the rest of the query.
+// Files are read newest first so reading stops as soon as there are enough.
+func (r *LogRepository) tail(ctx context.Context, q *LogQuery) (*FindResult, error) {
+	return r.FindWithMeta(ctx, tailQuery(q))
+}
+
+// tailQuery returns a copy of the query that finds the newest q.Tail
+// events, regardless of the time window, as a Limit
+func tailQuery(q *LogQuery) *LogQuery {
+	tq := *q
+	tq.SinceTime = time.Time{}
+	tq.UntilTime = time.Time{}
+	tq.Limit = q.Tail
+	tq.Offset = 0
+	tq.Tail = 0
+	return &tq
+}
+
+// DistinctServices returns the names of all services that have events
+// between since and until, sorted alphabetically. Every event in the time
+// window is read, one day at a time, so the list is not limited by MaxResults.
+func (r *LogRepository) DistinctServices(ctx context.Context, since, until time.Time) ([]string, error) {
+	seen := map[string]bool{}
+	var services []string
+
+	err := r.FindStream(ctx, &LogQuery{
+		SinceTime: since,
+		UntilTime: until,
+		Reverse:   true,
+	}, func(event *domain.Event) error {
+		if event.Service != "" && !seen[event.Service] {
+			seen[event.Service] = true
+			services = append(services, event.Service)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(services)
+	return services, nil
+}
+
+// DistinctFieldValues returns the number of events that match the query for
+// each value of the named field. Events that do not have the field are ignored.
+func (r *LogRepository) DistinctFieldValues(ctx context.Context, field string, q *LogQuery) (map[string]int, error) {
+	events, err := r.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]int{}
+	for _, event := range events {
+		if v, ok := event.Fields[field]; ok {
+			values[v]++
+		}
+	}
+
+	return values, nil
+}
+
+// LogFiles returns the paths of all log files in the log
+// directories, including any that have been rotated
+func (r *LogRepository) LogFiles() ([]string, error) {
+	return r.store().List()
+}
+
+// ActiveLogFiles returns the paths of the log files that are
+// currently being written to, one in each log directory
+func (r *LogRepository) ActiveLogFiles() []string {
+	return r.logFiles(time.Now().UTC())
+}
+
+// NewestEventTime returns the timestamp of the last event in the log
+// file. The zero time is returned if the file contains no events.
+func (r *LogRepository) NewestEventTime(filename string) (time.Time, error) {
+	groups, err := r.readGroups(filename, time.Time{})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// Find the last event with a timestamp, ignoring any that failed to parse
+	for i := len(groups) - 1; i >= 0; i-- {
+		if t := r.newEvent(groups[i]).Timestamp; !t.IsZero() {
+			return t, nil
+		}
+	}
 
-			// Filter by service
-			if len(q.Services) > 0 && !containsService(q.Services, event.Service) {
+	return time.Time{}, nil
+}
+
+// find returns the events that match the query, newest first. Only the newest
+// MaxResults events are kept, in which case the result is truncated.
+func (r *LogRepository) find(ctx context.Context, q *LogQuery) (*FindResult, error) {
+	maxResults := r.maxResults()
+
+	// Counting reads every event so the page is found here instead.
+	// Otherwise, one event more than can be kept shows truncation.
+	pq := *q
+	perFile := math.MaxInt32
+	if q.CountTotal {
+		pq.Offset = 0
+		pq.Limit = 0
+	} else if q.Limit > 0 && q.Limit <= maxResults {
+		perFile = r.perFile(q, q.Limit)
+	} else {
+		perFile = r.perFile(q, maxResults+1)
+	}
+
+	result := &FindResult{}
+	var skipped int
+
+	it := r.iterate(ctx, &pq, true, perFile)
+	for it.Next() {
+		if q.CountTotal {
+			result.Total++
+
+			// Skip events until the offset is reached and only count
+			// the rest of the events once the page is full
+			if skipped < q.Offset {
+				skipped++
+				continue
+			}
+			if q.Limit > 0 && len(result.Events) >= q.Limit {
 				continue
 			}
+		}
+
+		// Stop reading if there are too many events to hold in memory
+		if len(result.Events) >= maxResults {
+			result.Truncated = true
+			break
+		}
+
+		result.Events = append(result.Events, it.Event())
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
 
-			// Filter by time
-			if !q.UntilTime.IsZero() && event.Timestamp.After(q.UntilTime) {
+	return result, nil
+}
+
+// fileResult is the set of matching events in a single log file
+type fileResult struct {
+	events []*domain.Event
+
+	// newest is the newest of the events in the order of domain.Event.Before
+	// and newestGroup is the index of the group that it was parsed from
+	newest      *domain.Event
+	newestGroup int
+
+	// done is true if older files do not need to be read
+	done bool
+	err  error
+}
+
+// findInFile returns up to max events from the file that match the query,
+// newest first, along with any more at the same time as the oldest of them.
+// Offset and limit are not applied.
+func (r *LogRepository) findInFile(ctx context.Context, filename string, q *LogQuery, max int) *fileResult {
+	groups, err := r.readGroups(filename, q.SinceTime)
+	if os.IsNotExist(err) {
+		// This is expected so it is left for the caller to handle
+		return &fileResult{err: err}
+	} else if err != nil {
+		// Reading a file that exists usually fails for a transient reason
+		return &fileResult{err: errors.MarkRetryable(err, map[string]string{"filename": filename})}
+	}
+
+	return r.matchGroups(ctx, filename, groups, q, max)
+}
+
+// matchGroups returns up to max events, parsed from the groups of lines of
+// the file, that match the query, newest first, along with any more at the
+// same time as the oldest of them.
+func (r *LogRepository) matchGroups(ctx context.Context, filename string, groups [][][]byte, q *LogQuery, max int) *fileResult {
+	result := &fileResult{}
+
+	// Iterate backwards so we process newer log lines first
+	for i := len(groups) - 1; i >= 0; i-- {
+		// Give up promptly if nobody is waiting for the result
+		if (len(groups)-1-i)%cancelCheckInterval == 0 {
+			if err := cancelled(ctx); err != nil {
+				return &fileResult{err: err}
+			}
+		}
+
+		event := r.newEvent(groups[i])
+		event.SourceFile = filename
+
+		// Any more events from this file are not needed, unless they are
+		// at the same time as the oldest event and so need sorting with it
+		if len(result.events) >= max && !event.Timestamp.Equal(result.events[len(result.events)-1].Timestamp) {
+			return result
+		}
+
+		// Filter by UUID. SinceTime and UntilTime are the times of the
+		// SinceUUID and UntilUUID events so only the events at exactly
+		// those times need comparing with them, by UUID, in the same
+		// order that events are sorted in.
+		if q.SinceUUID != "" && event.Timestamp.Equal(q.SinceTime) {
+			if event.UUID < q.SinceUUID || (event.UUID == q.SinceUUID && !q.SinceUUIDInclusive) {
 				continue
 			}
-			if !q.SinceTime.IsZero() && event.Timestamp.Before(q.SinceTime) {
-				return events, nil
+		}
+		if q.UntilUUID != "" && event.Timestamp.Equal(q.UntilTime) {
+			if event.UUID > q.UntilUUID || (event.UUID == q.UntilUUID && !q.IncludeUntil) {
+				continue
 			}
+		}
+
+		// Filter by severity
+		if event.Severity < q.minSeverity() {
+			continue
+		}
+		if q.MaxSeverity > 0 && event.Severity > q.MaxSeverity {
+			continue
+		}
+
+		// Filter by service
+		if len(q.Services) > 0 && !containsService(q.Services, event.Service) {
+			continue
+		}
+		if len(q.ExcludeServices) > 0 && containsService(q.ExcludeServices, event.Service) {
+			continue
+		}
 
-			// Filter by UUID
-			if q.SinceUUID != "" && event.UUID == q.SinceUUID {
-				return events, nil
+		// Filter by message. The prefix is checked first because it is the
+		// cheapest. The pattern takes precedence over the substring.
+		if q.MessagePrefix != "" && !strings.HasPrefix(event.Message, q.MessagePrefix) {
+			continue
+		}
+		if q.MessageRegexp != nil {
+			if !q.MessageRegexp.MatchString(event.Message) {
+				continue
 			}
+		} else if q.Message != "" && !containsFold(event.Message, q.Message) {
+			continue
+		}
+
+		// Filter by fields
+		if !containsFields(event.Fields, q.Fields) {
+			continue
+		}
+
+		// Filter by trace
+		if q.TraceID != "" && event.TraceID != q.TraceID {
+			continue
+		}
+
+		// Filter by source file
+		if q.SourceFile != "" && q.SourceFile != filename && q.SourceFile != filepath.Base(filename) {
+			continue
+		}
+
+		// Filter by time
+		if !q.UntilTime.IsZero() && event.Timestamp.After(q.UntilTime) {
+			continue
+		}
+		if !q.SinceTime.IsZero() && event.Timestamp.Before(q.SinceTime) {
+			result.done = true
+			return result
+		}
+
+		if result.newest == nil || result.newest.Before(event) {
+			result.newest = event
+			result.newestGroup = i
+		}
 
-			events = append(events, event)
+		// Events with the same timestamp as the oldest event are kept even
+		// if there are already enough because, once they are sorted, they
+		// could be in the first max events instead of it
+		if len(result.events) < max || event.Timestamp.Equal(result.events[len(result.events)-1].Timestamp) {
+			result.events = append(result.events, event)
 		}
+	}
+
+	return result
+}
 
-		// Subtract a day from the date
-		date = date.AddDate(0, 0, -1)
+// cancelled returns an error with code ErrCancelled if ctx has been cancelled
+func cancelled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &errors.Error{
+			Code:    ErrCancelled,
+			Message: fmt.Sprintf("query abandoned: %v", err),
+		}
 	}
+	return nil
 }
 
-// readLines loads all lines from the log file into memory
-func readLines(filename string) ([][]byte, error) {
-	if _, err := os.Stat(filename); err != nil {
-		return nil, err
+// logFiles returns the path of the log file for the date in each log
+// directory. If the repository has a single File, it is returned for every date.
+func (r *LogRepository) logFiles(date time.Time) []string {
+	return r.store().Files(date)
+}
+
+// store returns the Store, or the log files on the filesystem if it is nil
+func (r *LogRepository) store() LogStore {
+	if r.Store != nil {
+		return r.Store
 	}
+	return &FileLogStore{Directories: r.LogDirectories, File: r.File}
+}
 
-	data, err := ioutil.ReadFile(filename)
+func (r *LogRepository) eventStart() *regexp.Regexp {
+	if r.EventStart != nil {
+		return r.EventStart
+	}
+	if r.LineFormat != nil {
+		return r.LineFormat
+	}
+	return DefaultEventStart
+}
+
+func (r *LogRepository) workers() int {
+	if r.Workers > 0 {
+		return r.Workers
+	}
+	return DefaultWorkers
+}
+
+func (r *LogRepository) maxResults() int {
+	if r.MaxResults > 0 {
+		return r.MaxResults
+	}
+	return DefaultMaxResults
+}
+
+// minSeverity returns the effective lower bound of the severity range
+func (q *LogQuery) minSeverity() slog.Severity {
+	if q.MinSeverity > q.Severity {
+		return q.MinSeverity
+	}
+	return q.Severity
+}
+
+// readGroups reads the lines from the log file and groups continuation lines
+// with the line that started their event. The first line in each group is
+// the line that started the event. Empty lines are removed. Events before
+// since may be skipped if the file has been indexed.
+func (r *LogRepository) readGroups(filename string, since time.Time) ([][][]byte, error) {
+	data, err := r.readFile(filename, since)
 	if err != nil {
-		return nil, errors.Wrap(err, nil)
+		return nil, err
+	}
+
+	return r.splitGroups(data), nil
+}
+
+// splitGroups splits the data into lines, grouping each line that
+// starts an event with any continuation lines that follow it. A last
+// line without a trailing new line is skipped because it is probably
+// still being written. It is read once its new line has been written.
+func (r *LogRepository) splitGroups(data []byte) [][][]byte {
+	groups, _ := r.splitGroupsAt(data)
+	return groups
+}
+
+// splitGroupsAt is splitGroups but also returns the offset in
+// data of the end of each group, after its trailing new line
+func (r *LogRepository) splitGroupsAt(data []byte) ([][][]byte, []int64) {
+	start := r.eventStart()
+
+	// Leave out a partially written last line
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	var groups [][][]byte
+	var ends []int64
+	var offset int64
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		offset += int64(len(line)) + 1
+
+		if len(line) == 0 {
+			continue
+		}
+
+		// A continuation line at the start of the file has no event to join
+		if len(groups) > 0 && !start.Match(line) {
+			groups[len(groups)-1] = append(groups[len(groups)-1], line)
+			ends[len(ends)-1] = offset
+			continue
+		}
+
+		groups = append(groups, [][]byte{line})
+		ends = append(ends, offset)
+	}
+
+	return groups, ends
+}
+
+// newEvent returns an event parsed from the first line in the
+// group with any continuation lines appended to its message
+func (r *LogRepository) newEvent(group [][]byte) *domain.Event {
+	event := r.parseLine(group[0])
+	if len(group) == 1 {
+		return event
+	}
+
+	event.Message += "\n" + string(bytes.Join(group[1:], []byte("\n")))
+	event.Raw = bytes.Join(group, []byte("\n"))
+	return event
+}
+
+// parseLine returns the event parsed from a single line using the
+// line format, if there is one, or as a line written by logstash
+func (r *LogRepository) parseLine(line []byte) *domain.Event {
+	if r.LineFormat != nil {
+		return domain.NewEventFromFormat(line, r.LineFormat, r.TimestampLayout)
 	}
+	return domain.NewEventFromBytes(line)
+}
 
-	return bytes.Split(data, []byte("\n")), nil
+// sameLine returns whether the events have the same service and message
+func sameLine(a, b *domain.Event) bool {
+	return a.Service == b.Service && a.Message == b.Message
 }
 
-// containsService returns whether any of the patterns match the service name.
-// Patterns may end with a wildcard character "*".
+// containsService returns whether any of the patterns match the service
+// name, ignoring case. Patterns may contain wildcard "*" characters.
 func containsService(patterns []string, service string) bool {
 	for _, p := range patterns {
-		if p == service {
+		if matchGlob(p, service) {
 			return true
 		}
+	}
+	return false
+}
 
-		if p[len(p)-1:] == "*" && strings.HasPrefix(service, p[:len(p)-1]) {
-			return true
+// matchGlob returns whether s matches the pattern, ignoring case. Each "*"
+// in the pattern matches any sequence of characters, e.g. "sensor.*" or
+// "*.kitchen". A pattern without a "*" must match the whole of s.
+func matchGlob(pattern, s string) bool {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return strings.EqualFold(pattern, s)
+	}
+
+	// The text before the first wildcard is a prefix
+	if !hasPrefixFold(s, pattern[:i]) {
+		return false
+	}
+	s = s[i:]
+	pattern = pattern[i+1:]
+
+	// The text between wildcards can be anywhere, so take the first
+	// occurrence of each to leave as much as possible for the rest
+	for {
+		i = strings.IndexByte(pattern, '*')
+		if i < 0 {
+			// The text after the last wildcard is a suffix
+			return hasSuffixFold(s, pattern)
+		}
+
+		j := indexFold(s, pattern[:i])
+		if j < 0 {
+			return false
 		}
+		s = s[j+i:]
+		pattern = pattern[i+1:]
 	}
-	return false
+}
+
+// hasPrefixFold is strings.HasPrefix ignoring case
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// hasSuffixFold is strings.HasSuffix ignoring case
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// indexFold is strings.Index ignoring case
+func indexFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// containsFields returns whether fields satisfy every filter
+func containsFields(fields map[string]string, filters []FieldFilter) bool {
+	for _, f := range filters {
+		if !f.matches(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold returns whether substr is within s, ignoring case
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// sortNewestFirst sorts the events into the reverse of the order of
+// domain.Event.Before, keeping events that are equal in the same order
+func sortNewestFirst(events []*domain.Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[j].Before(events[i])
+	})
 }
 
 // reverse performs an in-place reversal of the given slice
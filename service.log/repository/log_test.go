@@ -0,0 +1,775 @@
+package repository
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+
+	"gotest.tools/assert"
+)
+
+// newTestRepository writes the lines to today's log file in a temporary
+// directory and returns a repository that reads from it. The returned
+// function should be deferred to remove the directory.
+func newTestRepository(t *testing.T, lines ...string) (*LogRepository, func()) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	err = ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	assert.NilError(t, err)
+
+	return &LogRepository{LogDirectories: []string{dir}}, func() { os.RemoveAll(dir) }
+}
+
+// line returns a JSON log line in the format written by logstash
+func line(uuid, service, severity, message string) string {
+	return fmt.Sprintf(
+		`{"uuid":%q,"@timestamp":%q,"service":%q,"severity":%q,"message":%q}`,
+		uuid, time.Now().UTC().Format(time.RFC3339), service, severity, message,
+	)
+}
+
+// lineAt returns a JSON log line in the format written by logstash with the timestamp
+func lineAt(uuid string, timestamp time.Time) string {
+	return fmt.Sprintf(
+		`{"uuid":%q,"@timestamp":%q,"service":"service.foo","severity":"info","message":"a"}`,
+		uuid, timestamp.Format(time.RFC3339Nano),
+	)
+}
+
+func uuids(t *testing.T, r *LogRepository, q *LogQuery) []string {
+	events, err := r.Find(context.Background(), q)
+	assert.NilError(t, err)
+
+	var u []string
+	for _, e := range events {
+		u = append(u, e.UUID)
+	}
+	return u
+}
+
+func TestFindSeverityRange(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "debug", "a"),
+		line("2", "service.foo", "info", "b"),
+		line("3", "service.foo", "warning", "c"),
+		line("4", "service.foo", "error", "d"),
+	)
+	defer cleanup()
+
+	got := uuids(t, r, &LogQuery{
+		MinSeverity: slog.InfoSeverity,
+		MaxSeverity: slog.WarnSeverity,
+	})
+	assert.DeepEqual(t, got, []string{"2", "3"})
+}
+
+func TestFindSeverityLowerBound(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "debug", "a"),
+		line("2", "service.foo", "info", "b"),
+		line("3", "service.foo", "error", "c"),
+	)
+	defer cleanup()
+
+	// The old Severity field should still act as a minimum
+	got := uuids(t, r, &LogQuery{Severity: slog.InfoSeverity})
+	assert.DeepEqual(t, got, []string{"2", "3"})
+
+	// The higher of Severity and MinSeverity wins
+	got = uuids(t, r, &LogQuery{
+		Severity:    slog.InfoSeverity,
+		MinSeverity: slog.ErrorSeverity,
+	})
+	assert.DeepEqual(t, got, []string{"3"})
+}
+
+func TestFindInvertedSeverityRange(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.foo", "error", "b"),
+	)
+	defer cleanup()
+
+	events, err := r.Find(context.Background(), &LogQuery{
+		MinSeverity: slog.ErrorSeverity,
+		MaxSeverity: slog.InfoSeverity,
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 0)
+}
+
+func TestFindExcludeServices(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.bar", "info", "b"),
+		line("3", "service.baz", "info", "c"),
+	)
+	defer cleanup()
+
+	// An empty Services slice means all services
+	got := uuids(t, r, &LogQuery{ExcludeServices: []string{"service.bar"}})
+	assert.DeepEqual(t, got, []string{"1", "3"})
+}
+
+func TestFindExcludeServicesWins(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.bar", "info", "b"),
+	)
+	defer cleanup()
+
+	got := uuids(t, r, &LogQuery{
+		Services:        []string{"service.foo", "service.bar"},
+		ExcludeServices: []string{"service.bar"},
+	})
+	assert.DeepEqual(t, got, []string{"1"})
+}
+
+func TestFindServicesIgnoreCase(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "tv", "info", "one"),
+		line("2", "service.Hue", "info", "two"),
+		line("3", "service.foo", "info", "three"),
+	)
+	defer cleanup()
+
+	got := uuids(t, r, &LogQuery{Services: []string{"TV", "service.hue"}})
+	assert.DeepEqual(t, got, []string{"1", "2"})
+
+	got = uuids(t, r, &LogQuery{Services: []string{"SERVICE.*"}, ExcludeServices: []string{"Service.FOO"}})
+	assert.DeepEqual(t, got, []string{"2"})
+}
+
+func TestFindServicesGlob(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "sensor.kitchen", "info", "a"),
+		line("2", "sensor.bedroom", "info", "b"),
+		line("3", "light.kitchen", "info", "c"),
+		line("4", "sensor", "info", "d"),
+	)
+	defer cleanup()
+
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{Services: []string{"sensor.*"}}), []string{"1", "2"})
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{Services: []string{"*.kitchen"}}), []string{"1", "3"})
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{Services: []string{"sensor.*"}, ExcludeServices: []string{"*.kitchen"}}), []string{"2"})
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"sensor.kitchen", "sensor.kitchen", true},
+		{"sensor.kitchen", "sensor.kitchen.fridge", false},
+		{"sensor.*", "Sensor.Kitchen", true},
+		{"sensor.*", "sensor.", true},
+		{"sensor.*", "sensor", false},
+		{"*.kitchen", "light.kitchen", true},
+		{"*.kitchen", "light.kitchen.fridge", false},
+		{"*kitchen*", "sensor.kitchen.fridge", true},
+		{"sensor.*.temp", "sensor.kitchen.temp", true},
+		{"sensor.*.temp", "sensor.temp", false},
+		{"a*a", "a", false},
+		{"a*a", "aa", true},
+		{"*", "anything", true},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, matchGlob(tc.pattern, tc.s), tc.want, tc.pattern+" "+tc.s)
+	}
+}
+
+func TestDistinctServices(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.bar", "info", "b"),
+		line("3", "service.foo", "info", "c"),
+	)
+	defer cleanup()
+
+	services, err := r.DistinctServices(context.Background(), time.Time{}, time.Time{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, services, []string{"service.bar", "service.foo"})
+
+	// Services are not missed when there are more events than MaxResults
+	r.MaxResults = 1
+	services, err = r.DistinctServices(context.Background(), time.Time{}, time.Time{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, services, []string{"service.bar", "service.foo"})
+}
+
+func TestFindFields(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", `msg="done" user_id=42`),
+		line("2", "service.foo", "info", `msg="done" user_id=43`),
+		line("3", "service.foo", "info", `user_id=42 status=failed`),
+	)
+	defer cleanup()
+
+	got := uuids(t, r, &LogQuery{Fields: []FieldFilter{{"user_id", OpEqual, "42"}}})
+	assert.DeepEqual(t, got, []string{"1", "3"})
+
+	got = uuids(t, r, &LogQuery{Fields: []FieldFilter{{"user_id", OpEqual, "42"}, {"status", OpEqual, "failed"}}})
+	assert.DeepEqual(t, got, []string{"3"})
+}
+
+func TestFindFieldRanges(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", `duration_ms=120 status_code=200`),
+		line("2", "service.foo", "info", `duration_ms=950 status_code=500`),
+		line("3", "service.foo", "info", `duration_ms=slow status_code=404`),
+		line("4", "service.foo", "info", `duration_ms=500.0 status_code=400`),
+	)
+	defer cleanup()
+
+	got := uuids(t, r, &LogQuery{Fields: []FieldFilter{{"duration_ms", OpGreater, "500"}}})
+	assert.DeepEqual(t, got, []string{"2"})
+
+	got = uuids(t, r, &LogQuery{Fields: []FieldFilter{{"duration_ms", OpGreaterOrEqual, "500"}}})
+	assert.DeepEqual(t, got, []string{"2", "4"})
+
+	// Numbers are compared by value rather than as strings
+	got = uuids(t, r, &LogQuery{Fields: []FieldFilter{{"duration_ms", OpEqual, "500"}}})
+	assert.DeepEqual(t, got, []string{"4"})
+
+	// A value that is not a number only matches equality
+	got = uuids(t, r, &LogQuery{Fields: []FieldFilter{{"duration_ms", OpEqual, "slow"}}})
+	assert.DeepEqual(t, got, []string{"3"})
+
+	got = uuids(t, r, &LogQuery{Fields: []FieldFilter{{"status_code", OpGreaterOrEqual, "400"}, {"duration_ms", OpLess, "600"}}})
+	assert.DeepEqual(t, got, []string{"4"})
+}
+
+func TestFindTraceID(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", `msg="start" trace_id=abc`),
+		line("2", "service.bar", "info", `msg="start" trace_id=abcd`),
+		line("3", "service.bar", "info", `msg="done" trace_id=abc`),
+	)
+	defer cleanup()
+
+	got := uuids(t, r, &LogQuery{TraceID: "abc"})
+	assert.DeepEqual(t, got, []string{"1", "3"})
+}
+
+func TestFindMessagePrefix(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "[HTTP] GET /devices"),
+		line("2", "service.foo", "info", "[http] GET /rooms"),
+		line("3", "service.foo", "info", "Sent [HTTP] request"),
+		line("4", "service.foo", "info", "[HTTP] POST /devices"),
+	)
+	defer cleanup()
+
+	// The prefix is case-sensitive and must be at the start
+	got := uuids(t, r, &LogQuery{MessagePrefix: "[HTTP]"})
+	assert.DeepEqual(t, got, []string{"1", "4"})
+
+	// Both the prefix and the substring must match
+	got = uuids(t, r, &LogQuery{MessagePrefix: "[HTTP]", Message: "post"})
+	assert.DeepEqual(t, got, []string{"4"})
+
+	// Both the prefix and the pattern must match
+	got = uuids(t, r, &LogQuery{MessagePrefix: "[HTTP]", MessagePattern: "GET|rooms"})
+	assert.DeepEqual(t, got, []string{"1"})
+}
+
+func TestFindTail(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "one"),
+		line("2", "service.bar", "error", "two"),
+		line("3", "service.foo", "error", "three"),
+		line("4", "service.foo", "debug", "four"),
+		line("5", "service.foo", "error", "five"),
+	)
+	defer cleanup()
+
+	got := uuids(t, r, &LogQuery{Tail: 2})
+	assert.DeepEqual(t, got, []string{"4", "5"})
+
+	got = uuids(t, r, &LogQuery{
+		Tail:        2,
+		Services:    []string{"service.foo"},
+		MinSeverity: slog.ErrorSeverity,
+	})
+	assert.DeepEqual(t, got, []string{"3", "5"})
+
+	// The time window, limit and offset are ignored
+	got = uuids(t, r, &LogQuery{
+		Tail:      1,
+		SinceTime: time.Now().Add(time.Hour),
+		Limit:     5,
+		Offset:    2,
+	})
+	assert.DeepEqual(t, got, []string{"5"})
+}
+
+func TestFindCancelled(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "one"),
+	)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := r.Find(ctx, &LogQuery{})
+	e, ok := err.(*errors.Error)
+	assert.Assert(t, ok)
+	assert.Equal(t, e.Code, ErrCancelled)
+}
+
+func TestFindRetryableErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A directory in place of the log file cannot be read
+	r := &LogRepository{LogDirectories: []string{dir}}
+	assert.NilError(t, os.Mkdir(r.ActiveLogFiles()[0], 0755))
+
+	_, err = r.Find(context.Background(), &LogQuery{})
+	assert.Assert(t, errors.Retryable(err))
+
+	// Invalid queries are not worth retrying
+	_, err = r.Find(context.Background(), &LogQuery{MessagePattern: "("})
+	assert.Assert(t, err != nil)
+	assert.Assert(t, !errors.Retryable(err))
+}
+
+func TestFindMultilineEvents(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		"panic: something went wrong",
+		line("1", "service.foo", "error", "panic: runtime error"),
+		"goroutine 1 [running]:",
+		"main.main()",
+		"\t/go/src/main.go:12 +0x39",
+		line("2", "service.foo", "info", "b"),
+	)
+	defer cleanup()
+
+	events, err := r.Find(context.Background(), &LogQuery{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 3)
+
+	// A continuation line at the start of the file is its own event
+	assert.Equal(t, events[0].Message, "panic: something went wrong")
+
+	assert.Equal(t, events[1].UUID, "1")
+	assert.Equal(t, events[1].Message, "panic: runtime error\ngoroutine 1 [running]:\nmain.main()\n\t/go/src/main.go:12 +0x39")
+	assert.Equal(t, string(events[1].Format().Message), events[1].Message)
+
+	assert.Equal(t, events[2].UUID, "2")
+}
+
+func TestFindSkipsPartialLine(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+	)
+	defer cleanup()
+
+	filename := filepath.Join(r.LogDirectories[0], fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NilError(t, err)
+	defer f.Close()
+
+	// Write the first half of a line as if it is part way through being written
+	l := line("2", "service.foo", "info", "b")
+	_, err = f.WriteString(l[:len(l)/2])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{}), []string{"1"})
+
+	// The line is read once it is complete
+	_, err = f.WriteString(l[len(l)/2:] + "\n")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{}), []string{"1", "2"})
+}
+
+func TestFindWithMetaTruncated(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.foo", "info", "b"),
+		line("3", "service.foo", "info", "c"),
+	)
+	defer cleanup()
+	r.MaxResults = 2
+
+	// The newest events are kept
+	result, err := r.FindWithMeta(context.Background(), &LogQuery{})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Truncated, true)
+	assert.Equal(t, len(result.Events), 2)
+	assert.Equal(t, result.Events[0].UUID, "2")
+
+	// A limit within the cap is not truncation
+	result, err = r.FindWithMeta(context.Background(), &LogQuery{Limit: 1})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Truncated, false)
+}
+
+func TestFindWithMetaTotal(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "one"),
+		line("2", "service.bar", "info", "two"),
+		line("3", "service.foo", "info", "three"),
+		line("4", "service.foo", "info", "four"),
+		line("5", "service.foo", "info", "five"),
+	)
+	defer cleanup()
+
+	q := &LogQuery{Services: []string{"service.foo"}, Limit: 2, Offset: 1, CountTotal: true}
+	result, err := r.FindWithMeta(context.Background(), q)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Total, 4)
+	assert.Equal(t, len(result.Events), 2)
+	assert.Equal(t, result.Events[0].UUID, "3")
+	assert.Equal(t, result.Events[1].UUID, "4")
+
+	// The total is not counted unless it is asked for
+	q.CountTotal = false
+	result, err = r.FindWithMeta(context.Background(), q)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Total, 0)
+}
+
+func TestFindDedupe(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "polling"),
+		line("2", "service.foo", "info", "polling"),
+		line("3", "service.foo", "info", "polling"),
+		line("4", "service.bar", "info", "polling"),
+		line("5", "service.foo", "info", "polling"),
+		line("6", "service.foo", "info", "done"),
+	)
+	defer cleanup()
+
+	events, err := r.Find(context.Background(), &LogQuery{Dedupe: true})
+	assert.NilError(t, err)
+
+	var got []string
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s:%d", e.UUID, e.RepeatCount))
+	}
+
+	// Runs are collapsed into their newest event but
+	// duplicates that are not consecutive are kept
+	assert.DeepEqual(t, got, []string{"3:3", "4:0", "5:0", "6:0"})
+
+	// A run at the end of a page is counted in full
+	events, err = r.Find(context.Background(), &LogQuery{Dedupe: true, Limit: 1, Offset: 3})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].UUID, "3")
+	assert.Equal(t, events[0].RepeatCount, 3)
+}
+
+func TestFindGzipRotatedFile(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("2", "service.foo", "info", "b"),
+	)
+	defer cleanup()
+
+	// Write yesterday's events to a rotated, compressed file
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	f, err := os.Create(filepath.Join(r.LogDirectories[0], fmt.Sprintf("messages-%s.gz", yesterday.Format("2006-01-02"))))
+	assert.NilError(t, err)
+	zw := gzip.NewWriter(f)
+	_, err = fmt.Fprintf(zw, `{"uuid":"1","@timestamp":%q,"service":"service.foo","severity":"info","message":"a"}`+"\n", yesterday.Format(time.RFC3339))
+	assert.NilError(t, err)
+	assert.NilError(t, zw.Close())
+	assert.NilError(t, f.Close())
+
+	got := uuids(t, r, &LogQuery{})
+	assert.DeepEqual(t, got, []string{"1", "2"})
+
+	// Files outside of the time window are skipped
+	got = uuids(t, r, &LogQuery{UntilTime: yesterday.Add(time.Minute)})
+	assert.DeepEqual(t, got, []string{"1"})
+}
+
+func TestFindParallel(t *testing.T) {
+	r, cleanup := newTestRepository(t, line("today", "service.foo", "info", "a"))
+	defer cleanup()
+	r.Workers = 3
+
+	// Write a file for each of the previous week's days
+	now := time.Now().UTC()
+	for d := 1; d <= 7; d++ {
+		date := now.AddDate(0, 0, -d)
+		content := fmt.Sprintf(
+			`{"uuid":"%d","@timestamp":%q,"service":"service.foo","severity":"info","message":"a"}`+"\n",
+			d, date.Format(time.RFC3339),
+		)
+		filename := filepath.Join(r.LogDirectories[0], fmt.Sprintf("messages-%s", date.Format("2006-01-02")))
+		assert.NilError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	}
+
+	// Run queries concurrently so the race detector can check the index cache
+	results := make(chan []string, 4)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			events, err := r.Find(context.Background(), &LogQuery{})
+			if err != nil {
+				results <- nil
+				return
+			}
+
+			var u []string
+			for _, e := range events {
+				u = append(u, e.UUID)
+			}
+			results <- u
+		}()
+	}
+
+	for i := 0; i < cap(results); i++ {
+		assert.DeepEqual(t, <-results, []string{"7", "6", "5", "4", "3", "2", "1", "today"})
+	}
+
+	// Ordering holds across batches in both directions
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{Reverse: true, Limit: 5, Offset: 1}), []string{"1", "2", "3", "4", "5"})
+}
+
+func TestFindMultipleDirectories(t *testing.T) {
+	now := time.Now().UTC()
+	yesterday := now.AddDate(0, 0, -1)
+
+	// Each directory has its own events with interleaved timestamps,
+	// and only the second directory has a file for yesterday
+	files := map[string]map[time.Time]map[string]time.Duration{
+		"a": {now: {"a1": -4 * time.Minute, "a2": -2 * time.Minute}},
+		"b": {now: {"b1": -3 * time.Minute, "b2": -time.Minute}, yesterday: {"b0": 0}},
+	}
+
+	var dirs []string
+	for _, name := range []string{"a", "b"} {
+		dir, err := ioutil.TempDir("", "service.log")
+		assert.NilError(t, err)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+
+		for date, events := range files[name] {
+			var content string
+			for uuid, offset := range events {
+				content += fmt.Sprintf(
+					`{"uuid":%q,"@timestamp":%q,"service":"service.foo","severity":"info","message":"a"}`+"\n",
+					uuid, date.Add(offset).Format(time.RFC3339),
+				)
+			}
+			filename := filepath.Join(dir, fmt.Sprintf("messages-%s", date.Format("2006-01-02")))
+			assert.NilError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+		}
+	}
+
+	r := NewLogRepository(dirs...)
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{}), []string{"b0", "a1", "b1", "a2", "b2"})
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{Reverse: true, Limit: 3}), []string{"b2", "a2", "b1"})
+	assert.DeepEqual(t, streamUUIDs(t, r, &LogQuery{}), []string{"b0", "a1", "b1", "a2", "b2"})
+}
+
+func TestFindSourceFile(t *testing.T) {
+	var filenames []string
+	for _, uuid := range []string{"a", "b"} {
+		dir, err := ioutil.TempDir("", "service.log")
+		assert.NilError(t, err)
+		defer os.RemoveAll(dir)
+
+		filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+		content := line(uuid, "service.foo", "info", "hello") + "\n"
+		assert.NilError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+		filenames = append(filenames, filename)
+	}
+
+	r := NewLogRepository(filepath.Dir(filenames[0]), filepath.Dir(filenames[1]))
+
+	// Events know which file they came from
+	events, err := r.Find(context.Background(), &LogQuery{SourceFile: filenames[1]})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].UUID, "b")
+	assert.Equal(t, events[0].SourceFile, filenames[1])
+	assert.Equal(t, events[0].Format().SourceFile, filenames[1])
+
+	// Both files have the same base name
+	got := uuids(t, r, &LogQuery{SourceFile: filepath.Base(filenames[0])})
+	assert.DeepEqual(t, got, []string{"a", "b"})
+
+	got = uuids(t, r, &LogQuery{SourceFile: "tv.log"})
+	assert.Equal(t, len(got), 0)
+}
+
+func TestFindLineFormat(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	layout := "02/01/2006 15:04:05"
+
+	r, cleanup := newTestRepository(t,
+		fmt.Sprintf("[%s] INFO service.foo: Started", now.Add(-time.Minute).Format(layout)),
+		fmt.Sprintf("[%s] ERROR service.foo: Failed", now.Format(layout)),
+		"  at main.go:42",
+	)
+	defer cleanup()
+	r.LineFormat = regexp.MustCompile(`^\[(?P<timestamp>[^\]]+)\] (?P<severity>\w+) (?P<service>[\w.]+): (?P<message>.*)$`)
+	r.TimestampLayout = layout
+
+	events, err := r.Find(context.Background(), &LogQuery{Severity: slog.ErrorSeverity})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Service, "service.foo")
+	assert.Assert(t, events[0].Timestamp.Equal(now))
+
+	// Lines that do not match the format continue the previous event
+	assert.Equal(t, events[0].Message, "Failed\n  at main.go:42")
+}
+
+func TestDistinctFieldValues(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "status_code=200"),
+		line("2", "service.foo", "info", "status_code=200"),
+		line("3", "service.foo", "error", "status_code=500"),
+		line("4", "service.foo", "info", "no fields here"),
+	)
+	defer cleanup()
+
+	values, err := r.DistinctFieldValues(context.Background(), "status_code", &LogQuery{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, values, map[string]int{"200": 2, "500": 1})
+
+	// The query still applies
+	values, err = r.DistinctFieldValues(context.Background(), "status_code", &LogQuery{Severity: slog.ErrorSeverity})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, values, map[string]int{"500": 1})
+
+	values, err = r.DistinctFieldValues(context.Background(), "missing", &LogQuery{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, values, map[string]int{})
+}
+
+func TestFindUntilUUID(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.bar", "info", "b"),
+		line("3", "service.foo", "info", "c"),
+		line("4", "service.foo", "info", "d"),
+		line("5", "service.foo", "info", "e"),
+	)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		q    *LogQuery
+		want []string
+	}{
+		{"absent", &LogQuery{SinceUUID: "2"}, []string{"3", "4", "5"}},
+		{"until", &LogQuery{UntilUUID: "3"}, []string{"1", "2"}},
+		{"between", &LogQuery{SinceUUID: "1", UntilUUID: "4"}, []string{"2", "3"}},
+		{"inclusive", &LogQuery{SinceUUID: "1", UntilUUID: "4", IncludeUntil: true}, []string{"2", "3", "4"}},
+		{"filtered", &LogQuery{Services: []string{"service.foo"}, UntilUUID: "2", IncludeUntil: true}, []string{"1"}},
+		{"reverse", &LogQuery{UntilUUID: "3", Reverse: true}, []string{"2", "1"}},
+		{"until before since", &LogQuery{SinceUUID: "4", UntilUUID: "2"}, nil},
+		{"unknown", &LogQuery{UntilUUID: "6"}, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.DeepEqual(t, uuids(t, r, tc.q), tc.want)
+		})
+	}
+}
+
+func TestFindFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The file has events from several days and is not named like a daily log file
+	now := time.Now().UTC()
+	var lines []string
+	for i, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour, 0} {
+		lines = append(lines, lineAt(strconv.Itoa(i+1), now.Add(-age)))
+	}
+	filename := filepath.Join(dir, "export.log")
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	r := NewFileRepository(filename)
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{}), []string{"1", "2", "3", "4"})
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{SinceTime: now.Add(-50 * time.Hour), UntilTime: now.Add(-30 * time.Minute)}), []string{"2", "3"})
+	assert.DeepEqual(t, uuids(t, r, &LogQuery{Tail: 1}), []string{"4"})
+
+	var streamed []string
+	err = r.FindStream(context.Background(), &LogQuery{Reverse: true}, func(e *domain.Event) error {
+		streamed = append(streamed, e.UUID)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, streamed, []string{"4", "3", "2", "1"})
+
+	// A file that does not exist is an error rather than no events
+	_, err = NewFileRepository(filepath.Join(dir, "missing.log")).Find(context.Background(), &LogQuery{})
+	assert.ErrorContains(t, err, "missing.log")
+}
+
+func TestFindSameTimestampAcrossFiles(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	// Events in each directory at the same millisecond, written in an
+	// order that is different to the order of their UUIDs
+	files := [][]string{
+		{lineAt("d", now), lineAt("b", now), lineAt("e", now.Add(time.Millisecond))},
+		{lineAt("c", now), lineAt("a", now)},
+	}
+
+	var dirs []string
+	for _, lines := range files {
+		dir, err := ioutil.TempDir("", "service.log")
+		assert.NilError(t, err)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+
+		filename := filepath.Join(dir, fmt.Sprintf("messages-%s", now.Format("2006-01-02")))
+		assert.NilError(t, ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+	}
+
+	// The order does not depend on the order of the directories
+	want := []string{"a", "b", "c", "d", "e"}
+	for _, r := range []*LogRepository{NewLogRepository(dirs[0], dirs[1]), NewLogRepository(dirs[1], dirs[0])} {
+		assert.DeepEqual(t, uuids(t, r, &LogQuery{}), want)
+		assert.DeepEqual(t, uuids(t, r, &LogQuery{Reverse: true}), []string{"e", "d", "c", "b", "a"})
+		assert.DeepEqual(t, streamUUIDs(t, r, &LogQuery{}), want)
+
+		// Pages neither skip nor repeat events
+		var paged []string
+		for offset := 0; offset < len(want); offset += 2 {
+			paged = append(paged, uuids(t, r, &LogQuery{Reverse: true, Limit: 2, Offset: offset})...)
+		}
+		assert.DeepEqual(t, paged, []string{"e", "d", "c", "b", "a"})
+
+		// Resuming from an event returns the events after it in the same order.
+		// The slices are copied so that no events is nil rather than empty.
+		for i, uuid := range want {
+			after := append([]string(nil), want[i+1:]...)
+			before := append([]string(nil), want[:i]...)
+			assert.DeepEqual(t, uuids(t, r, &LogQuery{SinceUUID: uuid}), after)
+			assert.DeepEqual(t, sinceUUIDs(t, r, &LogQuery{SinceUUID: uuid}), after)
+			assert.DeepEqual(t, uuids(t, r, &LogQuery{UntilUUID: uuid}), before)
+		}
+
+		latest, err := r.Latest(context.Background(), &LogQuery{UntilUUID: "e"})
+		assert.NilError(t, err)
+		assert.Equal(t, latest.UUID, "d")
+	}
+}
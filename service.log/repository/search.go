@@ -0,0 +1,276 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+)
+
+// MaxSearchDepth is the deepest that conditions can be nested in a Search so
+// that a single request cannot make every event take long to match
+const MaxSearchDepth = 8
+
+// Search is a condition on events that can combine other conditions with
+// "and", "or" and "not", for queries that a LogQuery cannot express, e.g.
+//
+//	{"and": [
+//		{"service": "service.tv"},
+//		{"or": [{"field": "status", "eq": "500"}, {"severity_gte": "error"}]}
+//	]}
+//
+// Each Search must have exactly one condition. The field operators are
+// the exception: a field can be compared with any number of them, and
+// the field must satisfy them all.
+type Search struct {
+	// And matches events that match every one of the searches
+	And []*Search `json:"and,omitempty"`
+
+	// Or matches events that match any of the searches
+	Or []*Search `json:"or,omitempty"`
+
+	// Not matches events that do not match the search
+	Not *Search `json:"not,omitempty"`
+
+	// Service matches events from the service. It is
+	// a pattern in the same form as LogQuery.Services.
+	Service string `json:"service,omitempty"`
+
+	// Message matches events whose message contains it, ignoring case
+	Message string `json:"message,omitempty"`
+
+	// TraceID matches events with the trace ID
+	TraceID string `json:"trace_id,omitempty"`
+
+	// SeverityGTE and SeverityLTE match events with at least
+	// and at most the severity. They can be numbers or names.
+	SeverityGTE *SearchValue `json:"severity_gte,omitempty"`
+	SeverityLTE *SearchValue `json:"severity_lte,omitempty"`
+
+	// Field is the key of a field that is compared with the operators below.
+	// Values are compared in the same way as a FieldFilter's, as numbers if
+	// they both are numbers. Events that do not have the field never match.
+	Field string       `json:"field,omitempty"`
+	Eq    *SearchValue `json:"eq,omitempty"`
+	Gt    *SearchValue `json:"gt,omitempty"`
+	Gte   *SearchValue `json:"gte,omitempty"`
+	Lt    *SearchValue `json:"lt,omitempty"`
+	Lte   *SearchValue `json:"lte,omitempty"`
+}
+
+// SearchValue is the value that a field or severity is compared
+// with. It can be given as a JSON string or number, e.g. "500" or 500.
+type SearchValue string
+
+// UnmarshalJSON accepts a string or a number
+func (v *SearchValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = SearchValue(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return errors.BadRequest("invalid value %s, expected a string or a number", data)
+	}
+
+	*v = SearchValue(n)
+	return nil
+}
+
+// ParseSearch unmarshals a Search from JSON. Unknown
+// keys are rejected so that typos do not match everything.
+func ParseSearch(data []byte) (*Search, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	s := &Search{}
+	if err := dec.Decode(s); err != nil {
+		return nil, errors.BadRequest("invalid search: %v", err)
+	}
+
+	return s, nil
+}
+
+// Predicate returns a function that reports whether an event matches the
+// search. An error is returned if the search is invalid or nested too deeply.
+func (s *Search) Predicate() (func(*domain.Event) bool, error) {
+	return s.compile(1)
+}
+
+func (s *Search) compile(depth int) (func(*domain.Event) bool, error) {
+	if depth > MaxSearchDepth {
+		return nil, errors.BadRequest("search is nested more than %d deep", MaxSearchDepth)
+	}
+
+	switch n := s.conditions(); {
+	case n == 0:
+		return nil, errors.BadRequest("search has no condition")
+	case n > 1:
+		return nil, errors.BadRequest("search has %d conditions, combine them with \"and\" or \"or\"", n)
+	}
+
+	switch {
+	case s.And != nil:
+		preds, err := compileAll(s.And, depth)
+		if err != nil {
+			return nil, err
+		}
+		return func(e *domain.Event) bool {
+			for _, p := range preds {
+				if !p(e) {
+					return false
+				}
+			}
+			return true
+		}, nil
+
+	case s.Or != nil:
+		preds, err := compileAll(s.Or, depth)
+		if err != nil {
+			return nil, err
+		}
+		return func(e *domain.Event) bool {
+			for _, p := range preds {
+				if p(e) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case s.Not != nil:
+		p, err := s.Not.compile(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(e *domain.Event) bool {
+			return !p(e)
+		}, nil
+
+	case s.Service != "":
+		patterns := []string{s.Service}
+		return func(e *domain.Event) bool {
+			return containsService(patterns, e.Service)
+		}, nil
+
+	case s.Message != "":
+		return func(e *domain.Event) bool {
+			return containsFold(e.Message, s.Message)
+		}, nil
+
+	case s.TraceID != "":
+		return func(e *domain.Event) bool {
+			return e.TraceID == s.TraceID
+		}, nil
+
+	case s.SeverityGTE != nil:
+		severity, err := slog.ParseSeverity(string(*s.SeverityGTE))
+		if err != nil {
+			return nil, errors.BadRequest("invalid severity_gte: %v", err)
+		}
+		return func(e *domain.Event) bool {
+			return e.Severity >= severity
+		}, nil
+
+	case s.SeverityLTE != nil:
+		severity, err := slog.ParseSeverity(string(*s.SeverityLTE))
+		if err != nil {
+			return nil, errors.BadRequest("invalid severity_lte: %v", err)
+		}
+		return func(e *domain.Event) bool {
+			return e.Severity <= severity
+		}, nil
+	}
+
+	return s.compileField()
+}
+
+// compileField returns a predicate that compares the field with each operator
+func (s *Search) compileField() (func(*domain.Event) bool, error) {
+	if s.Field == "" {
+		return nil, errors.BadRequest("comparison has no field")
+	}
+
+	var filters []FieldFilter
+	for _, c := range []struct {
+		op    string
+		value *SearchValue
+	}{
+		{OpEqual, s.Eq},
+		{OpGreater, s.Gt},
+		{OpGreaterOrEqual, s.Gte},
+		{OpLess, s.Lt},
+		{OpLessOrEqual, s.Lte},
+	} {
+		if c.value == nil {
+			continue
+		}
+
+		// Comparing a string with anything other than eq can never match
+		if c.op != OpEqual {
+			if _, err := strconv.ParseFloat(string(*c.value), 64); err != nil {
+				return nil, errors.BadRequest("field %q can only be compared with a number using %q", s.Field, c.op)
+			}
+		}
+
+		filters = append(filters, FieldFilter{Key: s.Field, Op: c.op, Value: string(*c.value)})
+	}
+
+	if len(filters) == 0 {
+		return nil, errors.BadRequest("field %q has no operator", s.Field)
+	}
+
+	return func(e *domain.Event) bool {
+		return containsFields(e.Fields, filters)
+	}, nil
+}
+
+// compileAll compiles each of the searches, which are one level deeper than depth
+func compileAll(searches []*Search, depth int) ([]func(*domain.Event) bool, error) {
+	if len(searches) == 0 {
+		return nil, errors.BadRequest("\"and\" and \"or\" need at least one search")
+	}
+
+	preds := make([]func(*domain.Event) bool, len(searches))
+	for i, search := range searches {
+		if search == nil {
+			return nil, errors.BadRequest("search has no condition")
+		}
+
+		p, err := search.compile(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		preds[i] = p
+	}
+
+	return preds, nil
+}
+
+// conditions returns the number of conditions that are set. A field
+// and its operators are a single condition. Operators without a field
+// are counted as a condition so that they are not silently ignored.
+func (s *Search) conditions() int {
+	n := 0
+	for _, set := range []bool{
+		s.And != nil,
+		s.Or != nil,
+		s.Not != nil,
+		s.Service != "",
+		s.Message != "",
+		s.TraceID != "",
+		s.SeverityGTE != nil,
+		s.SeverityLTE != nil,
+		s.Field != "" || s.Eq != nil || s.Gt != nil || s.Gte != nil || s.Lt != nil || s.Lte != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
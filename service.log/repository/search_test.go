@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+
+	"gotest.tools/assert"
+)
+
+func TestSearchPredicate(t *testing.T) {
+	tv := &domain.Event{Service: "service.tv", Severity: slog.InfoSeverity, Message: "Turned on", Fields: map[string]string{"status": "500"}}
+	hue := &domain.Event{Service: "service.hue", Severity: slog.ErrorSeverity, Message: "Bridge unreachable", TraceID: "abc"}
+	ok := &domain.Event{Service: "service.tv", Severity: slog.DebugSeverity, Fields: map[string]string{"status": "200"}}
+
+	tests := []struct {
+		name   string
+		search string
+		want   []bool // Whether each of tv, hue and ok match
+	}{
+		{"service", `{"service": "service.*"}`, []bool{true, true, true}},
+		{"message", `{"message": "BRIDGE"}`, []bool{false, true, false}},
+		{"trace", `{"trace_id": "abc"}`, []bool{false, true, false}},
+		{"severity by name", `{"severity_gte": "error"}`, []bool{false, true, false}},
+		{"severity by number", `{"severity_lte": 3}`, []bool{true, false, true}},
+		{"field string", `{"field": "status", "eq": "500"}`, []bool{true, false, false}},
+		{"field number", `{"field": "status", "eq": 500}`, []bool{true, false, false}},
+		{"field range", `{"field": "status", "gte": 100, "lt": 300}`, []bool{false, false, true}},
+		{"not", `{"not": {"service": "service.tv"}}`, []bool{false, true, false}},
+		{
+			"and or",
+			`{"and": [{"service": "service.tv"}, {"or": [{"field": "status", "eq": "500"}, {"severity_gte": 6}]}]}`,
+			[]bool{true, false, false},
+		},
+		{
+			"or and",
+			`{"or": [{"and": [{"service": "service.tv"}, {"severity_lte": "debug"}]}, {"trace_id": "abc"}]}`,
+			[]bool{false, true, true},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := ParseSearch([]byte(tc.search))
+			assert.NilError(t, err)
+			match, err := s.Predicate()
+			assert.NilError(t, err)
+
+			assert.DeepEqual(t, []bool{match(tv), match(hue), match(ok)}, tc.want)
+		})
+	}
+}
+
+func TestSearchPredicateInvalid(t *testing.T) {
+	// Nest one level deeper than allowed
+	deep := strings.Repeat(`{"not": `, MaxSearchDepth) + `{"service": "service.tv"}` + strings.Repeat(`}`, MaxSearchDepth)
+
+	tests := []struct {
+		name   string
+		search string
+	}{
+		{"empty", `{}`},
+		{"two conditions", `{"service": "service.tv", "message": "on"}`},
+		{"empty and", `{"and": []}`},
+		{"null in or", `{"or": [null]}`},
+		{"field without operator", `{"field": "status"}`},
+		{"operator without field", `{"eq": "500"}`},
+		{"string range", `{"field": "status", "gt": "abc"}`},
+		{"unknown severity", `{"severity_gte": "loud"}`},
+		{"too deep", deep},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := ParseSearch([]byte(tc.search))
+			assert.NilError(t, err)
+			_, err = s.Predicate()
+			assert.Assert(t, err != nil)
+		})
+	}
+
+	// The deepest allowed search is fine
+	s, err := ParseSearch([]byte(strings.Repeat(`{"not": `, MaxSearchDepth-1) + `{"service": "service.tv"}` + strings.Repeat(`}`, MaxSearchDepth-1)))
+	assert.NilError(t, err)
+	_, err = s.Predicate()
+	assert.NilError(t, err)
+
+	// Unknown keys are rejected rather than ignored
+	_, err = ParseSearch([]byte(`{"servce": "service.tv"}`))
+	assert.Assert(t, err != nil)
+}
@@ -0,0 +1,277 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/service.log/domain"
+)
+
+// maxPositions is the most event positions that are remembered
+const maxPositions = 1024
+
+// position is where the lines of an event are in a log file
+type position struct {
+	filename string
+
+	// date is the day of the log file
+	date time.Time
+
+	// start and end are the offsets of the event's first
+	// byte and of the byte after its trailing new line
+	start int64
+	end   int64
+
+	// first is the start of the first of the events just before it in the
+	// file with the same timestamp, or start if there are none. They could
+	// come after it in the order of domain.Event.Before so are read too.
+	first int64
+}
+
+// positionCache maps the UUIDs of events to their positions
+type positionCache struct {
+	mux       sync.Mutex
+	positions map[string]*position
+}
+
+func (c *positionCache) get(uuid string) (*position, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	pos, ok := c.positions[uuid]
+	return pos, ok
+}
+
+func (c *positionCache) put(uuid string, pos *position) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.positions == nil {
+		c.positions = map[string]*position{}
+	}
+
+	// Forget an arbitrary position to make room. The positions
+	// of events that are still being followed are put back on the
+	// next call so they are quickly remembered again.
+	if len(c.positions) >= maxPositions {
+		for k := range c.positions {
+			delete(c.positions, k)
+			break
+		}
+	}
+
+	c.positions[uuid] = pos
+}
+
+func (c *positionCache) remove(uuid string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.positions, uuid)
+}
+
+// FindSince returns the same events as Find for a query with a SinceUUID,
+// but is intended for following the log, where the query is repeated with
+// SinceUUID moved on to the newest event each time. Rather than searching
+// the whole time window again, the log file that contains the SinceUUID
+// event is only read from that event onwards, along with the events just
+// before it at the same time and any log files that have been started
+// since. The position of the newest event that is returned is remembered
+// for the next call.
+//
+// If the position of the SinceUUID event is not known and it is not in one
+// of today's log files, e.g. because its file has since been rotated, or if
+// the query has an UntilUUID, Offset, Tail, Dedupe or CountTotal, Find is
+// used instead.
+func (r *LogRepository) FindSince(ctx context.Context, q *LogQuery) ([]*domain.Event, error) {
+	if q.SinceUUID == "" || q.UntilUUID != "" || q.Offset > 0 || q.Tail > 0 || q.Dedupe || q.CountTotal {
+		return r.Find(ctx, q)
+	}
+
+	if ok, err := q.prepare(); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, nil
+	}
+
+	pos, ok := r.positions.get(q.SinceUUID)
+	if !ok {
+		var err error
+		pos, err = r.locate(ctx, q.SinceUUID, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pos == nil {
+		return r.Find(ctx, q)
+	}
+
+	events, err := r.findAfter(ctx, q, pos)
+	if err != nil {
+		return nil, err
+	}
+	if events == nil {
+		// The file has changed so the position is no longer valid
+		r.positions.remove(q.SinceUUID)
+		return r.Find(ctx, q)
+	}
+
+	if !q.Reverse {
+		reverse(events)
+	}
+
+	return events, nil
+}
+
+// findAfter returns the events that match the query after the SinceUUID
+// event at pos, newest first. Nil is returned if the SinceUUID event is
+// no longer at pos. An empty slice is returned if there are no events.
+func (r *LogRepository) findAfter(ctx context.Context, q *LogQuery, pos *position) ([]*domain.Event, error) {
+	data, err := r.store().ReadFrom(pos.filename, pos.first)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.MarkRetryable(err, map[string]string{"filename": pos.filename})
+	}
+
+	// The SinceUUID event must still end where it did before. If
+	// the file has been replaced by a shorter one, it won't be.
+	groups, ends := r.splitGroupsAt(data)
+	k := sort.Search(len(ends), func(i int) bool {
+		return ends[i] >= pos.end-pos.first
+	})
+	if k == len(ends) || ends[k] != pos.end-pos.first {
+		return nil, nil
+	}
+	since := r.newEvent(groups[k])
+	if since.UUID != q.SinceUUID {
+		return nil, nil
+	}
+
+	// Events in every file at the same time as the SinceUUID event are
+	// compared with it so the groups before it at that time are included
+	sq := boundSince(q, since)
+
+	maxResults := r.maxResults()
+	max := maxResults
+	if q.Limit > 0 && q.Limit < maxResults {
+		max = q.Limit
+	}
+
+	result := r.matchGroups(ctx, pos.filename, groups, sq, max)
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	// Read the files of the same day in other directories and of every day
+	// since in full. They are read newest first, like Find, so that events
+	// without a UUID at the same time are in the same order.
+	events := []*domain.Event{}
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for date := today; !date.Before(pos.date); date = date.AddDate(0, 0, -1) {
+		for _, filename := range r.logFiles(date) {
+			if filename == pos.filename {
+				events = append(events, result.events...)
+				continue
+			}
+
+			other := r.findInFile(ctx, filename, sq, max)
+			if os.IsNotExist(other.err) {
+				continue
+			} else if other.err != nil {
+				return nil, other.err
+			}
+
+			events = append(events, other.events...)
+		}
+	}
+
+	sortNewestFirst(events)
+	if len(events) > max {
+		events = events[:max]
+	}
+
+	// Remember where the newest event is if it is in the same file. If it
+	// is in another file, the next call finds it in today's files instead.
+	if len(events) > 0 && events[0] == result.newest {
+		newest := r.positionOf(pos.filename, pos.date, groups, ends, result.newestGroup)
+		newest.start += pos.first
+		newest.end += pos.first
+		newest.first += pos.first
+		r.positions.put(events[0].UUID, newest)
+	}
+
+	return events, nil
+}
+
+// locate searches the log files for the date for the event with the UUID
+// and remembers its position. Nil is returned if the event is not found.
+func (r *LogRepository) locate(ctx context.Context, uuid string, date time.Time) (*position, error) {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+
+	for _, filename := range r.logFiles(day) {
+		data, err := r.store().ReadFrom(filename, 0)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.MarkRetryable(err, map[string]string{"filename": filename})
+		}
+
+		// The event is probably near the end so search backwards
+		groups, ends := r.splitGroupsAt(data)
+		for i := len(groups) - 1; i >= 0; i-- {
+			if (len(groups)-1-i)%cancelCheckInterval == 0 {
+				if err := cancelled(ctx); err != nil {
+					return nil, err
+				}
+			}
+
+			// Only lines written by logstash contain the UUID
+			// so only they can be skipped without parsing
+			if r.LineFormat == nil && !bytes.Contains(groups[i][0], []byte(uuid)) {
+				continue
+			}
+			if r.newEvent(groups[i]).UUID != uuid {
+				continue
+			}
+
+			pos := r.positionOf(filename, day, groups, ends, i)
+			r.positions.put(uuid, pos)
+			return pos, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// positionOf returns the position of group i, given the offsets of the end
+// of each group, relative to the start of the data that they were split from
+func (r *LogRepository) positionOf(filename string, date time.Time, groups [][][]byte, ends []int64, i int) *position {
+	groupStart := func(i int) int64 {
+		if i == 0 {
+			return 0
+		}
+		return ends[i-1]
+	}
+
+	pos := &position{
+		filename: filename,
+		date:     date,
+		start:    groupStart(i),
+		end:      ends[i],
+	}
+
+	// Include the events just before it at the same time
+	pos.first = pos.start
+	timestamp := r.newEvent(groups[i]).Timestamp
+	for j := i - 1; j >= 0 && r.newEvent(groups[j]).Timestamp.Equal(timestamp); j-- {
+		pos.first = groupStart(j)
+	}
+
+	return pos
+}
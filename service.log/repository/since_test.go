@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func sinceUUIDs(t *testing.T, r *LogRepository, q *LogQuery) []string {
+	events, err := r.FindSince(context.Background(), q)
+	assert.NilError(t, err)
+
+	var u []string
+	for _, e := range events {
+		u = append(u, e.UUID)
+	}
+	return u
+}
+
+// appendLines writes the lines to the end of the file
+func appendLines(t *testing.T, filename string, lines ...string) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	assert.NilError(t, err)
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+}
+
+func TestFindSince(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.bar", "info", "b"),
+		line("3", "service.foo", "info", "c"),
+	)
+	defer cleanup()
+	filename := r.ActiveLogFiles()[0]
+
+	q := &LogQuery{Services: []string{"service.foo"}, SinceUUID: "1"}
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), []string{"3"})
+
+	// The position of the newest event is remembered
+	_, ok := r.positions.get("3")
+	assert.Assert(t, ok)
+
+	appendLines(t, filename,
+		line("4", "service.foo", "info", "d"),
+		line("5", "service.bar", "info", "e"),
+		line("6", "service.foo", "info", "f\n  continued"),
+	)
+
+	q.SinceUUID = "3"
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), []string{"4", "6"})
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), uuids(t, r, q))
+
+	q.SinceUUID = "6"
+	assert.Equal(t, len(sinceUUIDs(t, r, q)), 0)
+
+	q.Reverse = true
+	q.SinceUUID = "3"
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), []string{"6", "4"})
+}
+
+func TestFindSinceUUIDInclusive(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	r, cleanup := newTestRepository(t,
+		lineAt("1", now.Add(-time.Second)),
+		lineAt("3", now),
+		lineAt("2", now),
+		lineAt("4", now),
+		lineAt("5", now.Add(time.Second)),
+	)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		q    *LogQuery
+		want []string
+	}{
+		{"exclusive", &LogQuery{SinceUUID: "1"}, []string{"2", "3", "4", "5"}},
+		{"inclusive", &LogQuery{SinceUUID: "1", SinceUUIDInclusive: true}, []string{"1", "2", "3", "4", "5"}},
+		{"exclusive at the same time", &LogQuery{SinceUUID: "3"}, []string{"4", "5"}},
+		{"inclusive at the same time", &LogQuery{SinceUUID: "3", SinceUUIDInclusive: true}, []string{"3", "4", "5"}},
+		{"inclusive reversed", &LogQuery{SinceUUID: "3", SinceUUIDInclusive: true, Reverse: true}, []string{"5", "4", "3"}},
+		{"inclusive with until", &LogQuery{SinceUUID: "3", SinceUUIDInclusive: true, UntilUUID: "4", IncludeUntil: true}, []string{"3", "4"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.DeepEqual(t, uuids(t, r, tc.q), tc.want)
+
+			// Resuming from a remembered position gives the same events
+			assert.DeepEqual(t, sinceUUIDs(t, r, tc.q), tc.want)
+			assert.DeepEqual(t, sinceUUIDs(t, r, tc.q), tc.want)
+		})
+	}
+}
+
+func TestFindSinceRotated(t *testing.T) {
+	// The events were written just before the file was rotated at midnight
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	r, cleanup := newTestRepository(t,
+		lineAt("1", midnight.Add(-2*time.Second)),
+		lineAt("2", midnight.Add(-time.Second)),
+	)
+	defer cleanup()
+	filename := r.ActiveLogFiles()[0]
+
+	q := &LogQuery{SinceUUID: "1"}
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), []string{"2"})
+
+	// Rotate the file so that the remembered position of event 2 is gone
+	yesterday := filepath.Join(filepath.Dir(filename), fmt.Sprintf("messages-%s", time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")))
+	assert.NilError(t, os.Rename(filename, yesterday))
+	appendLines(t, filename, line("3", "service.foo", "info", "c"))
+
+	q.SinceUUID = "2"
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), []string{"3"})
+
+	// An event in a rotated file is not in today's file either
+	r.positions.remove("1")
+	q.SinceUUID = "1"
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), []string{"2", "3"})
+}
+
+func TestFindSinceNewDay(t *testing.T) {
+	r, cleanup := newTestRepository(t, line("3", "service.foo", "info", "c"))
+	defer cleanup()
+	filename := r.ActiveLogFiles()[0]
+
+	// The SinceUUID event is in yesterday's file, which is still remembered
+	date := time.Now().UTC().AddDate(0, 0, -1)
+	yesterday := r.logFiles(date)[0]
+	appendLines(t, yesterday,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.foo", "info", "b"),
+	)
+	pos, err := r.locate(context.Background(), "1", date)
+	assert.NilError(t, err)
+	assert.Equal(t, pos.filename, yesterday)
+	assert.Assert(t, filename != yesterday)
+
+	assert.DeepEqual(t, sinceUUIDs(t, r, &LogQuery{SinceUUID: "1"}), []string{"2", "3"})
+}
+
+func TestFindSinceReplacedFile(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.foo", "info", "b"),
+	)
+	defer cleanup()
+	filename := r.ActiveLogFiles()[0]
+
+	q := &LogQuery{SinceUUID: "1"}
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), []string{"2"})
+
+	// Event 2 is no longer where it was remembered
+	assert.NilError(t, os.Remove(filename))
+	appendLines(t, filename,
+		line("2", "service.foo", "info", "b"),
+		line("3", "service.foo", "info", "c"),
+	)
+
+	q.SinceUUID = "2"
+	assert.DeepEqual(t, sinceUUIDs(t, r, q), []string{"3"})
+}
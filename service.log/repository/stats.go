@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+)
+
+// statsServicesWindow is how far back Stats looks for distinct services
+const statsServicesWindow = 24 * time.Hour
+
+// RepoStats summarises the log files in the repository
+type RepoStats struct {
+	// Files is the number of log files, including rotated files
+	Files int `json:"files"`
+
+	// TotalBytes is the size of all of the log files on disk
+	TotalBytes int64 `json:"total_bytes"`
+
+	// OldestEvent and NewestEvent are the timestamps of the first event
+	// in the oldest log file and the last event in the newest log file.
+	// They are the zero time if there are no events.
+	OldestEvent time.Time `json:"oldest_event"`
+	NewestEvent time.Time `json:"newest_event"`
+
+	// Services is the number of distinct services
+	// that have written events in the last day
+	Services int `json:"services"`
+}
+
+// Stats returns a summary of the log files. Only the oldest and newest files
+// are read to find the time range of the events, rather than every file.
+func (r *LogRepository) Stats(ctx context.Context) (*RepoStats, error) {
+	files, err := r.LogFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &RepoStats{Files: len(files)}
+
+	// Group the files by the date in their name
+	byDate := map[string][]string{}
+	var dates []string
+	for _, filename := range files {
+		size, err := r.store().Size(filename)
+		if os.IsNotExist(err) {
+			// The file could have been purged since the list was made
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, map[string]string{"filename": filename})
+		}
+		stats.TotalBytes += size
+
+		date := logFileDate(filename)
+		if _, ok := byDate[date]; !ok {
+			dates = append(dates, date)
+		}
+		byDate[date] = append(byDate[date], filename)
+	}
+
+	// The dates are formatted so that they sort chronologically
+	sort.Strings(dates)
+
+	// Work inwards from each end in case the files at the ends have no events
+	for _, date := range dates {
+		if stats.OldestEvent, err = r.eventTimeInFiles(byDate[date], r.OldestEventTime, time.Time.Before); err != nil {
+			return nil, err
+		}
+		if !stats.OldestEvent.IsZero() {
+			break
+		}
+	}
+	for i := len(dates) - 1; i >= 0; i-- {
+		if stats.NewestEvent, err = r.eventTimeInFiles(byDate[dates[i]], r.NewestEventTime, time.Time.After); err != nil {
+			return nil, err
+		}
+		if !stats.NewestEvent.IsZero() {
+			break
+		}
+	}
+
+	now := time.Now()
+	services, err := r.DistinctServices(ctx, now.Add(-statsServicesWindow), now)
+	if err != nil {
+		return nil, err
+	}
+	stats.Services = len(services)
+
+	return stats, nil
+}
+
+// OldestEventTime returns the timestamp of the first event in the log file
+// without reading the rest of it. The zero time is returned if the file
+// contains no events.
+func (r *LogRepository) OldestEventTime(filename string) (time.Time, error) {
+	f, err := r.store().Open(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	start := r.eventStart()
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 && start.Match(line) {
+			// Find the first event with a timestamp, ignoring any that failed to parse
+			if t := r.parseLine(line).Timestamp; !t.IsZero() {
+				return t, nil
+			}
+		}
+
+		if err == io.EOF {
+			return time.Time{}, nil
+		} else if err != nil {
+			return time.Time{}, errors.Wrap(err, nil)
+		}
+	}
+}
+
+// eventTimeInFiles returns the time given by eventTime for the file
+// that is first according to less. Missing and empty files are ignored.
+func (r *LogRepository) eventTimeInFiles(files []string, eventTime func(string) (time.Time, error), less func(time.Time, time.Time) bool) (time.Time, error) {
+	var result time.Time
+	for _, filename := range files {
+		t, err := eventTime(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return time.Time{}, errors.Wrap(err, map[string]string{"filename": filename})
+		}
+
+		if !t.IsZero() && (result.IsZero() || less(t, result)) {
+			result = t
+		}
+	}
+	return result, nil
+}
+
+// logFileDate returns the date in the log file's name, e.g. "2006-01-02"
+// for messages-2006-01-02.1.gz, or the whole name if it has no date
+func logFileDate(filename string) string {
+	name := strings.TrimPrefix(filepath.Base(filename), "messages-")
+	if len(name) < len("2006-01-02") {
+		return name
+	}
+	return name[:len("2006-01-02")]
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestStats(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	old := now.Add(-36 * time.Hour)
+
+	event := func(service string, timestamp time.Time) string {
+		return fmt.Sprintf(
+			`{"uuid":"1","@timestamp":%q,"service":%q,"severity":"info","message":"a"}`,
+			timestamp.Format(time.RFC3339), service,
+		)
+	}
+
+	r, cleanup := newTestRepository(t,
+		event("service.foo", now.Add(-2*time.Minute)),
+		event("service.bar", now.Add(-time.Minute)),
+		event("service.foo", now),
+	)
+	defer cleanup()
+
+	// Yesterday's file only has events from a service that has since stopped
+	yesterday := now.AddDate(0, 0, -1)
+	filename := filepath.Join(r.LogDirectories[0], fmt.Sprintf("messages-%s", yesterday.Format("2006-01-02")))
+	content := event("service.old", old) + "\n" + event("service.old", old.Add(time.Minute)) + "\n"
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+
+	stats, err := r.Stats(context.Background())
+	assert.NilError(t, err)
+
+	var size int64
+	files, err := r.LogFiles()
+	assert.NilError(t, err)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		assert.NilError(t, err)
+		size += info.Size()
+	}
+
+	assert.Equal(t, stats.Files, 2)
+	assert.Equal(t, stats.TotalBytes, size)
+	assert.Assert(t, stats.OldestEvent.Equal(old), stats.OldestEvent)
+	assert.Assert(t, stats.NewestEvent.Equal(now), stats.NewestEvent)
+	assert.Equal(t, stats.Services, 2)
+}
+
+func TestStatsEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	stats, err := NewLogRepository(dir).Stats(context.Background())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, stats, &RepoStats{})
+}
+
+func TestLogFileDate(t *testing.T) {
+	assert.Equal(t, logFileDate("/var/log/messages-2006-01-02"), "2006-01-02")
+	assert.Equal(t, logFileDate("/var/log/messages-2006-01-02.1.gz"), "2006-01-02")
+	assert.Equal(t, logFileDate("/var/log/messages-old"), "old")
+}
@@ -0,0 +1,169 @@
+package repository
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+)
+
+// LogStore is where a LogRepository reads log files from. Files are
+// identified by name and hold lines of events in the order they were
+// written. Errors that satisfy os.IsNotExist are returned as-is if a
+// file does not exist so that missing days can be skipped.
+type LogStore interface {
+	// Files returns the names of the files that hold the events of the date
+	Files(date time.Time) []string
+
+	// List returns the names of every file in the store
+	List() ([]string, error)
+
+	// Open returns a reader of the file's contents from the start. A file
+	// that has been compressed is decompressed. If the reader can also
+	// seek and be stat'd, like an *os.File, the file is indexed by time.
+	Open(name string) (io.ReadCloser, error)
+
+	// ReadFrom returns the contents of the file from the offset onwards
+	ReadFrom(name string, offset int64) ([]byte, error)
+
+	// Size returns the number of bytes in the file as it is stored
+	Size(name string) (int64, error)
+}
+
+// FileLogStore is a LogStore of the log files on the local filesystem
+type FileLogStore struct {
+	// Directories contain daily log files named messages-2006-01-02
+	// which are optionally compressed with a ".gz" suffix once rotated
+	Directories []string
+
+	// File is a single log file to read instead of the daily log files
+	// in Directories. It is returned as the file for every date.
+	File string
+}
+
+// Files returns the path of the log file for the date in each
+// directory, or the File if the store has a single file
+func (s *FileLogStore) Files(date time.Time) []string {
+	if s.File != "" {
+		return []string{s.File}
+	}
+
+	filenames := make([]string, len(s.Directories))
+	for i, dir := range s.Directories {
+		filenames[i] = filepath.Join(dir, fmt.Sprintf("messages-%s", date.Format("2006-01-02")))
+	}
+	return filenames
+}
+
+// List returns the paths of all log files in the
+// directories, including any that have been rotated
+func (s *FileLogStore) List() ([]string, error) {
+	if s.File != "" {
+		return []string{s.File}, nil
+	}
+
+	var files []string
+	for _, dir := range s.Directories {
+		matches, err := filepath.Glob(filepath.Join(dir, "messages-*"))
+		if err != nil {
+			return nil, errors.Wrap(err, nil)
+		}
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// Open opens the log file, falling back to the file rotated
+// with a ".gz" suffix. Files with a ".gz" suffix are decompressed.
+func (s *FileLogStore) Open(name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, ".gz") {
+		return openGzipFile(name)
+	}
+
+	f, err := os.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, nil)
+	}
+
+	gz, err := openGzipFile(name + ".gz")
+	if err != nil {
+		return nil, err
+	}
+
+	return gz, nil
+}
+
+// ReadFrom returns the contents of the uncompressed log file from offset
+// onwards. Files that have been rotated and compressed are not read.
+func (s *FileLogStore) ReadFrom(name string, offset int64) ([]byte, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, nil)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, nil)
+	}
+
+	return readAll(f)
+}
+
+// Size returns the size of the log file, falling back to
+// the compressed size of the file rotated with a ".gz" suffix
+func (s *FileLogStore) Size(name string) (int64, error) {
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) && !strings.HasSuffix(name, ".gz") {
+		info, err = os.Stat(name + ".gz")
+	}
+	if os.IsNotExist(err) {
+		return 0, err
+	} else if err != nil {
+		return 0, errors.Wrap(err, nil)
+	}
+
+	return info.Size(), nil
+}
+
+// openGzipFile opens the file and returns a reader of its decompressed contents
+func openGzipFile(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, nil)
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, map[string]string{"filename": filename})
+	}
+
+	return &gzipFile{Reader: zr, file: f}, nil
+}
+
+// gzipFile closes both the gzip reader and the underlying file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	if err := f.Reader.Close(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// memoryStore is a LogStore of files held in memory
+type memoryStore map[string][]byte
+
+func (s memoryStore) Files(date time.Time) []string {
+	return []string{fmt.Sprintf("messages-%s", date.Format("2006-01-02"))}
+}
+
+func (s memoryStore) List() ([]string, error) {
+	var names []string
+	for name := range s {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s memoryStore) Open(name string) (io.ReadCloser, error) {
+	data, ok := s[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s memoryStore) ReadFrom(name string, offset int64) ([]byte, error) {
+	data, ok := s[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data[offset:], nil
+}
+
+func (s memoryStore) Size(name string) (int64, error) {
+	data, ok := s[name]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(data)), nil
+}
+
+func TestFindMemoryStore(t *testing.T) {
+	store := memoryStore{}
+	today := store.Files(time.Now().UTC())[0]
+	store[today] = []byte(strings.Join([]string{
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.bar", "error", "b"),
+		line("3", "service.foo", "info", "c"),
+	}, "\n") + "\n")
+
+	r := &LogRepository{Store: store}
+	q := &LogQuery{Services: []string{"service.foo"}}
+	assert.DeepEqual(t, uuids(t, r, q), []string{"1", "3"})
+
+	latest, err := r.Latest(context.Background(), q)
+	assert.NilError(t, err)
+	assert.Equal(t, latest.UUID, "3")
+
+	stats, err := r.Stats(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, stats.Files, 1)
+	assert.Equal(t, stats.TotalBytes, int64(len(store[today])))
+
+	// Events written after the SinceUUID event are found from where it was
+	store[today] = append(store[today], line("4", "service.foo", "info", "d")+"\n"...)
+	events, err := r.FindSince(context.Background(), &LogQuery{SinceUUID: "3"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].UUID, "4")
+}
@@ -0,0 +1,427 @@
+package repository
+
+import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/service.log/domain"
+)
+
+// EventIterator reads the events that match a query one at a time
+//
+//	it, err := r.Iterate(ctx, q)
+//	if err != nil { ... }
+//	for it.Next() {
+//		event := it.Event()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type EventIterator interface {
+	// Next moves on to the next event and returns whether there is one.
+	// It returns false once every event has been read or if reading fails.
+	Next() bool
+
+	// Event returns the event that Next moved on to
+	Event() *domain.Event
+
+	// Err returns the error that stopped Next, if any
+	Err() error
+}
+
+// Iterate returns an iterator over the events that match the query, in the
+// order given by Reverse. The log files are read lazily, a batch of days at
+// a time, so the number of events is not limited by MaxResults. Find reads
+// events with the same iterator.
+//
+// Newest first, reading stops as soon as the Limit or Tail is reached.
+// Oldest first, the page of Limit events is found newest first and held in
+// memory, and an Offset without a Limit needs the events counting first so
+// the log files are read twice. CountTotal is ignored.
+func (r *LogRepository) Iterate(ctx context.Context, q *LogQuery) (EventIterator, error) {
+	if q.Tail > 0 {
+		return r.Iterate(ctx, tailQuery(q))
+	}
+
+	if ok, err := q.prepare(); err != nil {
+		return nil, err
+	} else if !ok {
+		return &sliceIterator{}, nil
+	}
+
+	q, err := r.boundUUIDs(ctx, q)
+	if err != nil {
+		return nil, err
+	} else if q == nil {
+		return &sliceIterator{}, nil
+	}
+
+	switch {
+	case q.Reverse:
+		return r.iterate(ctx, q, true, r.perFile(q, q.Limit)), nil
+
+	case q.Limit > 0:
+		// The page is the newest events after the offset so it has to be
+		// found newest first, but it is no bigger than the limit
+		var events []*domain.Event
+		it := r.iterate(ctx, q, true, r.perFile(q, q.Limit))
+		for it.Next() {
+			events = append(events, it.Event())
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		reverse(events)
+		return &sliceIterator{events: events}, nil
+
+	case q.Offset > 0:
+		// The offset is counted from the newest event so the oldest
+		// events are the ones before the last q.Offset events
+		cq := *q
+		cq.Offset = 0
+		var n int
+		it := r.iterate(ctx, &cq, true, math.MaxInt32)
+		for it.Next() {
+			n++
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		} else if n <= q.Offset {
+			return &sliceIterator{}, nil
+		}
+
+		cq.Limit = n - q.Offset
+		return r.iterate(ctx, &cq, false, math.MaxInt32), nil
+	}
+
+	return r.iterate(ctx, q, false, math.MaxInt32), nil
+}
+
+// FindStream calls fn with each event that matches the query, in the same
+// way as Iterate, and stops if fn returns an error
+func (r *LogRepository) FindStream(ctx context.Context, q *LogQuery, fn func(*domain.Event) error) error {
+	it, err := r.Iterate(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	for it.Next() {
+		if err := fn(it.Event()); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// iterate returns an iterator over the events that match the query, newest
+// first or oldest first, with Dedupe, Offset and Limit applied in that order.
+// The Offset is only correct newest first. Each log file only needs to produce
+// up to perFile events, after which older days are not read.
+func (r *LogRepository) iterate(ctx context.Context, q *LogQuery, newestFirst bool, perFile int) EventIterator {
+	days := r.daysInWindow(q)
+	if !newestFirst {
+		// Read the oldest day first
+		for left, right := 0, len(days)-1; left < right; left, right = left+1, right-1 {
+			days[left], days[right] = days[right], days[left]
+		}
+	}
+
+	var it EventIterator = &dayIterator{
+		ctx:         ctx,
+		r:           r,
+		q:           q,
+		days:        days,
+		newestFirst: newestFirst,
+		perFile:     perFile,
+	}
+
+	if q.Dedupe {
+		it = &dedupeIterator{it: it, newestFirst: newestFirst}
+	}
+
+	if q.Offset > 0 || q.Limit > 0 {
+		it = &pageIterator{it: it, offset: q.Offset, limit: q.Limit}
+	}
+
+	return it
+}
+
+// perFile returns the number of events that each log file needs to produce,
+// newest first, to find the first n events after the query's offset. Deduping
+// could need more so it is not limited.
+func (r *LogRepository) perFile(q *LogQuery, n int) int {
+	if n <= 0 || q.Dedupe {
+		return math.MaxInt32
+	}
+	return q.Offset + n
+}
+
+// dayIterator reads the log files of a batch of days at a time, in order,
+// and iterates over the events from them that match the query
+type dayIterator struct {
+	ctx         context.Context
+	r           *LogRepository
+	q           *LogQuery
+	days        [][]string // The log files of the days that are still to be read
+	newestFirst bool       // The order of the days and the events
+	perFile     int        // The number of events to read from each file
+
+	events []*domain.Event // The events that are still to be returned
+	event  *domain.Event
+	err    error
+}
+
+func (it *dayIterator) Next() bool {
+	for len(it.events) == 0 {
+		if it.err != nil || len(it.days) == 0 {
+			it.event = nil
+			return false
+		}
+
+		it.events, it.err = it.readBatch()
+	}
+
+	it.event, it.events = it.events[0], it.events[1:]
+	return true
+}
+
+func (it *dayIterator) Event() *domain.Event {
+	return it.event
+}
+
+func (it *dayIterator) Err() error {
+	return it.err
+}
+
+// readBatch reads the next batch of days concurrently and returns
+// the events from them that match the query, in order
+func (it *dayIterator) readBatch() ([]*domain.Event, error) {
+	if err := cancelled(it.ctx); err != nil {
+		return nil, err
+	}
+
+	n := it.r.workers()
+	if n > len(it.days) {
+		n = len(it.days)
+	}
+	days := it.days[:n]
+	it.days = it.days[n:]
+
+	// Read every file of every day concurrently
+	results := make([][]*fileResult, len(days))
+	var wg sync.WaitGroup
+	for i, filenames := range days {
+		results[i] = make([]*fileResult, len(filenames))
+		for j, filename := range filenames {
+			wg.Add(1)
+			go func(i, j int, filename string) {
+				defer wg.Done()
+				results[i][j] = it.r.findInFile(it.ctx, filename, it.q, it.perFile)
+			}(i, j, filename)
+		}
+	}
+	wg.Wait()
+
+	var events []*domain.Event
+	for _, dayResults := range results {
+		var dayEvents []*domain.Event
+		var last bool
+		for _, result := range dayResults {
+			if os.IsNotExist(result.err) {
+				// A single file is expected to exist but others
+				// could have been purged since the list was made
+				if it.r.File != "" {
+					return nil, errors.Wrap(result.err, map[string]string{"filename": it.r.File})
+				}
+				continue
+			} else if result.err != nil {
+				return nil, result.err
+			}
+
+			dayEvents = append(dayEvents, result.events...)
+
+			// Older days are not needed once a file has reached the start
+			// of the time window or produced as many events as are needed
+			last = last || result.done || len(result.events) >= it.perFile
+		}
+
+		// Order the events newest first, which merges the events from each
+		// directory. Events with the same timestamp are ordered by UUID so
+		// the order does not depend on which file they are in. The sort is
+		// stable so events without a UUID stay in the order they were written.
+		sortNewestFirst(dayEvents)
+		if !it.newestFirst {
+			reverse(dayEvents)
+		}
+		events = append(events, dayEvents...)
+
+		if last && it.newestFirst {
+			it.days = nil
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// dedupeIterator collapses each run of consecutive events with the same
+// service and message into the newest event of the run, which has its
+// RepeatCount set to the length of the run
+type dedupeIterator struct {
+	it          EventIterator
+	newestFirst bool
+
+	next  *domain.Event // The first event of the next run
+	event *domain.Event
+}
+
+func (it *dedupeIterator) Next() bool {
+	if it.next == nil {
+		if !it.it.Next() {
+			it.event = nil
+			return false
+		}
+		it.next = it.it.Event()
+	}
+
+	// Read to the end of the run, which is the
+	// first event that is not the same as it
+	run := it.next
+	newest := run
+	count := 1
+	it.next = nil
+	for it.it.Next() {
+		event := it.it.Event()
+		if !sameLine(run, event) {
+			it.next = event
+			break
+		}
+		count++
+		if !it.newestFirst {
+			newest = event
+		}
+	}
+
+	if count > 1 {
+		newest.RepeatCount = count
+	}
+	it.event = newest
+	return true
+}
+
+func (it *dedupeIterator) Event() *domain.Event {
+	return it.event
+}
+
+func (it *dedupeIterator) Err() error {
+	return it.it.Err()
+}
+
+// pageIterator skips the first offset events and
+// then stops after limit events, unless it is zero
+type pageIterator struct {
+	it     EventIterator
+	offset int
+	limit  int
+
+	n     int // The number of events returned so far
+	event *domain.Event
+}
+
+func (it *pageIterator) Next() bool {
+	it.event = nil
+	if it.limit > 0 && it.n >= it.limit {
+		return false
+	}
+
+	for ; it.offset > 0; it.offset-- {
+		if !it.it.Next() {
+			return false
+		}
+	}
+
+	if !it.it.Next() {
+		return false
+	}
+
+	it.event = it.it.Event()
+	it.n++
+	return true
+}
+
+func (it *pageIterator) Event() *domain.Event {
+	return it.event
+}
+
+func (it *pageIterator) Err() error {
+	return it.it.Err()
+}
+
+// sliceIterator iterates over events that have already been found
+type sliceIterator struct {
+	events []*domain.Event
+	event  *domain.Event
+}
+
+func (it *sliceIterator) Next() bool {
+	if len(it.events) == 0 {
+		it.event = nil
+		return false
+	}
+	it.event, it.events = it.events[0], it.events[1:]
+	return true
+}
+
+func (it *sliceIterator) Event() *domain.Event {
+	return it.event
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+// daysInWindow returns the log files that could contain events in the
+// query's time window, grouped by day, newest first. Like Find, it stops
+// at the first day that does not have a log file in any directory.
+func (r *LogRepository) daysInWindow(q *LogQuery) [][]string {
+	// A single file could contain events from any day
+	if r.File != "" {
+		return [][]string{{r.File}}
+	}
+
+	var days [][]string
+	for date := time.Now().UTC(); ; date = date.AddDate(0, 0, -1) {
+		// Skip files that are entirely after the time window
+		dayStart := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		if !q.UntilTime.IsZero() && dayStart.After(q.UntilTime) {
+			continue
+		}
+
+		// Stop once the files are entirely before the time window
+		if !q.SinceTime.IsZero() && dayStart.AddDate(0, 0, 1).Before(q.SinceTime) {
+			return days
+		}
+
+		var filenames []string
+		for _, filename := range r.logFiles(date) {
+			if r.logFileExists(filename) {
+				filenames = append(filenames, filename)
+			}
+		}
+		if len(filenames) == 0 {
+			return days
+		}
+
+		days = append(days, filenames)
+	}
+}
+
+// logFileExists returns whether the log file exists, either
+// as it was written or compressed after being rotated
+func (r *LogRepository) logFileExists(filename string) bool {
+	_, err := r.store().Size(filename)
+	return err == nil
+}
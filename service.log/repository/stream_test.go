@@ -0,0 +1,220 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+
+	"gotest.tools/assert"
+)
+
+// streamUUIDs returns the UUIDs of the events streamed by FindStream
+func streamUUIDs(t *testing.T, r *LogRepository, q *LogQuery) []string {
+	var u []string
+	err := r.FindStream(context.Background(), q, func(e *domain.Event) error {
+		u = append(u, e.UUID)
+		return nil
+	})
+	assert.NilError(t, err)
+	return u
+}
+
+// iterateUUIDs returns the UUIDs of the events read by an iterator
+func iterateUUIDs(t *testing.T, r *LogRepository, q *LogQuery) []string {
+	it, err := r.Iterate(context.Background(), q)
+	assert.NilError(t, err)
+
+	var u []string
+	for it.Next() {
+		u = append(u, it.Event().UUID)
+	}
+	assert.NilError(t, it.Err())
+	return u
+}
+
+func TestIterate(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "debug", "starting up"),
+		line("2", "service.bar", "info", "status=ok trace_id=abc"),
+		line("3", "service.foo", "warning", "status=failed trace_id=abc"),
+		line("4", "service.baz", "error", "something broke"),
+		line("5", "service.foo", "info", "[HTTP] GET /devices"),
+	)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		q    *LogQuery
+		want []string
+	}{
+		{"all", &LogQuery{}, []string{"1", "2", "3", "4", "5"}},
+		{"reverse", &LogQuery{Reverse: true}, []string{"5", "4", "3", "2", "1"}},
+		{"severity range", &LogQuery{MinSeverity: slog.InfoSeverity, MaxSeverity: slog.WarnSeverity}, []string{"2", "3", "5"}},
+		{"services", &LogQuery{Services: []string{"service.foo"}}, []string{"1", "3", "5"}},
+		{"exclude services", &LogQuery{ExcludeServices: []string{"service.foo"}}, []string{"2", "4"}},
+		{"message", &LogQuery{Message: "BROKE"}, []string{"4"}},
+		{"message prefix", &LogQuery{MessagePrefix: "[HTTP]"}, []string{"5"}},
+		{"fields", &LogQuery{Fields: []FieldFilter{{Key: "status", Op: "=", Value: "failed"}}}, []string{"3"}},
+		{"trace", &LogQuery{TraceID: "abc"}, []string{"2", "3"}},
+		{"inverted severity range", &LogQuery{MinSeverity: slog.ErrorSeverity, MaxSeverity: slog.InfoSeverity}, nil},
+		{"limit", &LogQuery{Limit: 2}, []string{"4", "5"}},
+		{"reverse limit", &LogQuery{Limit: 2, Reverse: true}, []string{"5", "4"}},
+		{"offset", &LogQuery{Offset: 2}, []string{"1", "2", "3"}},
+		{"reverse offset", &LogQuery{Offset: 2, Reverse: true}, []string{"3", "2", "1"}},
+		{"offset past the end", &LogQuery{Offset: 5}, nil},
+		{"page", &LogQuery{Limit: 2, Offset: 1}, []string{"3", "4"}},
+		{"reverse page", &LogQuery{Limit: 2, Offset: 1, Reverse: true}, []string{"4", "3"}},
+		{"filtered page", &LogQuery{Services: []string{"service.foo"}, Limit: 1, Offset: 1}, []string{"3"}},
+		{"tail", &LogQuery{Tail: 1}, []string{"5"}},
+		{"since uuid", &LogQuery{SinceUUID: "3"}, []string{"4", "5"}},
+		{"until uuid", &LogQuery{UntilUUID: "3", IncludeUntil: true}, []string{"1", "2", "3"}},
+		{"unknown until uuid", &LogQuery{UntilUUID: "missing"}, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := iterateUUIDs(t, r, tc.q)
+			assert.DeepEqual(t, got, tc.want)
+			assert.DeepEqual(t, got, uuids(t, r, tc.q))
+		})
+	}
+}
+
+func TestIterateDedupe(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "polling"),
+		line("2", "service.foo", "info", "polling"),
+		line("3", "service.foo", "info", "polling"),
+		line("4", "service.bar", "info", "polling"),
+		line("5", "service.foo", "info", "polling"),
+		line("6", "service.foo", "info", "done"),
+	)
+	defer cleanup()
+
+	for _, q := range []*LogQuery{
+		{Dedupe: true},
+		{Dedupe: true, Reverse: true},
+		{Dedupe: true, Limit: 1, Offset: 3},
+		{Dedupe: true, Offset: 1},
+	} {
+		it, err := r.Iterate(context.Background(), q)
+		assert.NilError(t, err)
+
+		var got []string
+		for it.Next() {
+			got = append(got, fmt.Sprintf("%s:%d", it.Event().UUID, it.Event().RepeatCount))
+		}
+		assert.NilError(t, it.Err())
+
+		// Runs are collapsed into their newest event in either order
+		events, err := r.Find(context.Background(), q)
+		assert.NilError(t, err)
+		var want []string
+		for _, e := range events {
+			want = append(want, fmt.Sprintf("%s:%d", e.UUID, e.RepeatCount))
+		}
+		assert.DeepEqual(t, got, want)
+	}
+
+	assert.DeepEqual(t, iterateUUIDs(t, r, &LogQuery{Dedupe: true}), []string{"3", "4", "5", "6"})
+}
+
+func TestIterateDays(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("3", "service.foo", "info", "c"),
+		line("4", "service.bar", "info", "d"),
+		line("5", "service.foo", "info", "e"),
+	)
+	defer cleanup()
+
+	// Write yesterday's events to another file
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	lines := ""
+	for _, uuid := range []string{"1", "2"} {
+		lines += fmt.Sprintf(`{"uuid":%q,"@timestamp":%q,"service":"service.foo","severity":"info","message":"a"}`+"\n", uuid, yesterday.Format(time.RFC3339))
+	}
+	filename := filepath.Join(r.LogDirectories[0], fmt.Sprintf("messages-%s", yesterday.Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(lines), 0644))
+
+	// Pages that span both days are the same as Find's
+	for offset := 0; offset <= 5; offset++ {
+		for limit := 0; limit <= 3; limit++ {
+			for _, reverse := range []bool{false, true} {
+				q := &LogQuery{Limit: limit, Offset: offset, Reverse: reverse}
+				assert.DeepEqual(t, iterateUUIDs(t, r, q), uuids(t, r, q))
+			}
+		}
+	}
+
+}
+
+func TestIterateCancelled(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+	)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it, err := r.Iterate(ctx, &LogQuery{})
+	assert.NilError(t, err)
+
+	// Nothing is read until the first call to Next
+	cancel()
+	assert.Assert(t, !it.Next())
+	assert.Equal(t, it.Err().(*errors.Error).Code, ErrCancelled)
+	assert.Assert(t, !it.Next())
+}
+
+func TestFindStream(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("3", "service.foo", "info", "c"),
+		line("4", "service.bar", "info", "d"),
+		line("5", "service.foo", "info", "e"),
+	)
+	defer cleanup()
+
+	// Write yesterday's events to another file
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	lines := ""
+	for _, uuid := range []string{"1", "2"} {
+		lines += fmt.Sprintf(`{"uuid":%q,"@timestamp":%q,"service":"service.foo","severity":"info","message":"a"}`+"\n", uuid, yesterday.Format(time.RFC3339))
+	}
+	filename := filepath.Join(r.LogDirectories[0], fmt.Sprintf("messages-%s", yesterday.Format("2006-01-02")))
+	assert.NilError(t, ioutil.WriteFile(filename, []byte(lines), 0644))
+
+	// Events are streamed in the same order as Find
+	q := &LogQuery{Services: []string{"service.foo"}}
+	assert.DeepEqual(t, streamUUIDs(t, r, q), []string{"1", "2", "3", "5"})
+	assert.DeepEqual(t, streamUUIDs(t, r, q), uuids(t, r, q))
+
+	q.Reverse = true
+	assert.DeepEqual(t, streamUUIDs(t, r, q), []string{"5", "3", "2", "1"})
+
+	// Queries that depend on the newest events are found first
+	q.Limit = 2
+	assert.DeepEqual(t, streamUUIDs(t, r, q), []string{"5", "3"})
+}
+
+func TestFindStreamStopsOnError(t *testing.T) {
+	r, cleanup := newTestRepository(t,
+		line("1", "service.foo", "info", "a"),
+		line("2", "service.foo", "info", "b"),
+	)
+	defer cleanup()
+
+	var n int
+	stop := fmt.Errorf("stop")
+	err := r.FindStream(context.Background(), &LogQuery{}, func(e *domain.Event) error {
+		n++
+		return stop
+	})
+	assert.Equal(t, err, stop)
+	assert.Equal(t, n, 1)
+}
@@ -0,0 +1,491 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/request"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+	"github.com/jakewright/home-automation/service.log/watch"
+)
+
+const (
+	// defaultQueryTimeout is used if Server.QueryTimeout is not set
+	defaultQueryTimeout = 10 * time.Second
+
+	// defaultWriteTimeout is used if Server.WriteTimeout is not set
+	defaultWriteTimeout = 10 * time.Second
+
+	// defaultWindow is used if Server.DefaultWindow is not set
+	defaultWindow = time.Hour
+)
+
+// Server streams events to clients that connect over a raw TCP socket,
+// for log shippers that do not speak HTTP. A client sends its query as a
+// single line of JSON and is then sent each matching event as a line of
+// JSON, first the events that already exist and then new events as they
+// are written, until either side closes the connection.
+type Server struct {
+	// Addr is the TCP address to listen on, e.g. ":7006"
+	Addr string
+
+	// LogRepository provides access to the existing events
+	LogRepository *repository.LogRepository
+
+	// Watcher provides new events as they are written
+	Watcher *watch.Watcher
+
+	// Tokens are the tokens that clients must send with their query,
+	// the same as the HTTP bearer tokens. If empty, every client is allowed.
+	Tokens []string
+
+	// QueryTimeout is how long a client has to send its query
+	// after connecting. Defaults to 10 seconds.
+	QueryTimeout time.Duration
+
+	// WriteTimeout is how long to wait for a client to accept
+	// an event before disconnecting it. Defaults to 10 seconds.
+	WriteTimeout time.Duration
+
+	// DefaultWindow is how far back to send existing events if a client's
+	// since_uuid is not found, e.g. because it has been purged, and it did
+	// not send a since_time. Defaults to one hour.
+	DefaultWindow time.Duration
+
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	stopped  bool
+	mux      sync.Mutex // Guards the listener, conns and stopped
+}
+
+// queryMessage is the first line sent by a client
+type queryMessage struct {
+	Token string `json:"token"`
+
+	Services        []string `json:"services"`
+	ExcludeServices []string `json:"exclude_services"`
+	Severity        string   `json:"severity"`
+	Message         string   `json:"message"`
+	MessagePattern  string   `json:"message_pattern"`
+	MessagePrefix   string   `json:"message_prefix"`
+	TraceID         string   `json:"trace_id"`
+	SourceFile      string   `json:"source_file"`
+	Fields          []string `json:"fields"`
+
+	// SinceTime and SinceUUID send the existing events after them before
+	// any new events, in the same way as since_uuid on the WebSocket
+	SinceTime time.Time `json:"since_time"`
+	SinceUUID string    `json:"since_uuid"`
+
+	// Backlog is the number of recent events to send before any new
+	// events. It is ignored if SinceTime or SinceUUID is set.
+	Backlog int `json:"backlog"`
+
+	// Buffer is the number of events that the subscription can hold,
+	// overriding the watcher's BufferSize
+	Buffer int `json:"buffer"`
+}
+
+// gapMessage is sent to the client when events have been dropped
+type gapMessage struct {
+	Type    string `json:"type"`
+	Dropped int    `json:"dropped"`
+}
+
+// GetName returns the name "tcp"
+func (s *Server) GetName() string {
+	return "tcp"
+}
+
+// Start listens on Addr and serves clients until Stop is called
+func (s *Server) Start() error {
+	// Make sure the receiver struct has been initialised properly
+	if s.LogRepository == nil {
+		return errors.InternalService("LogRepository is not set")
+	}
+	if s.Watcher == nil {
+		return errors.InternalService("Watcher is not set")
+	}
+
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return errors.Wrap(err, map[string]string{"addr": s.Addr})
+	}
+
+	slog.Info("Listening for TCP clients on %s", listener.Addr())
+	return s.serve(listener)
+}
+
+// serve accepts connections from the listener until it is closed
+func (s *Server) serve(listener net.Listener) error {
+	s.mux.Lock()
+	if s.stopped {
+		s.mux.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.mux.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isStopped() {
+				return nil
+			}
+			return errors.Wrap(err, nil)
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+
+		go func() {
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+// Stop closes the listener and disconnects every client.
+// It is safe to call Stop more than once.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+
+	slog.Info("Stopping TCP server with %d clients", len(s.conns))
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+// handle reads the client's query and then streams events to it
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	logger := slog.With(map[string]string{"remoteAddr": conn.RemoteAddr().String()})
+	enc := json.NewEncoder(conn)
+
+	// write sends v to the client as a line of JSON
+	write := func(v interface{}) error {
+		if err := conn.SetWriteDeadline(time.Now().Add(s.writeTimeout())); err != nil {
+			return err
+		}
+		return enc.Encode(v)
+	}
+
+	// The query is read before the client is authorised
+	// so limit its size in the same way as HTTP bodies
+	limited := &io.LimitedReader{R: conn, N: request.MaxBodyBytes}
+	reader := bufio.NewReader(limited)
+	if err := conn.SetReadDeadline(time.Now().Add(s.queryTimeout())); err != nil {
+		logger.Error("Failed to set read deadline: %v", err)
+		return
+	}
+	line, err := reader.ReadBytes('\n')
+	if err == io.EOF && limited.N <= 0 {
+		logger.Debug("Query is too long")
+		write(errors.BadRequest("query must not be longer than %d bytes", request.MaxBodyBytes))
+		return
+	} else if err != nil {
+		logger.Debug("Failed to read query: %v", err)
+		return
+	}
+	limited.N = math.MaxInt64
+
+	msg := &queryMessage{}
+	if err := json.Unmarshal(line, msg); err != nil {
+		logger.Debug("Invalid query: %v", err)
+		write(errors.BadRequest("invalid query: %v", err))
+		return
+	}
+
+	if !s.authorised(msg.Token) {
+		logger.Warn("Rejected unauthorised TCP client")
+		write(errors.Unauthorized("a valid token is required"))
+		return
+	}
+
+	query, err := msg.query()
+	if err != nil {
+		logger.Debug("Invalid query: %v", err)
+		write(err)
+		return
+	}
+
+	// Nothing else is expected from the client, so reading only returns
+	// once it disconnects. This is how a client that has gone away is
+	// noticed while there are no events to send it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		logger.Error("Failed to clear read deadline: %v", err)
+		return
+	}
+	go func() {
+		io.Copy(ioutil.Discard, reader)
+		cancel()
+	}()
+
+	send := func(event *domain.Event) error {
+		return write(event.Format())
+	}
+
+	if err := s.sendExisting(ctx, query, msg.Backlog, send); err != nil {
+		if !isCancelled(err) {
+			logger.Error("Failed to send existing events: %v", err)
+			write(errors.Wrap(err, nil))
+		}
+		return
+	}
+
+	// Subscribe to new events that match the query
+	events := s.Watcher.NewChannel(msg.Buffer)
+	if err := s.Watcher.Subscribe(events, query); err != nil {
+		logger.Error("Failed to subscribe to the watcher: %v", err)
+		write(err)
+		return
+	}
+	defer s.Watcher.Unsubscribe(events)
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				logger.Error("Events channel unexpectedly closed")
+				return
+			}
+
+			if err := send(event); err != nil {
+				logger.Debug("Failed to write event: %v", err)
+				return
+			}
+
+			// Let the client know if it has missed any events
+			if dropped := s.Watcher.TakeDropped(events); dropped > 0 {
+				if err := write(&gapMessage{Type: "gap", Dropped: dropped}); err != nil {
+					logger.Debug("Failed to write gap: %v", err)
+					return
+				}
+			}
+		case <-s.Watcher.Done():
+			// The service is shutting down so close the connection
+			return
+		case <-ctx.Done():
+			// The client has gone away so unsubscribe
+			logger.Debug("Client disconnected")
+			return
+		}
+	}
+}
+
+// sendExisting sends the events that already match the query, before any
+// new events, and moves SinceUUID on to the last of them so that a
+// subscription using the same query streams the events after them. If
+// there is no event with SinceUUID, the events in the default time window
+// are sent instead of every event.
+func (s *Server) sendExisting(ctx context.Context, query *repository.LogQuery, backlog int, send func(*domain.Event) error) error {
+	if query.SinceUUID != "" {
+		since, err := s.LogRepository.FindByUUID(ctx, query, query.SinceUUID)
+		if err != nil {
+			return err
+		}
+		if since == nil {
+			query.SinceUUID = ""
+			if query.SinceTime.IsZero() {
+				query.SinceTime = time.Now().Add(-s.defaultWindow())
+			}
+		}
+	}
+
+	q := *query
+	switch {
+	case query.SinceUUID != "" || !query.SinceTime.IsZero():
+	case backlog > 0:
+		q.Tail = backlog
+	default:
+		// Only new events are wanted
+		query.SinceTime = time.Now()
+		return nil
+	}
+
+	events, err := s.LogRepository.Find(ctx, &q)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	if len(events) == 0 {
+		if query.SinceTime.IsZero() {
+			query.SinceTime = time.Now()
+		}
+		return nil
+	}
+
+	// The backlog ignores the time window so bound the live events by
+	// time as well in case the event with SinceUUID is rotated away
+	last := events[len(events)-1]
+	query.SinceUUID = last.UUID
+	if last.Timestamp.After(query.SinceTime) {
+		query.SinceTime = last.Timestamp
+	}
+
+	return nil
+}
+
+// authorised returns whether the token is one of the server's tokens
+func (s *Server) authorised(token string) bool {
+	if len(s.Tokens) == 0 {
+		return true
+	}
+
+	// Compare in constant time so the token cannot be guessed from the
+	// response time. Every token is checked for the same reason.
+	var ok bool
+	for _, t := range s.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// query validates the message and returns the query that it describes
+func (msg *queryMessage) query() (*repository.LogQuery, error) {
+	if msg.Backlog < 0 {
+		return nil, errors.BadRequest("backlog must not be negative")
+	}
+
+	if msg.Buffer < 0 || msg.Buffer > watch.MaxBufferSize {
+		return nil, errors.BadRequest("buffer must be between 0 and %d", watch.MaxBufferSize)
+	}
+
+	var severity slog.Severity
+	if msg.Severity != "" {
+		var err error
+		severity, err = slog.ParseSeverity(msg.Severity)
+		if err != nil {
+			return nil, errors.BadRequest("invalid severity: %v", err)
+		}
+	}
+
+	var messageRegexp *regexp.Regexp
+	if msg.MessagePattern != "" {
+		var err error
+		messageRegexp, err = regexp.Compile(msg.MessagePattern)
+		if err != nil {
+			return nil, errors.BadRequest("invalid message_pattern: %v", err)
+		}
+	}
+
+	// Fields are conditions such as "status=failed" or "duration_ms>500"
+	var fields []repository.FieldFilter
+	for _, condition := range msg.Fields {
+		f, err := repository.ParseFieldFilter(condition)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+
+	return &repository.LogQuery{
+		Services:        msg.Services,
+		ExcludeServices: msg.ExcludeServices,
+		Severity:        severity,
+		Message:         msg.Message,
+		MessagePattern:  msg.MessagePattern,
+		MessageRegexp:   messageRegexp,
+		MessagePrefix:   msg.MessagePrefix,
+		TraceID:         strings.TrimSpace(msg.TraceID),
+		SourceFile:      strings.TrimSpace(msg.SourceFile),
+		Fields:          fields,
+		SinceTime:       msg.SinceTime,
+		SinceUUID:       msg.SinceUUID,
+	}, nil
+}
+
+// track records the connection so that Stop can close it. It returns
+// false if the server has been stopped and the connection should be closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.stopped {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) isStopped() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.stopped
+}
+
+func (s *Server) queryTimeout() time.Duration {
+	if s.QueryTimeout > 0 {
+		return s.QueryTimeout
+	}
+	return defaultQueryTimeout
+}
+
+func (s *Server) writeTimeout() time.Duration {
+	if s.WriteTimeout > 0 {
+		return s.WriteTimeout
+	}
+	return defaultWriteTimeout
+}
+
+func (s *Server) defaultWindow() time.Duration {
+	if s.DefaultWindow > 0 {
+		return s.DefaultWindow
+	}
+	return defaultWindow
+}
+
+// isCancelled returns whether the error is because the client went away
+func isCancelled(err error) bool {
+	e, ok := err.(*errors.Error)
+	return ok && e.Code == repository.ErrCancelled
+}
@@ -0,0 +1,197 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/request"
+	"github.com/jakewright/home-automation/service.log/repository"
+	"github.com/jakewright/home-automation/service.log/watch"
+
+	"gotest.tools/assert"
+)
+
+// newTestServer writes the lines to today's log file in a temporary
+// directory and starts a server that reads from it. The returned
+// function should be deferred to stop the server and remove the directory.
+func newTestServer(t *testing.T, lines ...string) (*Server, net.Addr, func()) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02")))
+	err = ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	assert.NilError(t, err)
+
+	r := repository.NewLogRepository(dir)
+	s := &Server{
+		LogRepository: r,
+		Watcher:       &watch.Watcher{LogRepository: r, MaxSubscribers: 1},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go s.serve(listener)
+
+	return s, listener.Addr(), func() {
+		s.Stop(context.Background())
+		os.RemoveAll(dir)
+	}
+}
+
+// line returns a JSON log line in the format written by logstash
+func line(uuid, service string) string {
+	return fmt.Sprintf(
+		`{"uuid":%q,"@timestamp":%q,"service":%q,"severity":"info","message":"hello"}`,
+		uuid, time.Now().UTC().Format(time.RFC3339), service,
+	)
+}
+
+// connect sends the query and returns a scanner over the lines sent back
+func connect(t *testing.T, addr net.Addr, query string) (net.Conn, *bufio.Scanner) {
+	conn, err := net.Dial("tcp", addr.String())
+	assert.NilError(t, err)
+	assert.NilError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	_, err = fmt.Fprintln(conn, query)
+	assert.NilError(t, err)
+
+	return conn, bufio.NewScanner(conn)
+}
+
+// next decodes the next line sent by the server
+func next(t *testing.T, scanner *bufio.Scanner) map[string]interface{} {
+	assert.Assert(t, scanner.Scan(), "no more lines")
+
+	var v map[string]interface{}
+	assert.NilError(t, json.Unmarshal(scanner.Bytes(), &v))
+	return v
+}
+
+func TestServerBacklog(t *testing.T) {
+	_, addr, cleanup := newTestServer(t,
+		line("1", "service.foo"),
+		line("2", "service.bar"),
+		line("3", "service.foo"),
+		line("4", "service.foo"),
+	)
+	defer cleanup()
+
+	conn, scanner := connect(t, addr, `{"services":["service.foo"],"backlog":2}`)
+	defer conn.Close()
+
+	assert.Equal(t, next(t, scanner)["UUID"], "3")
+	assert.Equal(t, next(t, scanner)["UUID"], "4")
+}
+
+func TestServerUnknownSinceUUID(t *testing.T) {
+	old := fmt.Sprintf(
+		`{"uuid":"old","@timestamp":%q,"service":"service.foo","severity":"info","message":"hello"}`,
+		time.Now().UTC().Add(-2*time.Hour).Format(time.RFC3339),
+	)
+	_, addr, cleanup := newTestServer(t, old, line("1", "service.foo"))
+	defer cleanup()
+
+	// Only the events in the default window are sent, not the whole history
+	conn, scanner := connect(t, addr, `{"since_uuid":"purged"}`)
+	defer conn.Close()
+
+	assert.Equal(t, next(t, scanner)["UUID"], "1")
+	assert.Assert(t, !scanner.Scan())
+}
+
+func TestServerQueryTooLong(t *testing.T) {
+	defer func(n int64) { request.MaxBodyBytes = n }(request.MaxBodyBytes)
+	request.MaxBodyBytes = 100
+
+	_, addr, cleanup := newTestServer(t)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", addr.String())
+	assert.NilError(t, err)
+	defer conn.Close()
+	assert.NilError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	// The query is rejected once the limit is reached,
+	// without waiting for the end of the line
+	_, err = fmt.Fprint(conn, `{"services":["`+strings.Repeat("a", 86))
+	assert.NilError(t, err)
+
+	scanner := bufio.NewScanner(conn)
+	assert.Equal(t, next(t, scanner)["code"], "bad_request")
+}
+
+func TestServerInvalidQuery(t *testing.T) {
+	_, addr, cleanup := newTestServer(t)
+	defer cleanup()
+
+	conn, scanner := connect(t, addr, `{"severity":"loud"}`)
+	defer conn.Close()
+
+	assert.Equal(t, next(t, scanner)["code"], "bad_request")
+
+	// The connection is closed after the error
+	assert.Assert(t, !scanner.Scan())
+}
+
+func TestServerToken(t *testing.T) {
+	s, addr, cleanup := newTestServer(t, line("1", "service.foo"))
+	defer cleanup()
+	s.Tokens = []string{"secret"}
+
+	conn, scanner := connect(t, addr, `{"token":"wrong","backlog":1}`)
+	defer conn.Close()
+	assert.Equal(t, next(t, scanner)["code"], "unauthorized")
+
+	conn, scanner = connect(t, addr, `{"token":"secret","backlog":1}`)
+	defer conn.Close()
+	assert.Equal(t, next(t, scanner)["UUID"], "1")
+}
+
+func TestServerUnsubscribesOnDisconnect(t *testing.T) {
+	_, addr, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// subscribed returns whether another client can subscribe. The watcher
+	// only allows one subscriber so this is false while the first is connected.
+	subscribed := func() bool {
+		conn, scanner := connect(t, addr, `{}`)
+		defer conn.Close()
+
+		assert.NilError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		if !scanner.Scan() {
+			// Nothing was sent before the read deadline
+			return true
+		}
+
+		var rsp map[string]interface{}
+		assert.NilError(t, json.Unmarshal(scanner.Bytes(), &rsp))
+		assert.Equal(t, rsp["code"], watch.ErrTooManySubscribers)
+		return false
+	}
+
+	first, _ := connect(t, addr, `{}`)
+	defer first.Close()
+
+	// Wait for the first client to be subscribed
+	deadline := time.Now().Add(time.Second)
+	for subscribed() {
+		assert.Assert(t, time.Now().Before(deadline), "first client was not subscribed")
+	}
+
+	first.Close()
+
+	deadline = time.Now().Add(time.Second)
+	for !subscribed() {
+		assert.Assert(t, time.Now().Before(deadline), "first client was not unsubscribed")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,12 +2,18 @@ package watch
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jakewright/home-automation/libraries/go/errors"
 	"github.com/jakewright/home-automation/libraries/go/slog"
 	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/live"
+	"github.com/jakewright/home-automation/service.log/metrics"
 	"github.com/jakewright/home-automation/service.log/repository"
 
 	"github.com/fsnotify/fsnotify"
@@ -18,13 +24,114 @@ type Watcher struct {
 	// LogDAO provides access to the log events
 	LogRepository *repository.LogRepository
 
-	subscribers map[chan<- *domain.Event]*repository.LogQuery
-	mux         sync.Mutex        // Concurrent map access
-	notify      chan struct{}     // Triggers reading new events from the log files
-	ticker      *time.Ticker      // Used as a rate limiter
+	// DebounceWindow is how long to wait after a write before reading new
+	// events. Each write in the window restarts it so a burst of writes
+	// only triggers one read. Defaults to 100 milliseconds.
+	DebounceWindow time.Duration
+
+	// SendTimeout is how long to wait for a subscriber to receive
+	// an event before dropping it. Defaults to 200 milliseconds.
+	SendTimeout time.Duration
+
+	// MaxSubscribers is the most channels that can be subscribed at
+	// once. Each subscriber costs a Find on every write so this caps
+	// the work done per write. There is no limit if it is zero.
+	// It is replaced by Live's MaxSubscribers once Live holds settings.
+	MaxSubscribers int
+
+	// MaxEventsPerSecond is the most events that are sent to each
+	// subscriber per second. Any more are dropped so that a subscriber
+	// with a broad query is not flooded during a burst of logs. There
+	// is no limit if it is zero. It is replaced by Live's
+	// MaxEventsPerSecond once Live holds settings. Subscribers keep the
+	// limit that they subscribed with.
+	MaxEventsPerSecond int
+
+	// Live holds the settings that are reloaded while the watcher is running
+	Live *live.Value
+
+	// BufferSize is the number of events that each subscriber's channel
+	// can hold. A bigger buffer absorbs longer bursts without dropping
+	// events but costs more memory per subscriber. Defaults to 50.
+	BufferSize int
+
+	subscribers map[chan<- *domain.Event]*subscriber
+	mux         sync.Mutex        // Concurrent map access, done and watcher
+	done        chan struct{}     // Closed when the watcher is stopped
+	stopOnce    sync.Once         // Makes Stop safe to call more than once
 	watcher     *fsnotify.Watcher // Internal file watcher
 }
 
+// subscriber holds the state for a single subscription
+type subscriber struct {
+	// query is used to find new events for the subscriber
+	query *repository.LogQuery
+
+	// dropped is the number of events that could not be sent before
+	// the send timeout. It is reset when read by TakeDropped and
+	// must only be accessed atomically.
+	dropped int64
+
+	// maxRate is the most events per second that are
+	// sent to the subscriber. There is no limit if it is zero.
+	maxRate int
+
+	// windowStart and windowSent count the events sent in the current
+	// second. They are only accessed by the goroutine sending events.
+	windowStart time.Time
+	windowSent  int
+}
+
+// allow returns whether another event can be sent to the subscriber
+// at the given time without going over its rate limit
+func (s *subscriber) allow(now time.Time) bool {
+	if s.maxRate <= 0 {
+		return true
+	}
+
+	if now.Sub(s.windowStart) >= time.Second {
+		s.windowStart = now
+		s.windowSent = 0
+	}
+
+	if s.windowSent >= s.maxRate {
+		return false
+	}
+
+	s.windowSent++
+	return true
+}
+
+const (
+	// defaultDebounceWindow is used if Watcher.DebounceWindow is not set
+	defaultDebounceWindow = 100 * time.Millisecond
+
+	// maxDebounceWindows is the most windows that a burst of writes can
+	// extend the debounce for before subscribers are notified anyway
+	maxDebounceWindows = 10
+
+	// defaultSendTimeout is used if Watcher.SendTimeout is not set
+	defaultSendTimeout = 200 * time.Millisecond
+
+	// defaultBufferSize is used if Watcher.BufferSize is not set
+	defaultBufferSize = 50
+
+	// retryInterval is how long to wait before trying again to watch
+	// log directories that could not be watched after a rotation
+	retryInterval = 2 * time.Second
+)
+
+// MaxBufferSize is the largest buffer that a subscriber can ask for
+const MaxBufferSize = 10000
+
+// ErrTooManySubscribers is the code of the error returned
+// by Subscribe when MaxSubscribers has been reached
+const ErrTooManySubscribers = "too_many_subscribers"
+
+// ErrStopped is the code of the error returned by
+// Subscribe when the watcher has been stopped
+const ErrStopped = "watcher_stopped"
+
 // GetName returns the name "watcher"
 func (w *Watcher) GetName() string {
 	return "watcher"
@@ -36,10 +143,13 @@ func (w *Watcher) Start() error {
 	if w.LogRepository == nil {
 		return errors.InternalService("LogRepository is not set")
 	}
-	if w.LogRepository.LogDirectory == "" {
-		return errors.InternalService("Log directory is not set")
+	if len(w.LogRepository.LogDirectories) == 0 {
+		return errors.InternalService("Log directories are not set")
 	}
 
+	// Everything started below exits once done is closed by Stop
+	done := w.Done()
+
 	// Create an fsnotify watcher and attach to w so
 	// that the Stop method can call Close() on it
 	watcher, err := fsnotify.NewWatcher()
@@ -47,30 +157,53 @@ func (w *Watcher) Start() error {
 		return errors.Wrap(err, nil)
 	}
 	defer watcher.Close()
+
+	w.mux.Lock()
 	w.watcher = watcher
+	w.mux.Unlock()
 
-	// Start watching the log file directory so we
+	// Start watching the log file directories so we
 	// are notified when new log files are created
-	if err = watcher.Add(w.LogRepository.LogDirectory); err != nil {
-		return errors.Wrap(err, nil)
+	if err = w.addDirectories(watcher); err != nil {
+		return err
 	}
-	slog.Info("Watching %s for changes", w.LogRepository.LogDirectory)
+	slog.Info("Watching %s for changes", strings.Join(w.LogRepository.LogDirectories, ", "))
 
 	// Create a notification channel with a buffer of 1 so
 	// that we can always queue a new event while the current
 	// one is in process. If the channel was unbuffered, we would
 	// risk missing events if the notifier were not ready to
 	// receive when the file write happened.
-	w.notify = make(chan struct{}, 1)
+	notify := make(chan struct{}, 1)
 
 	// Create a ticker to act as the rate limiter when notifying
 	// subscribers. Without this then we risk thrashing the disk.
-	w.ticker = time.NewTicker(time.Second * 2)
-
-	go w.notifySubscribers()
+	ticker := time.NewTicker(time.Second * 2)
+	defer ticker.Stop()
+
+	go w.notifySubscribers(notify, ticker, done)
+
+	// The debounce timer is replaced rather than reset on each write,
+	// which avoids having to drain the channel of a timer that fired.
+	// The debounce channel is nil, and so blocks, when no timer is running.
+	var timer *time.Timer
+	var debounce <-chan time.Time
+	var burstStart time.Time
+
+	// The retry channel is nil, and so blocks, unless a directory
+	// could not be watched again after a rotation
+	var retry <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
 
 	for {
 		select {
+		case <-done:
+			return nil
+
 		case fileEvent, ok := <-watcher.Events:
 			if !ok {
 				// If the channel is closed then just exit silently
@@ -81,14 +214,61 @@ func (w *Watcher) Start() error {
 			// We'll get a write event if any file inside the directory is written to.
 			// If the file isn't actually a log file we'll waste some work
 			// trying to read new events but it's safe to do.
-			if fileEvent.Op&fsnotify.Write != fsnotify.Write {
+			switch {
+			case fileEvent.Op&fsnotify.Write == fsnotify.Write:
+			case fileEvent.Op&(fsnotify.Create|fsnotify.Rename) != 0:
+				// When a log file is rotated, it is renamed and a new file
+				// is created in its place. Add the directory again in case
+				// it was the directory itself that was replaced, and then
+				// read the new file in case it was written to straight away.
+				slog.Debug("Log file rotation detected: %s", fileEvent)
+				if err := w.addDirectories(watcher); err != nil && retry == nil {
+					// The other directories are still watched so keep going
+					// in case the directory is about to be created again
+					slog.Error("Failed to watch log directories, retrying in %s: %v", retryInterval, err)
+					retry = time.After(retryInterval)
+				}
+			default:
+				continue
+			}
+
+			// Restart the debounce window, unless writes have been arriving
+			// for so long that subscribers would never be notified otherwise
+			window := w.debounceWindow()
+			if timer == nil {
+				burstStart = time.Now()
+			} else if time.Since(burstStart) < window*maxDebounceWindows {
+				timer.Stop()
+			} else {
+				continue
+			}
+			timer = time.NewTimer(window)
+			debounce = timer.C
+
+		case <-retry:
+			retry = nil
+			if err := w.addDirectories(watcher); err != nil {
+				slog.Error("Failed to watch log directories, retrying in %s: %v", retryInterval, err)
+				retry = time.After(retryInterval)
 				continue
 			}
+			slog.Info("Watching %s for changes", strings.Join(w.LogRepository.LogDirectories, ", "))
+
+			// Files may have been written while a directory was not watched
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+
+		case <-debounce:
+			// No writes have happened for a whole window
+			timer = nil
+			debounce = nil
 
 			// Write to the notify channel but do not block.
 			// If the channel is not ready to receive then skip.
 			select {
-			case w.notify <- struct{}{}:
+			case notify <- struct{}{}:
 			default:
 			}
 
@@ -106,16 +286,58 @@ func (w *Watcher) Start() error {
 	}
 }
 
-// Stop stops watching for log file changes
+// addDirectories adds each of the log directories to the fsnotify watcher.
+// A directory that cannot be added does not stop the others from being
+// added. The first error is returned.
+func (w *Watcher) addDirectories(watcher *fsnotify.Watcher) error {
+	var firstErr error
+	for _, dir := range w.LogRepository.LogDirectories {
+		if err := watcher.Add(dir); err != nil && firstErr == nil {
+			firstErr = errors.Wrap(err, map[string]string{"directory": dir})
+		}
+	}
+	return firstErr
+}
+
+// Stop stops watching for log file changes. Subscribers are removed and
+// the channel returned by Done is closed so that they can shut down cleanly.
+// It is safe to call Stop more than once.
 func (w *Watcher) Stop(ctx context.Context) error {
-	w.ticker.Stop()
-	close(w.notify)
+	var err error
+	w.stopOnce.Do(func() {
+		w.mux.Lock()
+		if w.done == nil {
+			w.done = make(chan struct{})
+		}
+		close(w.done)
+		slog.Info("Stopping watcher with %d subscribers", len(w.subscribers))
+		metrics.Subscribers.Sub(float64(len(w.subscribers)))
+		w.subscribers = nil
+		watcher := w.watcher
+		w.mux.Unlock()
+
+		// Start returns once it sees that done is closed, stopping the
+		// debounce timer and the ticker. The file watcher is nil if Start
+		// was never called. Closing it here releases it straight away.
+		if watcher != nil {
+			err = watcher.Close()
+		}
+	})
 
-	if w.watcher != nil {
-		return w.watcher.Close()
+	return err
+}
+
+// Done returns a channel that is closed when the watcher is stopped.
+// Subscribers will receive no more events after this.
+func (w *Watcher) Done() <-chan struct{} {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.done == nil {
+		w.done = make(chan struct{})
 	}
 
-	return nil
+	return w.done
 }
 
 // Subscribe starts sending all events that match the query over the given channel. The query
@@ -125,13 +347,44 @@ func (w *Watcher) Subscribe(c chan<- *domain.Event, q *repository.LogQuery) erro
 	w.mux.Lock()
 	defer w.mux.Unlock()
 
+	// Don't accept subscribers that would never be sent anything
+	if w.done != nil {
+		select {
+		case <-w.done:
+			return &errors.Error{
+				Code:    ErrStopped,
+				Message: "watcher has been stopped",
+			}
+		default:
+		}
+	}
+
 	// Initialise the map if necessary
 	if w.subscribers == nil {
-		w.subscribers = make(map[chan<- *domain.Event]*repository.LogQuery)
+		w.subscribers = make(map[chan<- *domain.Event]*subscriber)
+	}
+
+	// Subscribers that are already over a reloaded limit are not removed
+	maxSubscribers, maxRate := w.MaxSubscribers, w.MaxEventsPerSecond
+	if s := w.Live.Load(); s != nil {
+		maxSubscribers, maxRate = s.MaxSubscribers, s.MaxEventsPerSecond
+	}
+
+	if maxSubscribers > 0 && len(w.subscribers) >= maxSubscribers {
+		slog.Warn("Rejecting subscriber: %d of %d subscribers already connected", len(w.subscribers), maxSubscribers)
+		return &errors.Error{
+			Code:    ErrTooManySubscribers,
+			Message: fmt.Sprintf("too many subscribers, the maximum is %d", maxSubscribers),
+			Metadata: map[string]string{
+				"subscribers": strconv.Itoa(len(w.subscribers)),
+			},
+		}
 	}
 
 	// A channel is comparable so it's fine to use as a key
-	w.subscribers[c] = q
+	w.subscribers[c] = &subscriber{query: q, maxRate: maxRate}
+	metrics.Subscriptions.Inc()
+	metrics.Subscribers.Inc()
 
 	return nil
 }
@@ -140,16 +393,61 @@ func (w *Watcher) Subscribe(c chan<- *domain.Event, q *repository.LogQuery) erro
 func (w *Watcher) Unsubscribe(c chan<- *domain.Event) {
 	w.mux.Lock()
 	defer w.mux.Unlock()
-	delete(w.subscribers, c)
+
+	if _, ok := w.subscribers[c]; ok {
+		delete(w.subscribers, c)
+		metrics.Subscribers.Dec()
+	}
+}
+
+// UpdateQuery calls update with the query of the subscriber while holding the
+// lock, so that the subscriber's filters can be changed while it is subscribed.
+// It returns false, without calling update, if the channel is not subscribed.
+func (w *Watcher) UpdateQuery(c chan<- *domain.Event, update func(q *repository.LogQuery)) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	s, ok := w.subscribers[c]
+	if !ok {
+		return false
+	}
+
+	update(s.query)
+	return true
+}
+
+// TakeDropped returns the number of events that have been dropped for the
+// subscriber since the last call, because it did not receive them within the
+// send timeout, and resets the count to zero. Zero is returned if the channel is not subscribed.
+func (w *Watcher) TakeDropped(c chan<- *domain.Event) int {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	s, ok := w.subscribers[c]
+	if !ok {
+		return 0
+	}
+
+	return int(atomic.SwapInt64(&s.dropped, 0))
 }
 
-// notifySubscribers finds and sends new events to all subscribers
-// whenever the notify channel is written to, rate limited by w.ticker.
-func (w *Watcher) notifySubscribers() {
-	// Read notify events until the channel is closed
-	for range w.notify {
+// notifySubscribers finds and sends new events to all subscribers whenever
+// the notify channel is written to, rate limited by the ticker, until done
+// is closed
+func (w *Watcher) notifySubscribers(notify <-chan struct{}, ticker *time.Ticker, done <-chan struct{}) {
+	for {
+		select {
+		case <-notify:
+		case <-done:
+			return
+		}
+
 		// Block on the ticker to rate limit
-		<-w.ticker.C
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
 
 		w.findAndSendEvents()
 	}
@@ -158,34 +456,144 @@ func (w *Watcher) notifySubscribers() {
 // findAndSendEvents will find all new events for each subscriber
 // and send them over the subscribers' channels
 func (w *Watcher) findAndSendEvents() {
-	// Obtain a write lock before doing anything so that
-	// we don't send duplicate events to the subscriber
+	// Take a copy of the subscribers so that the lock is not held while
+	// sending. A slow subscriber would otherwise block Subscribe,
+	// Unsubscribe and TakeDropped for the duration of the send timeout.
+	// This is only ever called from one goroutine so events will not be
+	// sent to a subscriber twice.
 	w.mux.Lock()
-	defer w.mux.Unlock()
+	subscribers := make(map[chan<- *domain.Event]*subscriber, len(w.subscribers))
+	queries := make(map[chan<- *domain.Event]repository.LogQuery, len(w.subscribers))
+	for c, s := range w.subscribers {
+		subscribers[c] = s
 
-	for c, q := range w.subscribers {
-		// Ensure that events are always published in order
-		q.Reverse = false
+		// Queries can be changed by UpdateQuery so take a copy of each one
+		queries[c] = *s.query
+	}
+	w.mux.Unlock()
+
+	// Abandon any read that is in progress if the watcher is stopped
+	ctx, cancel := w.stopContext()
+	defer cancel()
+
+	// Each subscriber is sent its events in its own goroutine so
+	// that a slow subscriber does not hold up the others
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for c, s := range subscribers {
+		q := queries[c]
 
-		// Get all new events for this subscriber
-		events, err := w.LogRepository.Find(q)
-		if err != nil {
+		// Ensure that events are always published in order, and
+		// never again once the subscriber's SinceUUID has moved on
+		q.Reverse = false
+		q.SinceUUIDInclusive = false
+
+		// Get all new events for this subscriber. Once the subscriber has
+		// been sent an event, only the log since that event needs reading.
+		events, err := w.LogRepository.FindSince(ctx, &q)
+		if e, ok := err.(*errors.Error); ok && e.Code == repository.ErrCancelled {
+			return
+		} else if err != nil {
 			slog.Error("Failed to get events for subscriber: %v", err)
 			continue
 		}
 
-		// Send the events over the channel
-		for _, event := range events {
-			select {
-			case c <- event: // Non-blocking write to the channel
-			default: // Don't log otherwise we get a cycle of logs
-			}
+		if len(events) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(c chan<- *domain.Event, s *subscriber, events []*domain.Event) {
+			defer wg.Done()
+			w.sendEvents(c, s, events)
+		}(c, s, events)
+	}
+}
+
+// sendEvents sends the events to the subscriber and moves its query on
+// past them. Events that are over the subscriber's rate limit, or that
+// it does not receive within the send timeout, are counted as dropped.
+func (w *Watcher) sendEvents(c chan<- *domain.Event, s *subscriber, events []*domain.Event) {
+	timeout := w.sendTimeout()
+	done := w.Done()
+
+	// Send the events over the channel, giving a
+	// busy subscriber a short time to catch up
+	for _, event := range events {
+		if !s.allow(time.Now()) {
+			atomic.AddInt64(&s.dropped, 1)
+			metrics.DroppedEvents.Inc()
+			continue
 		}
 
-		// Update the query for this subscriber
-		if len(events) > 0 {
-			// Events will always be in order so we can take the UUID of the last one
-			q.SinceUUID = events[len(events)-1].UUID
+		select {
+		case c <- event:
+		case <-time.After(timeout): // Don't log otherwise we get a cycle of logs
+			atomic.AddInt64(&s.dropped, 1)
+			metrics.DroppedEvents.Inc()
+		case <-done:
+			return
 		}
 	}
+
+	// Events will always be in order so we can take the UUID of the last one
+	last := events[len(events)-1]
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	s.query.SinceUUID = last.UUID
+
+	// If the log file is rotated, the event with SinceUUID will no longer
+	// be in the current file and Find would carry on reading older files.
+	// Also bound the query by time so only events in the new file are found.
+	if last.Timestamp.After(s.query.SinceTime) {
+		s.query.SinceTime = last.Timestamp
+	}
+}
+
+// stopContext returns a context that is cancelled when the watcher is stopped
+func (w *Watcher) stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-w.Done():
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+func (w *Watcher) debounceWindow() time.Duration {
+	if w.DebounceWindow > 0 {
+		return w.DebounceWindow
+	}
+	return defaultDebounceWindow
+}
+
+// NewChannel returns a channel to subscribe with. Its buffer holds size
+// events, up to MaxBufferSize, or the watcher's BufferSize if size is zero.
+func (w *Watcher) NewChannel(size int) chan *domain.Event {
+	if size <= 0 {
+		size = w.bufferSize()
+	}
+	if size > MaxBufferSize {
+		size = MaxBufferSize
+	}
+	return make(chan *domain.Event, size)
+}
+
+func (w *Watcher) bufferSize() int {
+	if w.BufferSize > 0 {
+		return w.BufferSize
+	}
+	return defaultBufferSize
+}
+
+func (w *Watcher) sendTimeout() time.Duration {
+	if w.SendTimeout > 0 {
+		return w.SendTimeout
+	}
+	return defaultSendTimeout
 }
@@ -0,0 +1,385 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakewright/home-automation/libraries/go/errors"
+	"github.com/jakewright/home-automation/libraries/go/slog"
+	"github.com/jakewright/home-automation/service.log/domain"
+	"github.com/jakewright/home-automation/service.log/repository"
+
+	"gotest.tools/assert"
+)
+
+// newTestWatcher writes n events to today's log file in a temporary
+// directory and returns a watcher that reads from it. The returned
+// function should be deferred to remove the directory.
+func newTestWatcher(t *testing.T, n int) (*Watcher, func()) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+
+	var lines []string
+	for i := 0; i < n; i++ {
+		lines = append(lines, line(fmt.Sprintf("%d", i), time.Now()))
+	}
+	writeLogFile(t, dir, time.Now(), "", lines...)
+
+	w := &Watcher{
+		LogRepository: &repository.LogRepository{LogDirectories: []string{dir}},
+	}
+
+	return w, func() { os.RemoveAll(dir) }
+}
+
+// writeLogFile writes the lines to the log file for the given date
+func writeLogFile(t *testing.T, dir string, date time.Time, suffix string, lines ...string) {
+	filename := filepath.Join(dir, fmt.Sprintf("messages-%s%s", date.UTC().Format("2006-01-02"), suffix))
+	err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	assert.NilError(t, err)
+}
+
+// line returns a JSON log line in the format written by logstash
+func line(uuid string, timestamp time.Time) string {
+	return fmt.Sprintf(
+		`{"uuid":%q,"@timestamp":%q,"service":"service.foo","severity":"info","message":"hello"}`,
+		uuid, timestamp.UTC().Format(time.RFC3339),
+	)
+}
+
+// receive returns the UUIDs of all events currently buffered in the channel
+func receive(c chan *domain.Event) []string {
+	var uuids []string
+	for {
+		select {
+		case e := <-c:
+			uuids = append(uuids, e.UUID)
+		default:
+			return uuids
+		}
+	}
+}
+
+func TestFindAndSendEventsSlowConsumer(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 5)
+	defer cleanup()
+
+	c := make(chan *domain.Event, 1)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{}))
+
+	// Receive events slowly, but well within the send timeout
+	received := make(chan int)
+	go func() {
+		var n int
+		for range c {
+			n++
+			if n == 5 {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		received <- n
+	}()
+
+	w.findAndSendEvents()
+
+	select {
+	case n := <-received:
+		assert.Equal(t, n, 5)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for events")
+	}
+
+	assert.Equal(t, w.TakeDropped(c), 0)
+}
+
+func TestFindAndSendEventsDropsAfterTimeout(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 3)
+	defer cleanup()
+	w.SendTimeout = 10 * time.Millisecond
+
+	// Nothing reads from the channel so only the first event fits
+	c := make(chan *domain.Event, 1)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{}))
+
+	w.findAndSendEvents()
+
+	assert.Equal(t, w.TakeDropped(c), 2)
+	assert.Equal(t, w.TakeDropped(c), 0)
+}
+
+func TestFindAndSendEventsBufferSize(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 20)
+	defer cleanup()
+	w.SendTimeout = 10 * time.Millisecond
+	w.BufferSize = 5
+
+	// Nothing reads from the channels so the burst only fits in the larger buffer
+	small := w.NewChannel(0)
+	large := w.NewChannel(20)
+	assert.NilError(t, w.Subscribe(small, &repository.LogQuery{}))
+	assert.NilError(t, w.Subscribe(large, &repository.LogQuery{}))
+
+	w.findAndSendEvents()
+
+	assert.Equal(t, w.TakeDropped(small), 15)
+	assert.Equal(t, w.TakeDropped(large), 0)
+	assert.Equal(t, len(receive(large)), 20)
+
+	assert.Equal(t, cap(w.NewChannel(MaxBufferSize+1)), MaxBufferSize)
+	assert.Equal(t, cap((&Watcher{}).NewChannel(0)), defaultBufferSize)
+}
+
+func TestFindAndSendEventsRateLimit(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 10)
+	defer cleanup()
+	w.MaxEventsPerSecond = 4
+
+	c := make(chan *domain.Event, 10)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{}))
+
+	w.findAndSendEvents()
+
+	// Only the first events in the second are sent and the rest are dropped
+	assert.DeepEqual(t, receive(c), []string{"0", "1", "2", "3"})
+	assert.Equal(t, w.TakeDropped(c), 6)
+}
+
+func TestFindAndSendEventsNoisySubscriber(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 20)
+	defer cleanup()
+	w.SendTimeout = time.Second
+
+	// Add an event that only the quiet subscriber is interested in
+	dir := w.LogRepository.LogDirectories[0]
+	quiet := strings.Replace(line("quiet", time.Now()), "service.foo", "service.bar", 1)
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("messages-%s", time.Now().UTC().Format("2006-01-02"))), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NilError(t, err)
+	_, err = fmt.Fprintln(f, quiet)
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+
+	// Nothing reads from the noisy subscriber's channel
+	// so each of its events waits for the send timeout
+	noisy := make(chan *domain.Event)
+	assert.NilError(t, w.Subscribe(noisy, &repository.LogQuery{}))
+
+	c := make(chan *domain.Event, 1)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{Services: []string{"service.bar"}}))
+
+	go w.findAndSendEvents()
+	defer w.Stop(context.Background())
+
+	select {
+	case e := <-c:
+		assert.Equal(t, e.UUID, "quiet")
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Quiet subscriber was blocked by the noisy one")
+	}
+}
+
+func TestFindAndSendEventsAfterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().Truncate(time.Second)
+	yesterday := now.AddDate(0, 0, -1)
+
+	writeLogFile(t, dir, yesterday, "", line("old", yesterday))
+	writeLogFile(t, dir, now, "", line("1", now.Add(-2*time.Second)), line("2", now.Add(-time.Second)))
+
+	w := &Watcher{
+		LogRepository: &repository.LogRepository{LogDirectories: []string{dir}},
+	}
+
+	c := make(chan *domain.Event, 10)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{SinceTime: yesterday.Add(-time.Hour)}))
+
+	w.findAndSendEvents()
+	assert.DeepEqual(t, receive(c), []string{"old", "1", "2"})
+
+	// Simulate logrotate renaming the file and creating a new one
+	today := filepath.Join(dir, fmt.Sprintf("messages-%s", now.UTC().Format("2006-01-02")))
+	assert.NilError(t, os.Rename(today, today+".1"))
+	writeLogFile(t, dir, now, "", line("3", now))
+
+	// Only the event in the new file should be sent, not yesterday's
+	w.findAndSendEvents()
+	assert.DeepEqual(t, receive(c), []string{"3"})
+}
+
+func TestSubscribeMaxSubscribers(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 0)
+	defer cleanup()
+	w.MaxSubscribers = 1
+
+	c1 := make(chan *domain.Event)
+	assert.NilError(t, w.Subscribe(c1, &repository.LogQuery{}))
+
+	c2 := make(chan *domain.Event)
+	err := w.Subscribe(c2, &repository.LogQuery{})
+	assert.Assert(t, err != nil)
+	assert.Equal(t, err.(*errors.Error).Code, ErrTooManySubscribers)
+
+	// There is room again after unsubscribing
+	w.Unsubscribe(c1)
+	assert.NilError(t, w.Subscribe(c2, &repository.LogQuery{}))
+}
+
+func TestUpdateQuery(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 3)
+	defer cleanup()
+
+	c := make(chan *domain.Event, 10)
+	assert.Equal(t, w.UpdateQuery(c, func(*repository.LogQuery) {}), false)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{}))
+
+	// The events are all info so none should be sent
+	assert.Equal(t, w.UpdateQuery(c, func(q *repository.LogQuery) {
+		q.Severity = slog.ErrorSeverity
+	}), true)
+	w.findAndSendEvents()
+	assert.Equal(t, len(receive(c)), 0)
+
+	w.UpdateQuery(c, func(q *repository.LogQuery) {
+		q.Severity = slog.InfoSeverity
+	})
+	w.findAndSendEvents()
+	assert.DeepEqual(t, receive(c), []string{"0", "1", "2"})
+}
+
+func TestFindAndSendEventsExcludesSince(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 3)
+	defer cleanup()
+
+	// The subscriber has already been sent the SinceUUID event so it
+	// is not sent again, even if the query would include it
+	c := make(chan *domain.Event, 10)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{SinceUUID: "0", SinceUUIDInclusive: true}))
+
+	w.findAndSendEvents()
+	assert.DeepEqual(t, receive(c), []string{"1", "2"})
+
+	w.findAndSendEvents()
+	assert.Equal(t, len(receive(c)), 0)
+}
+
+func TestStopUnblocksSubscriber(t *testing.T) {
+	w, cleanup := newTestWatcher(t, 0)
+	defer cleanup()
+
+	c := make(chan *domain.Event)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{}))
+
+	unblocked := make(chan struct{})
+	go func() {
+		select {
+		case <-c:
+		case <-w.Done():
+		}
+		close(unblocked)
+	}()
+
+	assert.NilError(t, w.Stop(context.Background()))
+
+	select {
+	case <-unblocked:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for subscriber to unblock")
+	}
+
+	// Stopping again is safe
+	assert.NilError(t, w.Stop(context.Background()))
+
+	err := w.Subscribe(make(chan *domain.Event), &repository.LogQuery{})
+	assert.Assert(t, err != nil)
+	assert.Equal(t, err.(*errors.Error).Code, ErrStopped)
+}
+
+func TestStartStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	w := &Watcher{
+		LogRepository:  &repository.LogRepository{LogDirectories: []string{dir}},
+		DebounceWindow: time.Millisecond,
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- w.Start()
+	}()
+
+	// Writes while stopping must not send on anything that has been closed
+	writeLogFile(t, dir, time.Now(), "", line("1", time.Now()))
+	time.Sleep(10 * time.Millisecond)
+	assert.NilError(t, w.Stop(context.Background()))
+	writeLogFile(t, dir, time.Now(), "", line("2", time.Now()))
+
+	select {
+	case err := <-started:
+		assert.NilError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+}
+
+func TestStartKeepsWatchingAfterFailedRotation(t *testing.T) {
+	a, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(a)
+
+	b, err := ioutil.TempDir("", "service.log")
+	assert.NilError(t, err)
+	defer os.RemoveAll(b)
+
+	w := &Watcher{
+		LogRepository:  &repository.LogRepository{LogDirectories: []string{a, b}},
+		DebounceWindow: time.Millisecond,
+	}
+	defer w.Stop(context.Background())
+
+	c := make(chan *domain.Event, 10)
+	assert.NilError(t, w.Subscribe(c, &repository.LogQuery{}))
+
+	started := make(chan error, 1)
+	go func() {
+		started <- w.Start()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Creating a file makes the watcher add the directories again,
+	// which fails because one of them has been removed
+	assert.NilError(t, os.RemoveAll(b))
+	writeLogFile(t, a, time.Now(), "", line("1", time.Now()))
+
+	select {
+	case e := <-c:
+		assert.Equal(t, e.UUID, "1")
+	case err := <-started:
+		t.Fatalf("Start returned: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+
+	// The removed directory is watched again once it is back
+	assert.NilError(t, os.Mkdir(b, 0755))
+	writeLogFile(t, b, time.Now(), "", line("2", time.Now().Add(time.Second)))
+
+	select {
+	case e := <-c:
+		assert.Equal(t, e.UUID, "2")
+	case err := <-started:
+		t.Fatalf("Start returned: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+}